@@ -0,0 +1,157 @@
+// Package archive reads and writes library archives, which are gzipped tar
+// streams of a manifest, tables of records in NDJSON and blobs.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Version is the version of the archive layout.
+const Version = 1
+
+// Names of entries.
+const (
+	ManifestName = "manifest.json"
+	tablePrefix  = "tables/"
+	tableSuffix  = ".ndjson"
+	blobPrefix   = "blobs/"
+)
+
+var (
+	ErrInvalidArchive     = errors.New("invalid archive")
+	ErrUnsupportedVersion = errors.New("unsupported archive version")
+)
+
+// Manifest describes an archive.
+type Manifest struct {
+	Version   int       `json:"Version"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	// Tables are names of tables in the order they are written.
+	Tables []string `json:"Tables"`
+}
+
+// Writer writes an archive. Entries are written in order: the manifest,
+// tables and blobs.
+type Writer struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	gz := gzip.NewWriter(w)
+	return &Writer{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (w *Writer) WriteManifest(m Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return w.write(ManifestName, int64(len(b)), strings.NewReader(string(b)))
+}
+
+// WriteTable writes records of a table in NDJSON of the given size.
+func (w *Writer) WriteTable(name string, size int64, r io.Reader) error {
+	return w.write(tablePrefix+name+tableSuffix, size, r)
+}
+
+// WriteBlob writes a blob stored at a path of a storage.
+func (w *Writer) WriteBlob(blobPath string, size int64, r io.Reader) error {
+	return w.write(blobPrefix+blobPath, size, r)
+}
+
+func (w *Writer) write(name string, size int64, r io.Reader) error {
+	header := tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+		Format:  tar.FormatPAX,
+	}
+	if err := w.tw.WriteHeader(&header); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+func (w *Writer) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// Entry is an entry read from an archive. Exactly one of Table and Blob is
+// set.
+type Entry struct {
+	Table string
+	Blob  string
+	Size  int64
+	Body  io.Reader
+}
+
+// Reader reads an archive as a stream.
+type Reader struct {
+	Manifest Manifest
+
+	gz *gzip.Reader
+	tr *tar.Reader
+}
+
+// NewReader reads the manifest of an archive.
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	ar := Reader{gz: gz, tr: tar.NewReader(gz)}
+
+	header, err := ar.tr.Next()
+	if err != nil || header.Name != ManifestName {
+		return nil, ErrInvalidArchive
+	}
+	if err := json.NewDecoder(ar.tr).Decode(&ar.Manifest); err != nil {
+		return nil, ErrInvalidArchive
+	}
+	if ar.Manifest.Version != Version {
+		return nil, ErrUnsupportedVersion
+	}
+	return &ar, nil
+}
+
+// Next returns the next table or blob, or io.EOF at the end.
+func (r *Reader) Next() (*Entry, error) {
+	for {
+		header, err := r.tr.Next()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, ErrInvalidArchive
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean("/" + header.Name)[1:]
+		switch {
+		case strings.HasPrefix(name, tablePrefix) && strings.HasSuffix(name, tableSuffix):
+			table := strings.TrimSuffix(strings.TrimPrefix(name, tablePrefix), tableSuffix)
+			return &Entry{Table: table, Size: header.Size, Body: r.tr}, nil
+		case strings.HasPrefix(name, blobPrefix):
+			return &Entry{Blob: strings.TrimPrefix(name, blobPrefix), Size: header.Size, Body: r.tr}, nil
+		}
+	}
+}
+
+func (r *Reader) Close() error {
+	return r.gz.Close()
+}
@@ -0,0 +1,61 @@
+package archive
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// EncodeRecord encodes the columns of a model as a JSON object keyed by
+// field names. Unlike encoding/json, fields hidden from API responses like
+// file paths and key hashes are included, and associations are not.
+func EncodeRecord(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	fields := map[string]interface{}{}
+	for _, f := range columns(rv.Type()) {
+		fields[f.Name] = rv.FieldByIndex(f.Index).Interface()
+	}
+	return json.Marshal(fields)
+}
+
+// DecodeRecord decodes a record encoded by EncodeRecord into a model.
+// Unknown fields are ignored so that archives of newer versions with more
+// columns can be read.
+func DecodeRecord(b []byte, v interface{}) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	for _, f := range columns(rv.Type()) {
+		value, ok := raw[f.Name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, rv.FieldByIndex(f.Index).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columns returns exported fields of a struct stored in the database.
+func columns(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("gorm") == "-" {
+			continue
+		}
+		// skip associations such as files of books
+		ft := f.Type
+		if ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft.PkgPath() != "time" {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
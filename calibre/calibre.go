@@ -0,0 +1,204 @@
+// Package calibre reads books of Calibre libraries.
+package calibre
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	// metadata.db of Calibre is a SQLite database
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var ErrNotLibrary = errors.New("metadata.db not found")
+
+// Library is a Calibre library folder.
+type Library struct {
+	Dir string
+	db  *sql.DB
+}
+
+// Book is a book in a Calibre library.
+type Book struct {
+	ID          int64
+	UUID        string
+	Title       string
+	Authors     []string
+	Series      string
+	SeriesIndex float64
+	Tags        []string
+	// Identifiers map types like isbn and amazon to values.
+	Identifiers map[string]string
+	// Rating is from 0 to 10, two for each star.
+	Rating    int
+	Comments  string
+	Publisher string
+	// PubDate is formatted as 2006-01-02, or empty if undefined.
+	PubDate  string
+	Path     string
+	HasCover bool
+	Formats  []Format
+}
+
+// Format is a file of a book in a format.
+type Format struct {
+	// Format is an upper-case name like EPUB.
+	Format string
+	Name   string
+	Size   int64
+}
+
+// Open opens a library read-only.
+func Open(dir string) (*Library, error) {
+	path := filepath.Join(dir, "metadata.db")
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotLibrary
+		}
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Library{Dir: dir, db: db}, nil
+}
+
+func (l *Library) Close() error {
+	return l.db.Close()
+}
+
+// Books returns all books in the library ordered by ID.
+func (l *Library) Books() ([]Book, error) {
+	rows, err := l.db.Query(`
+		select id, uuid, title, coalesce(series_index, 1), coalesce(pubdate, ''),
+			path, has_cover
+		from books order by id`)
+	if err != nil {
+		return nil, err
+	}
+	books := []Book{}
+	index := map[int64]*Book{}
+	for rows.Next() {
+		b := Book{Identifiers: map[string]string{}}
+		var uuid sql.NullString
+		if err := rows.Scan(&b.ID, &uuid, &b.Title, &b.SeriesIndex, &b.PubDate, &b.Path, &b.HasCover); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.UUID = uuid.String
+		b.PubDate = formatDate(b.PubDate)
+		books = append(books, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range books {
+		index[books[i].ID] = &books[i]
+	}
+
+	queries := []struct {
+		query string
+		set   func(b *Book, key, value string)
+	}{
+		{
+			`select l.book, '', a.name from books_authors_link l join authors a on a.id = l.author order by l.id`,
+			func(b *Book, _, value string) { b.Authors = append(b.Authors, value) },
+		},
+		{
+			`select l.book, '', s.name from books_series_link l join series s on s.id = l.series`,
+			func(b *Book, _, value string) { b.Series = value },
+		},
+		{
+			`select l.book, '', t.name from books_tags_link l join tags t on t.id = l.tag order by t.name`,
+			func(b *Book, _, value string) { b.Tags = append(b.Tags, value) },
+		},
+		{
+			`select l.book, '', p.name from books_publishers_link l join publishers p on p.id = l.publisher`,
+			func(b *Book, _, value string) { b.Publisher = value },
+		},
+		{
+			`select l.book, '', r.rating from books_ratings_link l join ratings r on r.id = l.rating where r.rating is not null`,
+			func(b *Book, _, value string) { b.Rating, _ = strconv.Atoi(value) },
+		},
+		{
+			`select book, '', text from comments`,
+			func(b *Book, _, value string) { b.Comments = value },
+		},
+		{
+			`select book, type, val from identifiers order by type`,
+			func(b *Book, key, value string) { b.Identifiers[key] = value },
+		},
+	}
+	for _, q := range queries {
+		if err := l.each(q.query, func(id int64, key, value string) {
+			if b, ok := index[id]; ok {
+				q.set(b, key, value)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = l.db.Query(`select book, format, name, coalesce(uncompressed_size, 0) from data order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		f := Format{}
+		if err := rows.Scan(&id, &f.Format, &f.Name, &f.Size); err != nil {
+			return nil, err
+		}
+		if b, ok := index[id]; ok {
+			b.Formats = append(b.Formats, f)
+		}
+	}
+	return books, rows.Err()
+}
+
+func (l *Library) each(query string, f func(id int64, key, value string)) error {
+	rows, err := l.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var key, value sql.NullString
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return err
+		}
+		f(id, key.String, value.String)
+	}
+	return rows.Err()
+}
+
+// FilePath returns the path of a file of a book.
+func (l *Library) FilePath(b *Book, f Format) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(b.Path), f.Name+"."+strings.ToLower(f.Format))
+}
+
+// CoverPath returns the path of the cover of a book.
+func (l *Library) CoverPath(b *Book) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(b.Path), "cover.jpg")
+}
+
+// formatDate returns the date of a Calibre timestamp. Calibre writes
+// undefined dates as 0101-01-01.
+func formatDate(timestamp string) string {
+	if len(timestamp) < 10 || strings.HasPrefix(timestamp, "0101-") {
+		return ""
+	}
+	return timestamp[:10]
+}
@@ -0,0 +1,129 @@
+package charset
+
+import (
+	"bytes"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	unicodeenc "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Names of detected character sets as used in Content-Type headers.
+const (
+	UTF8      = "utf-8"
+	UTF16LE   = "utf-16le"
+	UTF16BE   = "utf-16be"
+	ShiftJIS  = "shift_jis"
+	EUCJP     = "euc-jp"
+	ISO2022JP = "iso-2022-jp"
+	// Unknown is text in a character set which cannot be detected, which is
+	// neither decoded nor converted.
+	Unknown = "unknown"
+)
+
+var ErrUnknown = errors.New("unknown charset")
+
+var encodings = map[string]encoding.Encoding{
+	UTF16LE:   unicodeenc.UTF16(unicodeenc.LittleEndian, unicodeenc.ExpectBOM),
+	UTF16BE:   unicodeenc.UTF16(unicodeenc.BigEndian, unicodeenc.ExpectBOM),
+	ShiftJIS:  japanese.ShiftJIS,
+	EUCJP:     japanese.EUCJP,
+	ISO2022JP: japanese.ISO2022JP,
+}
+
+// Detect guesses the character set of text. Byte order marks and escape
+// sequences are trusted. Otherwise text which is valid UTF-8 is UTF-8, and
+// Shift_JIS and EUC-JP are told apart by how much of the text decodes into
+// Japanese characters. Unknown is returned unless one of them scores
+// clearly better, such as for text in other languages.
+func Detect(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return UTF8
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		return UTF16LE
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		return UTF16BE
+	}
+	if isASCII(b) {
+		if bytes.Contains(b, []byte("\x1b$B")) || bytes.Contains(b, []byte("\x1b$@")) {
+			return ISO2022JP
+		}
+		return UTF8
+	}
+	if utf8.Valid(b) {
+		return UTF8
+	}
+
+	sjis := japaneseScore(encodings[ShiftJIS], b)
+	eucjp := japaneseScore(encodings[EUCJP], b)
+	switch {
+	case isClearScore(sjis, eucjp):
+		return ShiftJIS
+	case isClearScore(eucjp, sjis):
+		return EUCJP
+	}
+	return Unknown
+}
+
+// isClearScore reports whether text scores positively and at least twice
+// as high as in the other character set.
+func isClearScore(score, other int) bool {
+	return score > 0 && score > 2*other
+}
+
+// IsUTF8 reports whether a character set is compatible with UTF-8.
+func IsUTF8(name string) bool {
+	return name == "" || name == UTF8 || name == "us-ascii"
+}
+
+// Decode converts text in a character set to UTF-8.
+func Decode(b []byte, name string) ([]byte, error) {
+	if IsUTF8(name) {
+		return bytes.TrimPrefix(b, []byte{0xef, 0xbb, 0xbf}), nil
+	}
+	e, ok := encodings[name]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	out, _, err := transform.Bytes(e.NewDecoder(), b)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// japaneseScore decodes text and scores kana and kanji positively and
+// invalid sequences negatively. Half-width katakana are not counted since
+// misdecoded text is full of them.
+func japaneseScore(e encoding.Encoding, b []byte) int {
+	out, _, err := transform.Bytes(e.NewDecoder(), b)
+	if err != nil {
+		return -len(b)
+	}
+	score := 0
+	for _, r := range string(out) {
+		switch {
+		case r == utf8.RuneError:
+			score -= 10
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana) && !(r >= 0xff61 && r <= 0xff9f):
+			score += 2
+		case unicode.Is(unicode.Han, r), r >= 0x3000 && r <= 0x303f, r >= 0xff01 && r <= 0xff5e:
+			score++
+		}
+	}
+	return score
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/altescy/bookshelf/calibre"
+	"github.com/altescy/bookshelf/controller"
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/model"
+	"github.com/altescy/bookshelf/storage"
+	"github.com/jinzhu/gorm"
+)
+
+const usage = `usage: bookshelf [command]
+
+Runs the server without a command.
+
+commands:
+  export [-o <archive>]          export the library to an archive (stdout by default)
+  import <archive>               import an archive of a library ("-" reads stdin)
+  import calibre <library-dir>   import books of a Calibre library
+  migrate-storage [-concurrency <n>] [-verify] <source-url> <target-url>
+                                 copy stored files to another storage
+  rotate-keys [-concurrency <n>] encrypt stored files with the current key
+`
+
+// runCommand runs a command given by arguments instead of the server.
+// Commands are configured by the same environment variables as the server.
+func runCommand(args []string) {
+	switch args[0] {
+	case "export":
+		runExport(args[1:])
+	case "import":
+		runImport(args[1:])
+	case "migrate-storage":
+		runMigrateStorage(args[1:])
+	case "rotate-keys":
+		runRotateKeys(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func runImport(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "calibre":
+		runImportCalibre(args[1:])
+	default:
+		runImportArchive(args)
+	}
+}
+
+// openLibrary connects to the database and storage of the library.
+func openLibrary() (*gorm.DB, *controller.Handler) {
+	db := createGormDB()
+	autoMigrate(db)
+	if err := model.RegisterCustomFormats(db); err != nil {
+		log.Fatalf("cannot load custom formats: %v", err)
+	}
+
+	// jobs such as metadata extraction are run later by the server
+	store, _ := createStorage()
+	h := createHandler(db, store, job.NewQueue(db, 1), false)
+	return db, h
+}
+
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "-", "archive file")
+	flags.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("cannot create archive: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	db, h := openLibrary()
+	defer db.Close()
+
+	summary, err := h.ExportLibrary(w)
+	if err != nil {
+		log.Fatalf("cannot export library: %v", err)
+	}
+	printArchiveSummary(os.Stderr, summary)
+	if len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runImportArchive(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("cannot open archive: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, h := openLibrary()
+	defer db.Close()
+
+	summary, err := h.ImportLibrary(r)
+	if summary != nil {
+		printArchiveSummary(os.Stdout, summary)
+	}
+	if err != nil {
+		log.Fatalf("import stopped: %v", err)
+	}
+	if len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func printArchiveSummary(w io.Writer, summary *controller.ArchiveSummary) {
+	for _, table := range model.ArchiveTables() {
+		fmt.Fprintf(w, "%s: %d", table, summary.Records[table])
+		if skipped := summary.Skipped[table]; skipped > 0 {
+			fmt.Fprintf(w, " (%d skipped)", skipped)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "blobs: %d\nerrors: %d\n", summary.Blobs, len(summary.Errors))
+	for _, message := range summary.Errors {
+		fmt.Fprintf(w, "  %s\n", message)
+	}
+}
+
+func runImportCalibre(args []string) {
+	flags := flag.NewFlagSet("import calibre", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	lib, err := calibre.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("cannot open calibre library: %v", err)
+	}
+	defer lib.Close()
+
+	db, h := openLibrary()
+	defer db.Close()
+
+	summary, err := h.ImportCalibre(lib)
+	if err != nil {
+		log.Printf("[ERROR] import stopped: %v", err)
+	}
+	if summary != nil {
+		fmt.Printf("books: %d\nadded: %d\nupdated: %d\nunchanged: %d\nfiles: %d\nerrors: %d\n",
+			summary.Books, summary.Added, summary.Updated, summary.Unchanged, summary.Files, len(summary.Errors))
+		for _, message := range summary.Errors {
+			fmt.Printf("  %s\n", message)
+		}
+	}
+	if err != nil || summary == nil || len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runMigrateStorage(args []string) {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 4, "number of files copied at once")
+	verify := flags.Bool("verify", false, "compare digests of copied files")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	db := createGormDB()
+	defer db.Close()
+	autoMigrate(db)
+
+	src := openStorage(flags.Arg(0), false)
+	dst := openStorage(flags.Arg(1), getEnv("CREATE_NEW_STORAGE", "") != "")
+	// files are compared with their digests after decryption
+	if keys := openKeyring(); keys != nil {
+		// the source may have files stored before encryption
+		src = storage.NewEncryptedStorage(src, keys, storage.EncryptionOptions{})
+		dst = storage.NewEncryptedStorage(dst, keys, storage.EncryptionOptions{Strict: true})
+	}
+
+	blobs := loadBlobs(db)
+	ctx, cancel := interruptibleContext("migration")
+	defer cancel()
+
+	summary := storage.Migrate(ctx, src, dst, blobs, storage.MigrateOptions{
+		Concurrency: *concurrency,
+		Verify:      *verify,
+	})
+
+	fmt.Printf("files: %d\ncopied: %d\nskipped: %d\nmissing: %d\n",
+		len(blobs), summary.Copied, summary.Skipped, summary.Missing)
+	if *verify {
+		fmt.Printf("verified: %d\n", summary.Verified)
+	}
+	fmt.Printf("errors: %d\n", len(summary.Errors))
+	for _, message := range summary.Errors {
+		fmt.Printf("  %s\n", message)
+	}
+	if ctx.Err() != nil || len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runRotateKeys(args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 4, "number of files encrypted at once")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	db := createGormDB()
+	defer db.Close()
+	autoMigrate(db)
+
+	opened, _ := createStorage()
+	store, ok := opened.(*storage.EncryptedStorage)
+	if !ok {
+		log.Fatal("encryption keys are not configured")
+	}
+
+	blobs := loadBlobs(db)
+	ctx, cancel := interruptibleContext("key rotation")
+	defer cancel()
+
+	summary := storage.RotateKeys(ctx, store, blobs, *concurrency)
+
+	fmt.Printf("files: %d\nrotated: %d\nskipped: %d\nmissing: %d\nerrors: %d\n",
+		len(blobs), summary.Rotated, summary.Skipped, summary.Missing, len(summary.Errors))
+	for _, message := range summary.Errors {
+		fmt.Printf("  %s\n", message)
+	}
+	if ctx.Err() != nil || len(summary.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadBlobs returns files and covers stored for the library, and exits if
+// they cannot be loaded.
+func loadBlobs(db *gorm.DB) []storage.Blob {
+	blobs, err := storedBlobs(db)
+	if err != nil {
+		log.Fatalf("cannot load stored files: %v", err)
+	}
+	return blobs
+}
+
+// storedBlobs returns files and covers stored for the library.
+func storedBlobs(db *gorm.DB) ([]storage.Blob, error) {
+	stored, err := model.GetStoredBlobs(db)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []storage.Blob{}
+	for _, b := range stored {
+		blobs = append(blobs, storage.Blob{Path: b.Path, Size: b.Size, Hash: b.Hash})
+	}
+	return blobs, nil
+}
+
+// interruptibleContext returns a context canceled by SIGINT.
+func interruptibleContext(name string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Printf("[INFO] stopping %s", name)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -1,14 +1,30 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/altescy/bookshelf/browser"
 	"github.com/altescy/bookshelf/controller"
+	"github.com/altescy/bookshelf/convert"
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/koreader"
+	"github.com/altescy/bookshelf/lookup"
+	"github.com/altescy/bookshelf/mailer"
+	"github.com/altescy/bookshelf/mailin"
 	"github.com/altescy/bookshelf/model"
 	"github.com/altescy/bookshelf/storage"
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,6 +37,9 @@ import (
 	"github.com/julienschmidt/httprouter"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // EnvPrefix is a prefix for environment variables.
@@ -75,12 +94,128 @@ func createGormDB() *gorm.DB {
 	return db
 }
 
-func createStorage() storage.Storage {
+// createStorage opens the configured storage. The replicated storage inside
+// it is also returned if files are replicated.
+func createStorage() (storage.Storage, *storage.ReplicatedStorage) {
+	store, replicated := createBaseStorage()
+	return encryptStorage(store, openKeyring()), replicated
+}
+
+// createBaseStorage opens the configured storage without encryption.
+func createBaseStorage() (storage.Storage, *storage.ReplicatedStorage) {
 	var (
 		storageURL       = getEnv("STORAGE_URL", "")
+		fallbackURL      = getEnv("STORAGE_FALLBACK_URL", "")
 		createNewStorage = getEnv("CREATE_NEW_STORAGE", "")
 	)
 
+	// comma separated urls are a primary storage followed by its replicas
+	stores := []storage.Storage{}
+	for _, u := range strings.Split(storageURL, ",") {
+		stores = append(stores, openStorage(strings.TrimSpace(u), createNewStorage != ""))
+	}
+	store := stores[0]
+	var replicated *storage.ReplicatedStorage
+	if len(stores) > 1 {
+		log.Printf("[INFO] replicate files to %d storages", len(stores)-1)
+		replicated = storage.NewReplicatedStorage(stores[0], stores[1:]...)
+		store = replicated
+	}
+
+	// files are written to both storages while they are migrated
+	if fallbackURL != "" {
+		log.Printf("[INFO] read files missing in the storage from the fallback storage")
+		store = storage.NewFallbackStorage(store, openStorage(fallbackURL, false))
+	}
+
+	return store, replicated
+}
+
+// encryptStorage wraps a storage with encryption if keys are configured.
+func encryptStorage(store storage.Storage, keys *storage.Keyring) storage.Storage {
+	if keys == nil {
+		return store
+	}
+	strict := getEnv("ENCRYPTION_STRICT", "") != ""
+	return storage.NewEncryptedStorage(store, keys, storage.EncryptionOptions{Strict: strict})
+}
+
+// createStorageCache wraps a storage with a local cache if configured. The
+// cache is used only by the server, so that commands do not share it.
+// Uploads are cached if the cache is warmed with recently added books. The
+// cache is put below encryption, so that cached files are not decrypted, and
+// is cleared when the storages or encryption keys change.
+func createStorageCache(store storage.Storage, warmBooks int) (storage.Storage, *storage.CachedStorage) {
+	var (
+		cacheDir  = getEnv("CACHE_DIR", "")
+		cacheSize = getEnv("CACHE_SIZE", "1073741824")
+	)
+
+	if cacheDir == "" {
+		return store, nil
+	}
+	maxSize, err := strconv.ParseInt(cacheSize, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid cache size: %v", err)
+	}
+
+	cache, err := storage.NewCachedStorage(store, cacheDir, storage.CacheOptions{
+		MaxSize:     maxSize,
+		WarmUploads: warmBooks > 0,
+		Fingerprint: cacheFingerprint(),
+	})
+	if err != nil {
+		log.Fatalf("cannot create cache: %v", err)
+	}
+	log.Printf("[INFO] cache files in %s up to %d bytes", cacheDir, maxSize)
+	return cache, cache
+}
+
+// cacheFingerprint identifies the storages and the encryption of files, so
+// that files cached before they are changed, such as by migrating storages
+// or rotating keys, are not read after a restart.
+func cacheFingerprint() string {
+	h := sha256.New()
+	for _, key := range []string{"STORAGE_URL", "STORAGE_FALLBACK_URL", "ENCRYPTION_STRICT"} {
+		fmt.Fprintf(h, "%s=%s\n", key, getEnv(key, ""))
+	}
+	fmt.Fprintf(h, "ENCRYPTION_KEYS=%s\n", readKeys())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readKeys reads encryption keys from a file or the environment.
+func readKeys() string {
+	var (
+		keys    = getEnv("ENCRYPTION_KEYS", "")
+		keyFile = getEnv("ENCRYPTION_KEY_FILE", "")
+	)
+
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Fatalf("cannot read encryption key file: %v", err)
+		}
+		keys = string(b)
+	}
+	return keys
+}
+
+// openKeyring reads encryption keys, and returns nil if files are not
+// encrypted.
+func openKeyring() *storage.Keyring {
+	keys := readKeys()
+	if keys == "" {
+		return nil
+	}
+
+	keyring, err := storage.ParseKeyring(keys)
+	if err != nil {
+		log.Fatalf("cannot parse encryption keys: %v", err)
+	}
+	return keyring
+}
+
+func openStorage(storageURL string, doCreateNewStorage bool) storage.Storage {
 	var store storage.Storage
 
 	parsedURL, err := url.Parse(storageURL)
@@ -88,8 +223,6 @@ func createStorage() storage.Storage {
 		log.Fatalf("cannot parse storage url: %v", err)
 	}
 
-	doCreateNewStorage := createNewStorage != ""
-
 	switch parsedURL.Scheme {
 	case "s3":
 		bucket := parsedURL.Host
@@ -98,6 +231,10 @@ func createStorage() storage.Storage {
 	case "file":
 		root := parsedURL.Path
 		store = createFileSysteStorage(root, doCreateNewStorage)
+	case "webdav", "webdavs":
+		store = createWebDAVStorage(parsedURL, doCreateNewStorage)
+	case "sftp":
+		store = createSFTPStorage(parsedURL, doCreateNewStorage)
 	default:
 		log.Fatalf("invalid storage url scheme: %s", parsedURL.Scheme)
 	}
@@ -162,18 +299,330 @@ func createS3Storage(bucket, root string, createNewStorage bool) *storage.S3Stor
 	return storage.NewS3Storage(svc, bucket, root)
 }
 
+// createWebDAVStorage connects to a WebDAV server over HTTP for webdav://
+// and HTTPS for webdavs:// urls. Credentials in the url are used unless they
+// are set by the environment.
+func createWebDAVStorage(storageURL *url.URL, createNewStorage bool) *storage.WebDAVStorage {
+	urlPassword, _ := storageURL.User.Password()
+	var (
+		username = getEnv("WEBDAV_USER", storageURL.User.Username())
+		password = getEnv("WEBDAV_PASSWORD", urlPassword)
+	)
+
+	scheme := "http"
+	if storageURL.Scheme == "webdavs" {
+		scheme = "https"
+	}
+	endpoint := url.URL{Scheme: scheme, Host: storageURL.Host}
+	client := gowebdav.NewClient(endpoint.String(), username, password)
+	client.SetTimeout(5 * time.Minute)
+
+	store := storage.NewWebDAVStorage(client, storageURL.Path)
+	if createNewStorage {
+		if err := store.CreateRoot(); err != nil {
+			log.Fatalf("failed to create webdav collection: %v", err)
+		}
+	}
+	return store
+}
+
+// createSFTPStorage configures a connection to an SFTP server. The host key
+// is verified with known_hosts unless verification is disabled.
+func createSFTPStorage(storageURL *url.URL, createNewStorage bool) *storage.SFTPStorage {
+	urlPassword, _ := storageURL.User.Password()
+	var (
+		username      = getEnv("SFTP_USER", storageURL.User.Username())
+		password      = getEnv("SFTP_PASSWORD", urlPassword)
+		keyFile       = getEnv("SFTP_KEY_FILE", "")
+		knownHosts    = getEnv("SFTP_KNOWN_HOSTS", "")
+		ignoreHostKey = getEnv("SFTP_INSECURE_IGNORE_HOST_KEY", "")
+	)
+
+	auth := []ssh.AuthMethod{}
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Fatalf("cannot read sftp key file: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			log.Fatalf("cannot parse sftp key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if ignoreHostKey != "" {
+		log.Printf("[WARN] host key of sftp server is not verified")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		if knownHosts == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				log.Fatalf("cannot find known_hosts: %v", err)
+			}
+			knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			log.Fatalf("cannot read known_hosts: %v", err)
+		}
+		hostKeyCallback = callback
+	}
+
+	addr := storageURL.Host
+	if storageURL.Port() == "" {
+		addr = net.JoinHostPort(storageURL.Hostname(), "22")
+	}
+	config := ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	store := storage.NewSFTPStorage(addr, &config, storageURL.Path)
+	if createNewStorage {
+		if err := store.CreateRoot(); err != nil {
+			log.Fatalf("failed to create sftp directory: %v", err)
+		}
+	}
+	return store
+}
+
 func autoMigrate(db *gorm.DB) {
 	if err := model.AutoMigrate(db); err != nil {
 		log.Fatalf("migration failed: %v", err)
 	}
 }
 
+// reconcileReplicas schedules repairs of files which replicas missed while
+// the server was stopped.
+func reconcileReplicas(db *gorm.DB, replicated *storage.ReplicatedStorage) {
+	blobs, err := storedBlobs(db)
+	if err != nil {
+		log.Printf("[WARN] cannot load stored files to reconcile replicas: %v", err)
+		return
+	}
+
+	if n := replicated.Reconcile(context.Background(), blobs, 4); n > 0 {
+		log.Printf("[INFO] scheduled repairs of %d files of replicas", n)
+	}
+}
+
+// backfillFileHashes computes KOReader document hashes and content hashes
+// of files uploaded before the hashes were recorded.
+func backfillFileHashes(db *gorm.DB, store storage.Storage) {
+	files, err := model.GetFilesWithoutHash(db, koreader.PartialMD5Version)
+	if err != nil {
+		log.Printf("[WARN] cannot load files to backfill hashes: %v", err)
+		return
+	}
+
+	for _, file := range *files {
+		buf := bytes.Buffer{}
+		if err := store.Download(&buf, file.Path); err != nil {
+			log.Printf("[WARN] cannot download file %d: %v", file.ID, err)
+			continue
+		}
+		b := buf.Bytes()
+		file.DocumentHash, err = koreader.PartialMD5(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			log.Printf("[WARN] cannot compute document hash of file %d: %v", file.ID, err)
+			continue
+		}
+		file.DocumentHashVersion = koreader.PartialMD5Version
+		file.Hash = model.HashContent(b)
+		file.Size = int64(len(b))
+		if err := model.UpdateFile(db, &file); err != nil {
+			log.Printf("[WARN] cannot update file %d: %v", file.ID, err)
+			continue
+		}
+		// progress synced before the hash was fixed is not linked
+		if err := model.LinkProgresses(db, &file); err != nil {
+			log.Printf("[WARN] cannot link progress of file %d: %v", file.ID, err)
+		}
+	}
+}
+
+func createLookupProviders() []lookup.Provider {
+	var (
+		names       = getEnv("LOOKUP_PROVIDERS", "openlibrary,googlebooks,ndl")
+		fixturePath = getEnv("LOOKUP_FIXTURE", "")
+		googleKey   = getEnv("GOOGLE_BOOKS_API_KEY", "")
+	)
+
+	providers := []lookup.Provider{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "fixture":
+			fixture, err := lookup.NewFixture(fixturePath)
+			if err != nil {
+				log.Fatalf("cannot load lookup fixture: %v", err)
+			}
+			providers = append(providers, fixture)
+		default:
+			provider, err := lookup.NewProvider(name)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			if p, ok := provider.(*lookup.GoogleBooks); ok {
+				p.APIKey = googleKey
+			}
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+func createMailer() *mailer.Mailer {
+	var (
+		host     = getEnv("SMTP_HOST", "")
+		port     = getEnv("SMTP_PORT", "587")
+		username = getEnv("SMTP_USERNAME", "")
+		password = getEnv("SMTP_PASSWORD", "")
+		from     = getEnv("SMTP_FROM", "")
+		maxSize  = getEnv("MAIL_MAX_SIZE", "26214400")
+	)
+
+	if host == "" {
+		log.Printf("[INFO] sending books by email is disabled")
+		return nil
+	}
+
+	smtpPort, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatalf("invalid smtp port: %v", err)
+	}
+	size, err := strconv.ParseInt(maxSize, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid mail max size: %v", err)
+	}
+	if from == "" {
+		from = username
+	}
+
+	return &mailer.Mailer{
+		Host:     host,
+		Port:     smtpPort,
+		Username: username,
+		Password: password,
+		From:     from,
+		MaxSize:  size,
+	}
+}
+
+func createIngestConfig() *controller.IngestConfig {
+	var (
+		dirs      = getEnv("INGEST_DIRS", "")
+		interval  = getEnv("INGEST_INTERVAL", "10s")
+		doneDir   = getEnv("INGEST_DONE_DIR", "done")
+		failedDir = getEnv("INGEST_FAILED_DIR", "failed")
+	)
+
+	config := controller.IngestConfig{DoneDir: doneDir, FailedDir: failedDir}
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			config.Dirs = append(config.Dirs, dir)
+		}
+	}
+	if len(config.Dirs) == 0 {
+		return nil
+	}
+
+	var err error
+	config.Interval, err = time.ParseDuration(interval)
+	if err != nil {
+		log.Fatalf("invalid ingest interval: %v", err)
+	}
+	return &config
+}
+
+func createMailServer(h *controller.Handler) *mailin.Server {
+	var (
+		addr     = getEnv("MAIL_IN_ADDR", "")
+		hostname = getEnv("MAIL_IN_HOSTNAME", "")
+		senders  = getEnv("MAIL_IN_ALLOWED_SENDERS", "")
+		maxSize  = getEnv("MAIL_IN_MAX_SIZE", "52428800")
+	)
+
+	if addr == "" {
+		return nil
+	}
+	if strings.TrimSpace(senders) == "" {
+		log.Fatalf("allowed senders are required to receive books by email")
+	}
+
+	size, err := strconv.ParseInt(maxSize, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid mail in max size: %v", err)
+	}
+
+	return &mailin.Server{
+		Addr:        addr,
+		Hostname:    hostname,
+		MaxSize:     size,
+		AllowSender: mailin.SenderList(strings.Split(senders, ",")),
+		Handler:     h.ReceiveMail,
+	}
+}
+
+// createHandler creates a handler shared by the server and commands.
+func createHandler(db *gorm.DB, store storage.Storage, queue *job.Queue, enableCors bool, opts ...controller.Option) *controller.Handler {
+	var (
+		adminUsers = getEnv("ADMIN_USERS", "")
+		retention  = getEnv("FILE_VERSION_RETENTION", "0")
+		cas        = getEnv("CONTENT_ADDRESSED_STORAGE", "")
+		ebookConv  = getEnv("EBOOK_CONVERT", "")
+		transcode  = getEnv("TRANSCODE_TEXT", "")
+	)
+
+	fileRetention, err := strconv.Atoi(retention)
+	if err != nil {
+		log.Fatalf("invalid file version retention: %v", err)
+	}
+
+	opts = append([]controller.Option{
+		controller.WithAdminUsers(strings.Split(adminUsers, ",")...),
+		controller.WithFileRetention(fileRetention),
+		controller.WithContentAddressing(cas != ""),
+		controller.WithLookupProviders(createLookupProviders()...),
+		controller.WithJobQueue(queue),
+		controller.WithTextTranscoding(transcode != ""),
+		controller.WithMailer(createMailer()),
+		controller.WithConverter(&convert.Converter{EbookConvert: ebookConv}),
+	}, opts...)
+	return controller.NewHandler(db, store, enableCors, opts...)
+}
+
 func Main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	var (
 		port       = getEnv("PORT", "8080")
 		enableCors = getEnv("ENABLE_CORS", "")
+		jobWorkers = getEnv("JOB_WORKERS", "2")
+		warmBooks  = getEnv("CACHE_WARM_BOOKS", "0")
 	)
 
+	workers, err := strconv.Atoi(jobWorkers)
+	if err != nil {
+		log.Fatalf("invalid number of job workers: %v", err)
+	}
+	cacheWarmBooks, err := strconv.Atoi(warmBooks)
+	if err != nil {
+		log.Fatalf("invalid number of books to warm cache: %v", err)
+	}
+
 	isEnableCors := enableCors != ""
 	log.Printf("[INFO] enable CORS: %v", isEnableCors)
 
@@ -182,9 +631,51 @@ func Main() {
 
 	autoMigrate(db)
 
-	store := createStorage()
+	if err := model.RegisterCustomFormats(db); err != nil {
+		log.Fatalf("cannot load custom formats: %v", err)
+	}
+
+	// files read once to backfill hashes are not cached, and files are
+	// cached as they are stored, so that they are encrypted on local disk
+	base, replicated := createBaseStorage()
+	cached, cache := createStorageCache(base, cacheWarmBooks)
+	keys := openKeyring()
+	if keys != nil {
+		log.Printf("[INFO] encrypt files with key %s", keys.Current())
+		if getEnv("ENCRYPTION_STRICT", "") != "" {
+			log.Printf("[INFO] reject files which are not encrypted")
+		}
+	}
+	uncached := encryptStorage(base, keys)
+	store := encryptStorage(cached, keys)
 
-	h := controller.NewHandler(db, store, isEnableCors)
+	go backfillFileHashes(db, uncached)
+	if replicated != nil {
+		go reconcileReplicas(db, replicated)
+	}
+
+	queue := job.NewQueue(db, workers)
+
+	h := createHandler(db, store, queue, isEnableCors, controller.WithStorageCache(cache))
+	go h.WarmCache(cacheWarmBooks)
+
+	if err := queue.Start(context.Background()); err != nil {
+		log.Fatalf("cannot start job queue: %v", err)
+	}
+
+	if ingest := createIngestConfig(); ingest != nil {
+		log.Printf("[INFO] watch ingest folders: %s", strings.Join(ingest.Dirs, ", "))
+		go h.Ingest(context.Background(), *ingest)
+	}
+
+	if server := createMailServer(h); server != nil {
+		log.Printf("[INFO] receive books by email on %s", server.Addr)
+		go func() {
+			if err := server.ListenAndServe(context.Background()); err != nil {
+				log.Fatalf("cannot receive mail: %v", err)
+			}
+		}()
+	}
 
 	router := httprouter.New()
 	router.POST("/api/book", h.AddBook)
@@ -193,11 +684,54 @@ func Main() {
 	router.DELETE("/api/book/:bookid", h.DeleteBook)
 	router.GET("/api/book/:bookid/file/:ext", h.DownloadFile)
 	router.DELETE("/api/book/:bookid/file/:ext", h.DeleteFile)
+	router.GET("/api/book/:bookid/file/:ext/versions", h.GetFileVersions)
+	router.GET("/api/book/:bookid/file/:ext/versions/:version", h.DownloadFileVersion)
+	router.POST("/api/book/:bookid/file/:ext/versions/:version/promote", h.PromoteFileVersion)
+	router.POST("/api/book/:bookid/file/:ext/convert", h.ConvertFile)
 	router.POST("/api/book/:bookid/files", h.UploadFiles)
+	router.POST("/api/book/:bookid/merge", h.MergeBooks)
 	router.GET("/api/books", h.GetBooks)
+	router.GET("/api/duplicates", h.GetDuplicates)
+	router.GET("/api/formats", h.GetFormats)
+	router.POST("/api/formats", h.AuthenticateAdmin(h.AddFormat))
+	router.DELETE("/api/formats/:alias", h.AuthenticateAdmin(h.DeleteFormat))
+	router.GET("/api/lookup/isbn/:isbn", h.LookupISBN)
+	router.POST("/api/metadata/refresh", h.RefreshMetadata)
+	router.GET("/api/metadata/proposals", h.GetMetadataProposals)
+	router.POST("/api/metadata/proposals/:proposalid/approve", h.ApproveMetadataProposal)
+	router.POST("/api/metadata/proposals/:proposalid/reject", h.RejectMetadataProposal)
+	router.GET("/api/jobs", h.GetJobs)
+	router.GET("/api/jobs/:jobid", h.GetJob)
+	router.POST("/api/jobs/:jobid/cancel", h.CancelJob)
+	router.POST("/api/book/:bookid/send", h.Authenticate(h.SendToDevice))
+	router.GET("/api/devices", h.Authenticate(h.GetDevices))
+	router.POST("/api/devices", h.Authenticate(h.AddDevice))
+	router.PUT("/api/devices/:deviceid", h.Authenticate(h.UpdateDevice))
+	router.DELETE("/api/devices/:deviceid", h.Authenticate(h.DeleteDevice))
+	router.GET("/api/deliveries", h.Authenticate(h.GetDeliveries))
+	router.GET("/api/deliveries/:deliveryid", h.Authenticate(h.GetDelivery))
+	router.GET("/api/archive", h.AuthenticateAdmin(h.ExportArchive))
+	router.POST("/api/archive", h.AuthenticateAdmin(h.ImportArchive))
+	router.GET("/api/storage/cache", h.AuthenticateAdmin(h.GetCacheStats))
 	router.GET("/api/mime/:ext", h.GetMime)
 	router.GET("/api/mimes", h.GetMimes)
+	router.GET("/api/book/:bookid/comic/:ext/pages", h.GetComicPages)
+	router.GET("/api/book/:bookid/comic/:ext/pages/:page", h.GetComicPage)
+	router.GET("/api/book/:bookid/cover", h.GetCover)
+	router.GET("/api/book/:bookid/epub/manifest", h.GetEPUBManifest)
+	router.GET("/api/book/:bookid/epub/content/*path", h.GetEPUBContent)
+	router.GET("/api/book/:bookid/progress", h.GetBookProgress)
+	router.GET("/api/book/:bookid/annotations", h.Authenticate(h.GetAnnotations))
+	router.POST("/api/book/:bookid/annotations", h.Authenticate(h.AddAnnotation))
+	router.POST("/api/book/:bookid/annotations/import", h.Authenticate(h.ImportAnnotations))
+	router.PUT("/api/book/:bookid/annotations/:annotationid", h.Authenticate(h.UpdateAnnotation))
+	router.DELETE("/api/book/:bookid/annotations/:annotationid", h.Authenticate(h.DeleteAnnotation))
 	router.GET("/opds", h.GetOPDSFeed)
+	router.POST("/kosync/users/create", h.KOSyncCreateUser)
+	router.GET("/kosync/users/auth", h.KOSyncAuthenticate(h.KOSyncAuthUser))
+	router.PUT("/kosync/syncs/progress", h.KOSyncAuthenticate(h.KOSyncUpdateProgress))
+	router.GET("/kosync/syncs/progress/:document", h.KOSyncAuthenticate(h.KOSyncGetProgress))
+	router.GET("/kosync/healthcheck", h.KOSyncHealthcheck)
 	router.NotFound = http.FileServer(&assetfs.AssetFS{
 		Asset:     browser.Asset,
 		AssetDir:  browser.AssetDir,
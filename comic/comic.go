@@ -0,0 +1,147 @@
+package comic
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrNoPages            = errors.New("comic: no pages found")
+	ErrPageNotFound       = errors.New("comic: page not found")
+	ErrUnsupportedArchive = errors.New("comic: unsupported archive")
+)
+
+var imageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+}
+
+// Archive is an opened comic book archive whose pages are images.
+type Archive interface {
+	// Pages returns names of page images in reading order.
+	Pages() []string
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// ImageType returns the MIME type of a page image.
+func ImageType(name string) string {
+	return imageTypes[strings.ToLower(path.Ext(name))]
+}
+
+// OpenPage opens the page at the given 0-based index.
+func OpenPage(a Archive, index int) (io.ReadCloser, string, error) {
+	pages := a.Pages()
+	if index < 0 || index >= len(pages) {
+		return nil, "", ErrPageNotFound
+	}
+	rc, err := a.Open(pages[index])
+	if err != nil {
+		return nil, "", err
+	}
+	return rc, ImageType(pages[index]), nil
+}
+
+type zipArchive struct {
+	files map[string]*zip.File
+	pages []string
+}
+
+// OpenZip opens a CBZ archive.
+func OpenZip(r io.ReaderAt, size int64) (Archive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &zipArchive{files: map[string]*zip.File{}}
+	names := []string{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		a.files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	a.pages = pageNames(names)
+	if len(a.pages) == 0 {
+		return nil, ErrNoPages
+	}
+	return a, nil
+}
+
+func (a *zipArchive) Pages() []string {
+	return a.pages
+}
+
+func (a *zipArchive) Open(name string) (io.ReadCloser, error) {
+	f, ok := a.files[name]
+	if !ok {
+		return nil, ErrPageNotFound
+	}
+	return f.Open()
+}
+
+func (a *zipArchive) Close() error {
+	return nil
+}
+
+// pageNames picks images out of archive entries and sorts them in natural
+// order, so that "page10.jpg" comes after "page9.jpg".
+func pageNames(names []string) []string {
+	pages := []string{}
+	for _, name := range names {
+		base := path.Base(name)
+		if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if ImageType(name) != "" {
+			pages = append(pages, name)
+		}
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return naturalLess(pages[i], pages[j])
+	})
+	return pages
+}
+
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if unicode.IsDigit(ra[i]) && unicode.IsDigit(rb[j]) {
+			si := i
+			for i < len(ra) && unicode.IsDigit(ra[i]) {
+				i++
+			}
+			sj := j
+			for j < len(rb) && unicode.IsDigit(rb[j]) {
+				j++
+			}
+			na := strings.TrimLeft(string(ra[si:i]), "0")
+			nb := strings.TrimLeft(string(rb[sj:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		if ra[i] != rb[j] {
+			return ra[i] < rb[j]
+		}
+		i++
+		j++
+	}
+	return len(ra)-i < len(rb)-j
+}
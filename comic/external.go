@@ -0,0 +1,111 @@
+package comic
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// extractors are command line tools able to read RAR and 7z archives,
+// which have no implementation in the standard library.
+var extractors = []string{"7z", "7zz", "7za"}
+
+type externalArchive struct {
+	command string
+	path    string
+	pages   []string
+	cleanup func()
+}
+
+// OpenExternal opens a CBR or CB7 archive at a local path with an external
+// 7-Zip executable. cleanup is called on Close, e.g. to remove a temporary
+// copy of the archive.
+func OpenExternal(path string, cleanup func()) (Archive, error) {
+	command := findExtractor()
+	if command == "" {
+		return nil, ErrUnsupportedArchive
+	}
+
+	out, err := exec.Command(command, "l", "-slt", "-ba", path).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Path = ") {
+			names = append(names, strings.TrimPrefix(line, "Path = "))
+		}
+	}
+
+	a := &externalArchive{
+		command: command,
+		path:    path,
+		pages:   pageNames(names),
+		cleanup: cleanup,
+	}
+	if len(a.pages) == 0 {
+		a.Close()
+		return nil, ErrNoPages
+	}
+	return a, nil
+}
+
+// IsExternalAvailable reports whether CBR and CB7 archives can be read.
+func IsExternalAvailable() bool {
+	return findExtractor() != ""
+}
+
+func (a *externalArchive) Pages() []string {
+	return a.pages
+}
+
+func (a *externalArchive) Open(name string) (io.ReadCloser, error) {
+	out, err := exec.Command(a.command, "x", "-so", a.path, name).Output()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(out)), nil
+}
+
+func (a *externalArchive) Close() error {
+	if a.cleanup != nil {
+		a.cleanup()
+	}
+	return nil
+}
+
+func findExtractor() string {
+	for _, name := range extractors {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// TempFile writes an archive into a temporary file for OpenExternal and
+// returns its path and a function removing it.
+func TempFile(write func(w io.Writer) error) (string, func(), error) {
+	f, err := ioutil.TempFile("", "bookshelf-comic-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/altescy/bookshelf/koreader"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GetAnnotations returns annotations of the user on a book. The format
+// query selects json (default) or markdown for exporting them.
+func (h *Handler) GetAnnotations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	book, err := model.GetBookByID(h.db, bookID)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+
+	fileidString := q.Get("fileid")
+	fileID, err := strconv.ParseUint(fileidString, 10, 64)
+	if err != nil && fileidString != "" {
+		h.handleError(w, errors.New("invalid fileid"), http.StatusBadRequest)
+		return
+	}
+
+	annotations, err := model.GetAnnotations(h.db, userIDFromContext(r), bookID, fileID, q.Get("kind"))
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		h.handleSuccess(w, annotations)
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"annotations-%d.md\"", bookID))
+		w.WriteHeader(http.StatusOK)
+		if err := model.WriteAnnotationsMarkdown(w, book, *annotations); err != nil {
+			log.Printf("[WARN] write annotations markdown failed. %s", err)
+		}
+	default:
+		h.handleError(w, errors.New("invalid format"), http.StatusBadRequest)
+	}
+}
+
+// AddAnnotation adds a new annotation on a book
+func (h *Handler) AddAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	_, err = model.GetBookByID(h.db, bookID)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	annotation := model.Annotation{
+		UserID: userIDFromContext(r),
+		BookID: bookID,
+	}
+	if err := readAnnotationForm(r, &annotation); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = model.AddAnnotation(h.db, &annotation)
+	switch {
+	case err == model.ErrInvalidAnnotation:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, annotation)
+}
+
+// UpdateAnnotation updates annotation properties
+func (h *Handler) UpdateAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	annotation, ok := h.getAnnotation(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := readAnnotationForm(r, annotation); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err := model.UpdateAnnotation(h.db, annotation)
+	switch {
+	case err == model.ErrInvalidAnnotation:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, annotation)
+}
+
+// DeleteAnnotation deletes an annotation
+func (h *Handler) DeleteAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	annotation, ok := h.getAnnotation(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := model.DeleteAnnotation(h.db, annotation); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, "successfully deleted")
+}
+
+// ImportAnnotations imports annotations from KOReader metadata.*.lua files
+// found in .sdr sidecar directories.
+func (h *Handler) ImportAnnotations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	_, err = model.GetBookByID(h.db, bookID)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	fileID := uint64(0)
+	results := []map[string]interface{}{}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		// an optional FileID field applies to the sidecar files following it
+		if part.FormName() == "FileID" {
+			b, _ := ioutil.ReadAll(part)
+			fileID, err = strconv.ParseUint(string(b), 10, 64)
+			if err != nil {
+				h.handleError(w, errors.New("invalid FileID"), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+
+		filename := part.FileName()
+		if filename == "" {
+			continue
+		}
+
+		items, err := koreader.ReadAnnotations(part)
+		if err != nil {
+			result := map[string]interface{}{
+				"file":    filename,
+				"status":  "error",
+				"content": err.Error(),
+			}
+			results = append(results, result)
+			log.Printf("[ERROR] %+v", err)
+			continue
+		}
+
+		annotations := make([]model.Annotation, 0, len(items))
+		for _, item := range items {
+			annotation := model.Annotation{
+				UserID:    userID,
+				BookID:    bookID,
+				FileID:    fileID,
+				Kind:      item.Kind,
+				XPointer0: item.Pos0,
+				XPointer1: item.Pos1,
+				Page:      item.Page,
+				Chapter:   item.Chapter,
+				Text:      item.Text,
+				Note:      item.Note,
+				Color:     item.Color,
+			}
+			if item.Rect != nil {
+				annotation.RectX = item.Rect.X
+				annotation.RectY = item.Rect.Y
+				annotation.RectWidth = item.Rect.Width
+				annotation.RectHeight = item.Rect.Height
+			}
+			if !item.Datetime.IsZero() {
+				annotation.CreatedAt = item.Datetime
+			}
+			annotations = append(annotations, annotation)
+		}
+
+		count, err := model.ImportAnnotations(h.db, annotations)
+		if err != nil {
+			result := map[string]interface{}{
+				"file":    filename,
+				"status":  "error",
+				"content": err.Error(),
+			}
+			results = append(results, result)
+			log.Printf("[ERROR] %+v", err)
+			continue
+		}
+
+		result := map[string]interface{}{
+			"file":    filename,
+			"status":  "ok",
+			"content": map[string]int{"found": len(annotations), "imported": count},
+		}
+		results = append(results, result)
+	}
+
+	h.handleSuccess(w, results)
+}
+
+func (h *Handler) getAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*model.Annotation, bool) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	annotationidString := ps.ByName("annotationid")
+	annotationID, err := strconv.ParseUint(annotationidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid annotationid"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	annotation, err := model.GetAnnotation(h.db, userIDFromContext(r), bookID, annotationID)
+	switch {
+	case err == model.ErrAnnotationNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return annotation, true
+}
+
+// readAnnotationForm sets annotation properties given in the request form.
+// Fields missing from the form are left unchanged.
+func readAnnotationForm(r *http.Request, annotation *model.Annotation) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	updateString := func(field string, value *string) {
+		if _, ok := r.Form[field]; ok {
+			*value = r.FormValue(field)
+		}
+	}
+	updateFloat := func(field string, value *float64) error {
+		if _, ok := r.Form[field]; !ok {
+			return nil
+		}
+		v, err := strconv.ParseFloat(r.FormValue(field), 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s", field)
+		}
+		*value = v
+		return nil
+	}
+
+	updateString("Kind", &annotation.Kind)
+	updateString("CFI", &annotation.CFI)
+	updateString("XPointer0", &annotation.XPointer0)
+	updateString("XPointer1", &annotation.XPointer1)
+	updateString("Chapter", &annotation.Chapter)
+	updateString("Text", &annotation.Text)
+	updateString("Note", &annotation.Note)
+	updateString("Color", &annotation.Color)
+
+	if _, ok := r.Form["FileID"]; ok {
+		fileID, err := strconv.ParseUint(r.FormValue("FileID"), 10, 64)
+		if err != nil {
+			return errors.New("invalid FileID")
+		}
+		annotation.FileID = fileID
+	}
+	if _, ok := r.Form["Page"]; ok {
+		page, err := strconv.Atoi(r.FormValue("Page"))
+		if err != nil {
+			return errors.New("invalid Page")
+		}
+		annotation.Page = page
+	}
+	for field, value := range map[string]*float64{
+		"RectX":      &annotation.RectX,
+		"RectY":      &annotation.RectY,
+		"RectWidth":  &annotation.RectWidth,
+		"RectHeight": &annotation.RectHeight,
+	} {
+		if err := updateFloat(field, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,426 @@
+package controller
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/altescy/bookshelf/archive"
+	"github.com/altescy/bookshelf/format"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ArchiveSummary reports records and blobs exported or imported.
+type ArchiveSummary struct {
+	Records map[string]int
+	// Skipped records already exist, such as books of the same UUID.
+	Skipped map[string]int
+	Blobs   int
+	Errors  []string
+}
+
+func newArchiveSummary() *ArchiveSummary {
+	return &ArchiveSummary{Records: map[string]int{}, Skipped: map[string]int{}, Errors: []string{}}
+}
+
+func (s *ArchiveSummary) fail(msg string, args ...interface{}) {
+	message := fmt.Sprintf(msg, args...)
+	log.Printf("[ERROR] %s", message)
+	s.Errors = append(s.Errors, message)
+}
+
+// ExportArchive streams an archive of the whole library.
+func (h *Handler) ExportArchive(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filename := fmt.Sprintf("bookshelf-%s.tar.gz", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// errors cannot be reported once the archive is being sent
+	summary, err := h.ExportLibrary(w)
+	if err != nil {
+		log.Printf("[ERROR] cannot export library: %v", err)
+		return
+	}
+	log.Printf("[INFO] exported library: %v, %d blobs", summary.Records, summary.Blobs)
+}
+
+// ImportArchive restores an archive sent as the request body.
+func (h *Handler) ImportArchive(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	summary, err := h.ImportLibrary(r.Body)
+	switch {
+	case err == archive.ErrInvalidArchive, err == archive.ErrUnsupportedVersion:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, summary)
+}
+
+// ExportLibrary writes an archive of records of all tables and the blobs of
+// files and covers. Tables and blobs are spooled to temporary files, so the
+// library does not have to fit in memory.
+func (h *Handler) ExportLibrary(w io.Writer) (*ArchiveSummary, error) {
+	summary := newArchiveSummary()
+	aw := archive.NewWriter(w)
+	manifest := archive.Manifest{
+		Version:   archive.Version,
+		CreatedAt: time.Now(),
+		Tables:    model.ArchiveTables(),
+	}
+	if err := aw.WriteManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	blobs := map[string]bool{}
+	for _, table := range manifest.Tables {
+		err := spool(func(tmp io.Writer) error {
+			bw := bufio.NewWriter(tmp)
+			err := model.EachArchiveRecord(h.db, table, func(record interface{}) error {
+				switch v := record.(type) {
+				case *model.Book:
+					if v.CoverPath != "" {
+						blobs[v.CoverPath] = true
+					}
+				case *model.File:
+					blobs[v.Path] = true
+				}
+				b, err := archive.EncodeRecord(record)
+				if err != nil {
+					return err
+				}
+				summary.Records[table]++
+				bw.Write(b)
+				return bw.WriteByte('\n')
+			})
+			if err != nil {
+				return err
+			}
+			return bw.Flush()
+		}, func(size int64, r io.Reader) error {
+			return aw.WriteTable(table, size, r)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths := []string{}
+	for path := range blobs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var missing error
+		err := spool(func(tmp io.Writer) error {
+			if err := h.storage.Download(tmp, path); err != nil {
+				missing = err
+			}
+			return nil
+		}, func(size int64, r io.Reader) error {
+			if missing != nil {
+				return nil
+			}
+			return aw.WriteBlob(path, size, r)
+		})
+		switch {
+		case err != nil:
+			return nil, err
+		case missing != nil:
+			summary.fail("cannot download %s: %v", path, missing)
+		default:
+			summary.Blobs++
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// ImportLibrary adds records and blobs of an archive to the library. Records
+// get new IDs, and references between them are updated. Books whose UUIDs
+// exist are skipped with the records depending on them, and users, custom
+// formats, devices and reading progress are merged into existing ones, so
+// importing an archive again does not add anything twice.
+func (h *Handler) ImportLibrary(r io.Reader) (*ArchiveSummary, error) {
+	ar, err := archive.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+
+	im := archiveImporter{
+		h:       h,
+		summary: newArchiveSummary(),
+		ids:     map[string]map[uint64]uint64{},
+		blobs:   map[string]bool{},
+		resumed: map[uint64]bool{},
+	}
+	for _, table := range model.ArchiveTables() {
+		im.ids[table] = map[uint64]uint64{}
+	}
+
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return im.summary, err
+		}
+
+		switch {
+		case entry.Table != "":
+			if err := im.importTable(entry.Table, entry.Body); err != nil {
+				return im.summary, err
+			}
+		case entry.Blob != "":
+			if err := im.importBlob(entry.Blob, entry.Body); err != nil {
+				return im.summary, err
+			}
+		}
+	}
+	return im.summary, nil
+}
+
+type archiveImporter struct {
+	h       *Handler
+	summary *ArchiveSummary
+	// ids map IDs in the archive to IDs of imported or existing records
+	ids map[string]map[uint64]uint64
+	// blobs are paths referenced by imported records
+	blobs map[string]bool
+	// resumed are IDs of books in the archive which exist
+	resumed map[uint64]bool
+}
+
+func (im *archiveImporter) importTable(table string, r io.Reader) error {
+	if _, err := model.NewArchiveRecord(table); err != nil {
+		log.Printf("[WARN] skip %v", err)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record, _ := model.NewArchiveRecord(table)
+		if err := archive.DecodeRecord(scanner.Bytes(), record); err != nil {
+			return archive.ErrInvalidArchive
+		}
+		imported, err := im.importRecord(record)
+		switch {
+		case err != nil:
+			im.summary.fail("cannot import %s record: %v", table, err)
+		case imported:
+			im.summary.Records[table]++
+		default:
+			im.summary.Skipped[table]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return archive.ErrInvalidArchive
+	}
+	return nil
+}
+
+// importRecord inserts a record with references to new IDs, and reports
+// false for records which are skipped.
+func (im *archiveImporter) importRecord(record interface{}) (bool, error) {
+	h := im.h
+	id := func(table string, old uint64) (uint64, bool) {
+		if old == 0 {
+			return 0, true
+		}
+		v, ok := im.ids[table][old]
+		return v, ok
+	}
+	var ok bool
+
+	switch v := record.(type) {
+	case *model.User:
+		old := v.ID
+		if existing, err := model.GetUserByName(h.db, v.Username); err == nil {
+			im.ids["users"][old] = existing.ID
+			return false, nil
+		}
+		v.ID = 0
+		if err := model.InsertArchiveRecord(h.db, v); err != nil {
+			return false, err
+		}
+		im.ids["users"][old] = v.ID
+
+	case *model.CustomFormat:
+		if _, err := format.Default.ByAlias(v.Alias); err == nil {
+			return false, nil
+		}
+		v.ID = 0
+		if err := model.AddCustomFormat(h.db, v); err != nil {
+			return false, err
+		}
+
+	case *model.Book:
+		old := v.ID
+		if _, err := model.GetBookByUUID(h.db, v.UUID); err == nil {
+			// blobs of a previous import may be missing if it was stopped
+			im.resumed[old] = true
+			if v.CoverPath != "" {
+				im.blobs[v.CoverPath] = true
+			}
+			return false, nil
+		}
+		v.ID = 0
+		if err := model.InsertArchiveRecord(h.db, v); err != nil {
+			return false, err
+		}
+		im.ids["books"][old] = v.ID
+		if v.CoverPath != "" {
+			im.blobs[v.CoverPath] = true
+			v.CoverURL = coverURL(v.ID)
+			if err := model.UpdateBook(h.db, v); err != nil {
+				return false, err
+			}
+		}
+
+	case *model.File:
+		old := v.ID
+		if im.resumed[v.BookID] {
+			im.blobs[v.Path] = true
+		}
+		if v.BookID, ok = id("books", v.BookID); !ok {
+			return false, nil
+		}
+		v.ID = 0
+		if err := model.InsertArchiveRecord(h.db, v); err != nil {
+			return false, err
+		}
+		im.ids["files"][old] = v.ID
+		im.blobs[v.Path] = true
+
+	case *model.Progress:
+		if v.UserID, ok = id("users", v.UserID); !ok {
+			return false, nil
+		}
+		if _, err := model.GetProgress(h.db, v.UserID, v.Document); err == nil {
+			return false, nil
+		}
+		v.FileID, _ = id("files", v.FileID)
+		v.ID = 0
+		return true, model.InsertArchiveRecord(h.db, v)
+
+	case *model.Annotation:
+		if v.BookID, ok = id("books", v.BookID); !ok {
+			return false, nil
+		}
+		if v.UserID, ok = id("users", v.UserID); !ok {
+			return false, nil
+		}
+		v.FileID, _ = id("files", v.FileID)
+		v.ID = 0
+		return true, model.InsertArchiveRecord(h.db, v)
+
+	case *model.MetadataProposal:
+		if v.BookID, ok = id("books", v.BookID); !ok {
+			return false, nil
+		}
+		// jobs are not archived
+		v.JobID = 0
+		v.ID = 0
+		return true, model.InsertArchiveRecord(h.db, v)
+
+	case *model.Device:
+		old := v.ID
+		if v.UserID, ok = id("users", v.UserID); !ok {
+			return false, nil
+		}
+		if devices, err := model.GetDevices(h.db, v.UserID); err == nil {
+			for _, d := range *devices {
+				if d.Email == v.Email {
+					im.ids["devices"][old] = d.ID
+					return false, nil
+				}
+			}
+		}
+		v.ID = 0
+		if err := model.InsertArchiveRecord(h.db, v); err != nil {
+			return false, err
+		}
+		im.ids["devices"][old] = v.ID
+
+	case *model.Delivery:
+		if v.BookID, ok = id("books", v.BookID); !ok {
+			return false, nil
+		}
+		if v.UserID, ok = id("users", v.UserID); !ok {
+			return false, nil
+		}
+		if v.DeviceID, ok = id("devices", v.DeviceID); !ok {
+			return false, nil
+		}
+		v.FileID, _ = id("files", v.FileID)
+		v.SentFileID, _ = id("files", v.SentFileID)
+		v.JobID = 0
+		v.ID = 0
+		return true, model.InsertArchiveRecord(h.db, v)
+
+	default:
+		return false, errors.New("unsupported record")
+	}
+	return true, nil
+}
+
+// importBlob uploads a blob referenced by imported records unless the
+// storage already has it.
+func (im *archiveImporter) importBlob(path string, r io.Reader) error {
+	if !im.blobs[path] {
+		return nil
+	}
+	if _, err := im.h.storage.Size(path); err == nil {
+		return nil
+	}
+
+	return spool(func(tmp io.Writer) error {
+		_, err := io.Copy(tmp, r)
+		return err
+	}, func(_ int64, body io.Reader) error {
+		if err := im.h.storage.Upload(path, body.(io.ReadSeeker)); err != nil {
+			im.summary.fail("cannot upload %s: %v", path, err)
+			return nil
+		}
+		im.summary.Blobs++
+		return nil
+	})
+}
+
+// spool writes data to a temporary file and reads it back with its size.
+func spool(write func(w io.Writer) error, read func(size int64, r io.Reader) error) error {
+	tmp, err := ioutil.TempFile("", "bookshelf-archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return read(size, tmp)
+}
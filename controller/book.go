@@ -2,8 +2,10 @@ package controller
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/altescy/bookshelf/model"
 	"github.com/julienschmidt/httprouter"
@@ -22,6 +24,20 @@ func (h *Handler) AddBook(w http.ResponseWriter, r *http.Request, _ httprouter.P
 		Files:       []model.File{},
 	}
 
+	if err := readBookProperties(r, &book); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if book.ISBN != "" {
+		isbn, err := model.NormalizeISBN(book.ISBN)
+		if err != nil {
+			h.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+		book.ISBN = isbn
+	}
+
 	if err := model.AddBook(h.db, &book); err != nil {
 		h.handleError(w, err, http.StatusInternalServerError)
 		return
@@ -30,6 +46,55 @@ func (h *Handler) AddBook(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	h.handleSuccess(w, book)
 }
 
+// readBookProperties sets series, tags, identifiers and rating of a book
+// given in the form. Unlike other properties, missing ones are kept so that
+// clients unaware of them do not clear them.
+func readBookProperties(r *http.Request, book *model.Book) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	given := func(field string) bool {
+		_, ok := r.Form[field]
+		return ok
+	}
+
+	if given("Series") {
+		book.Series = strings.TrimSpace(r.FormValue("Series"))
+	}
+	if given("SeriesIndex") {
+		index, err := strconv.ParseFloat(r.FormValue("SeriesIndex"), 64)
+		if err != nil || index < 0 {
+			return errors.New("invalid series index")
+		}
+		book.SeriesIndex = index
+	}
+	if given("Tags") {
+		book.Tags = joinList(r.FormValue("Tags"))
+	}
+	if given("Identifiers") {
+		book.Identifiers = joinList(r.FormValue("Identifiers"))
+	}
+	if given("Rating") {
+		rating, err := strconv.Atoi(r.FormValue("Rating"))
+		if err != nil || rating < 0 || rating > 10 {
+			return errors.New("invalid rating")
+		}
+		book.Rating = rating
+	}
+	return nil
+}
+
+// joinList normalizes a list separated by commas.
+func joinList(list string) string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
 //DeleteBook delete specified book from DB
 func (h *Handler) DeleteBook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	bookidString := ps.ByName("bookid")
@@ -138,6 +203,7 @@ func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request, ps httprout
 		}
 	}
 
+	storedISBN := book.ISBN
 	updateString("ISBN", &book.ISBN)
 	updateString("Title", &book.Title)
 	updateString("Author", &book.Author)
@@ -146,6 +212,21 @@ func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request, ps httprout
 	updateString("Publisher", &book.Publisher)
 	updateString("PubDate", &book.PubDate)
 
+	if err := readBookProperties(r, book); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// ISBNs stored before validation are kept unless they are changed
+	if book.ISBN != "" && book.ISBN != storedISBN {
+		isbn, err := model.NormalizeISBN(book.ISBN)
+		if err != nil {
+			h.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+		book.ISBN = isbn
+	}
+
 	err = model.UpdateBook(h.db, book)
 	if err != nil {
 		h.handleError(w, err, http.StatusInternalServerError)
@@ -160,3 +241,7 @@ func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request, ps httprout
 
 	h.handleSuccess(w, book)
 }
+
+func coverURL(bookID uint64) string {
+	return fmt.Sprintf("/api/book/%d/cover", bookID)
+}
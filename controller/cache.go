@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+var errCacheDisabled = errors.New("storage cache is disabled")
+
+// GetCacheStats returns hits, misses and usage of the storage cache.
+func (h *Handler) GetCacheStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.cache == nil {
+		h.handleError(w, errCacheDisabled, http.StatusNotFound)
+		return
+	}
+	h.handleSuccess(w, h.cache.Stats())
+}
+
+// WarmCache fetches files and covers of recently added books into the
+// storage cache.
+func (h *Handler) WarmCache(books int) {
+	if h.cache == nil || books <= 0 {
+		return
+	}
+
+	paths, err := model.GetRecentBlobs(h.db, books)
+	if err != nil {
+		log.Printf("[WARN] cannot load files to warm cache: %v", err)
+		return
+	}
+	for _, path := range paths {
+		if err := h.cache.Warm(path); err != nil {
+			log.Printf("[WARN] cannot warm cache with %s: %v", path, err)
+		}
+	}
+	stats := h.cache.Stats()
+	log.Printf("[INFO] warmed cache: %d files, %d bytes", stats.Files, stats.Size)
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/altescy/bookshelf/calibre"
+	"github.com/altescy/bookshelf/model"
+)
+
+// CalibreImportSummary reports the result of importing a Calibre library.
+type CalibreImportSummary struct {
+	Books int
+	// Added books are new, Updated books existed and gained files or a
+	// cover, and Unchanged books were imported before.
+	Added     int
+	Updated   int
+	Unchanged int
+	Files     int
+	Errors    []string
+}
+
+// ImportCalibre adds books of a Calibre library with their files and
+// covers. Books are identified by Calibre UUIDs which are kept as book
+// UUIDs, so that an interrupted import is resumed by running it again
+// without adding books or files twice.
+func (h *Handler) ImportCalibre(lib *calibre.Library) (*CalibreImportSummary, error) {
+	books, err := lib.Books()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := CalibreImportSummary{Books: len(books), Errors: []string{}}
+	for i := range books {
+		cb := &books[i]
+		fail := func(format string, args ...interface{}) {
+			message := fmt.Sprintf("%s: ", cb.Title) + fmt.Sprintf(format, args...)
+			log.Printf("[ERROR] %s", message)
+			summary.Errors = append(summary.Errors, message)
+		}
+
+		if cb.UUID == "" {
+			fail("no uuid")
+			continue
+		}
+
+		added := false
+		book, err := model.GetBookByUUID(h.db, cb.UUID)
+		switch {
+		case err == model.ErrBookNotFound:
+			book = calibreBook(cb)
+			if err := model.AddBook(h.db, book); err != nil {
+				fail("%v", err)
+				continue
+			}
+			added = true
+		case err != nil:
+			return &summary, err
+		}
+
+		changed := false
+		if cb.HasCover && book.CoverPath == "" {
+			cover, err := ioutil.ReadFile(lib.CoverPath(cb))
+			if err == nil {
+				err = h.saveCover(book, cover, "image/jpeg")
+			}
+			if err != nil {
+				fail("cannot import cover: %v", err)
+			} else {
+				changed = true
+			}
+		}
+
+		existing := map[string]bool{}
+		for _, file := range book.Files {
+			existing[file.MimeType] = true
+		}
+		for _, f := range cb.Formats {
+			path := lib.FilePath(cb, f)
+			mime, err := model.MimeByFilename(path)
+			if err != nil {
+				// formats like ORIGINAL_EPUB kept by Calibre conversions
+				log.Printf("[INFO] skip %s of %s: %v", f.Format, cb.Title, err)
+				continue
+			}
+			if existing[mime] {
+				continue
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				fail("cannot read %s: %v", f.Format, err)
+				continue
+			}
+			result := h.addFile(book.ID, f.Name+"."+strings.ToLower(f.Format), b)
+			if result["status"] != "ok" {
+				fail("%s: %v", f.Format, result["content"])
+				continue
+			}
+			existing[mime] = true
+			summary.Files++
+			changed = true
+		}
+
+		switch {
+		case added:
+			summary.Added++
+			log.Printf("[INFO] imported %s from calibre as book %d", cb.Title, book.ID)
+		case changed:
+			summary.Updated++
+			log.Printf("[INFO] resumed import of %s into book %d", cb.Title, book.ID)
+		default:
+			summary.Unchanged++
+		}
+	}
+	return &summary, nil
+}
+
+// calibreBook returns a book having properties of a Calibre book.
+func calibreBook(cb *calibre.Book) *model.Book {
+	book := model.Book{
+		UUID:        cb.UUID,
+		Title:       cb.Title,
+		Author:      strings.Join(cb.Authors, ", "),
+		Description: cb.Comments,
+		Publisher:   cb.Publisher,
+		PubDate:     cb.PubDate,
+		Tags:        strings.Join(cb.Tags, ","),
+		Rating:      cb.Rating,
+		Files:       []model.File{},
+	}
+	if cb.Series != "" {
+		book.Series = cb.Series
+		book.SeriesIndex = cb.SeriesIndex
+	}
+
+	identifiers := []string{}
+	for key, value := range cb.Identifiers {
+		if key == "isbn" {
+			if isbn, err := model.NormalizeISBN(value); err == nil {
+				book.ISBN = isbn
+				continue
+			}
+		}
+		identifiers = append(identifiers, key+":"+value)
+	}
+	sort.Strings(identifiers)
+	book.Identifiers = strings.Join(identifiers, ",")
+	return &book
+}
@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/altescy/bookshelf/comic"
+	"github.com/altescy/bookshelf/model"
+	"github.com/altescy/bookshelf/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+const comicCacheSize = 4
+
+// comicCache keeps local copies of recently opened CBR and CB7 archives, so
+// that each page request does not download the whole archive again. ZIP
+// archives are read by ranges and need no copies. An evicted archive is
+// closed, removing its copy, once no request reads it.
+type comicCache struct {
+	mu       sync.Mutex
+	archives map[string]*cachedComic
+	keys     []string
+}
+
+type cachedComic struct {
+	archive comic.Archive
+	refs    int
+	evicted bool
+}
+
+func newComicCache() *comicCache {
+	return &comicCache{archives: map[string]*cachedComic{}}
+}
+
+// get returns a cached archive, which must be closed after use.
+func (c *comicCache) get(key string) (comic.Archive, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.archives[key]
+	if !ok {
+		return nil, false
+	}
+	entry.refs++
+	return &comicHandle{cache: c, entry: entry}, true
+}
+
+// add caches an opened archive and returns it to be closed after use.
+func (c *comicCache) add(key string, archive comic.Archive) comic.Archive {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.archives[key]; ok {
+		// opened by a concurrent request
+		archive.Close()
+		entry.refs++
+		return &comicHandle{cache: c, entry: entry}
+	}
+	if len(c.keys) >= comicCacheSize {
+		oldest := c.archives[c.keys[0]]
+		delete(c.archives, c.keys[0])
+		c.keys = c.keys[1:]
+		oldest.evicted = true
+		if oldest.refs == 0 {
+			oldest.archive.Close()
+		}
+	}
+	entry := &cachedComic{archive: archive, refs: 1}
+	c.archives[key] = entry
+	c.keys = append(c.keys, key)
+	return &comicHandle{cache: c, entry: entry}
+}
+
+func (c *comicCache) release(entry *cachedComic) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.archive.Close()
+	}
+}
+
+// comicHandle is a cached archive in use by a request.
+type comicHandle struct {
+	cache  *comicCache
+	entry  *cachedComic
+	closed bool
+}
+
+func (a *comicHandle) Pages() []string {
+	return a.entry.archive.Pages()
+}
+
+func (a *comicHandle) Open(name string) (io.ReadCloser, error) {
+	return a.entry.archive.Open(name)
+}
+
+func (a *comicHandle) Close() error {
+	if !a.closed {
+		a.closed = true
+		a.cache.release(a.entry)
+	}
+	return nil
+}
+
+type comicPage struct {
+	Index int    `json:"Index"`
+	Name  string `json:"Name"`
+	Type  string `json:"Type"`
+}
+
+// GetComicPages returns the list of pages of a comic archive
+func (h *Handler) GetComicPages(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, archive, ok := h.openComic(w, ps)
+	if !ok {
+		return
+	}
+	defer archive.Close()
+
+	pages := []comicPage{}
+	for i, name := range archive.Pages() {
+		pages = append(pages, comicPage{Index: i, Name: name, Type: comic.ImageType(name)})
+	}
+
+	h.handleSuccess(w, pages)
+}
+
+// GetComicPage returns an image of the page at a 0-based index. This is
+// also used as the OPDS Page Streaming Extension stream link.
+func (h *Handler) GetComicPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	index, err := strconv.Atoi(ps.ByName("page"))
+	if err != nil {
+		h.handleError(w, errors.New("invalid page"), http.StatusBadRequest)
+		return
+	}
+
+	file, archive, ok := h.openComic(w, ps)
+	if !ok {
+		return
+	}
+	defer archive.Close()
+
+	rc, imageType, err := comic.OpenPage(archive, index)
+	switch {
+	case err == comic.ErrPageNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", imageType)
+	w.Header().Set("Cache-Control", epubCacheControl)
+	http.ServeContent(w, r, "", file.UpdatedAt, bytes.NewReader(b))
+}
+
+// GetCover returns a cover image stored for a book
+func (h *Handler) GetCover(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	book, err := model.GetBookByID(h.db, bookID)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if book.CoverPath == "" {
+		h.handleError(w, errors.New("cover not found"), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", book.CoverType)
+	w.Header().Set("Cache-Control", epubCacheControl)
+	w.WriteHeader(http.StatusOK)
+	if err := h.storage.Download(w, book.CoverPath); err != nil {
+		log.Printf("[WARN] download cover failed. %s", err)
+	}
+}
+
+func (h *Handler) openComic(w http.ResponseWriter, ps httprouter.Params) (*model.File, comic.Archive, bool) {
+	ext := "." + ps.ByName("ext")
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	mime, err := model.MimeByExt(ext)
+	switch {
+	case err == model.ErrMimeNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if !model.IsComicMime(mime) {
+		h.handleError(w, errors.New("not a comic archive"), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	file, err := model.GetFile(h.db, bookID, mime)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	var archive comic.Archive
+	if model.IsZipComicMime(file.MimeType) {
+		reader, err := storage.NewReaderAt(h.storage, file.Path)
+		if err != nil {
+			h.handleError(w, err, http.StatusInternalServerError)
+			return nil, nil, false
+		}
+		archive, err = comic.OpenZip(reader, reader.Size())
+	} else if cached, ok := h.comics.get(file.Path); ok {
+		archive = cached
+	} else {
+		archive, err = openExternalComic(func(w io.Writer) error {
+			return h.storage.Download(w, file.Path)
+		})
+		if err == nil {
+			archive = h.comics.add(file.Path, archive)
+		}
+	}
+	switch {
+	case err == comic.ErrUnsupportedArchive:
+		h.handleError(w, err, http.StatusNotImplemented)
+		return nil, nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+
+	return file, archive, true
+}
+
+func openExternalComic(write func(w io.Writer) error) (comic.Archive, error) {
+	if !comic.IsExternalAvailable() {
+		return nil, comic.ErrUnsupportedArchive
+	}
+	path, cleanup, err := comic.TempFile(write)
+	if err != nil {
+		return nil, err
+	}
+	return comic.OpenExternal(path, cleanup)
+}
+
+// countComicPages counts pages of an uploaded comic archive.
+func (h *Handler) countComicPages(file *model.File, b []byte) error {
+	var (
+		archive comic.Archive
+		err     error
+	)
+	if model.IsZipComicMime(file.MimeType) {
+		archive, err = comic.OpenZip(bytes.NewReader(b), int64(len(b)))
+	} else {
+		archive, err = openExternalComic(func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	file.PageCount = len(archive.Pages())
+	return nil
+}
+
+// saveCover stores a cover image and points the book cover URL to it. The
+// book is left unchanged unless the image is stored and the book is saved.
+func (h *Handler) saveCover(book *model.Book, cover []byte, coverType string) error {
+	coverPath := model.GenerateCoverPath(book.ID)
+	if err := h.storage.Upload(coverPath, bytes.NewReader(cover)); err != nil {
+		return err
+	}
+
+	prevPath, prevType, prevURL := book.CoverPath, book.CoverType, book.CoverURL
+	book.CoverPath = coverPath
+	book.CoverType = coverType
+	book.CoverURL = coverURL(book.ID)
+	if err := model.UpdateBook(h.db, book); err != nil {
+		book.CoverPath, book.CoverType, book.CoverURL = prevPath, prevType, prevURL
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/altescy/bookshelf/charset"
+	"github.com/altescy/bookshelf/convert"
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// convertJob is the payload of a job converting a file of a book into
+// another format, which is added to the book as a new file.
+type convertJob struct {
+	BookID uint64
+	FileID uint64
+	To     string
+	// Optional conversions are skipped if the book already has a file of
+	// the format, so that files uploaded by users stay current.
+	Optional bool
+}
+
+// ConvertFile enqueues a job converting a file to the format given by the
+// To form value
+func (h *Handler) ConvertFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ext := "." + ps.ByName("ext")
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	mime, err := model.MimeByExt(ext)
+	switch {
+	case err == model.ErrMimeNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	file, err := model.GetFile(h.db, bookID, mime)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	from, err := model.GetMimeAlias(mime)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	to, err := model.GetMimeAlias(mimeOrEmpty(r.FormValue("To")))
+	if err != nil {
+		h.handleError(w, errors.New("invalid target format"), http.StatusBadRequest)
+		return
+	}
+	if !h.converter.CanConvert(from, to) {
+		h.handleError(w, convert.ErrUnsupported, http.StatusBadRequest)
+		return
+	}
+
+	j, err := h.jobs.Enqueue(jobConvert, convertJob{BookID: bookID, FileID: file.ID, To: to})
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, j)
+}
+
+// mimeOrEmpty returns the MIME type of a format alias or an extension.
+func mimeOrEmpty(alias string) string {
+	alias = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(alias)), ".")
+	if alias == "" {
+		return ""
+	}
+	mime, err := model.MimeByExt("." + alias)
+	if err != nil {
+		return ""
+	}
+	return mime
+}
+
+func (h *Handler) runConvert(ctx context.Context, j *job.Job) error {
+	payload := convertJob{}
+	if err := j.Decode(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	book, err := model.GetBookByID(h.db, payload.BookID)
+	if err != nil {
+		if err == model.ErrBookNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+	src, err := model.GetFileByID(h.db, payload.FileID)
+	if err != nil {
+		if err == model.ErrFileNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+
+	if payload.Optional {
+		_, err := model.GetFile(h.db, book.ID, mimeOrEmpty(payload.To))
+		switch {
+		case err == nil:
+			log.Printf("[INFO] skip conversion of file %d: book %d has %s already", src.ID, book.ID, payload.To)
+			return nil
+		case err != model.ErrFileNotFound:
+			return err
+		}
+	}
+
+	_, _, err = h.convertFile(ctx, book, src, payload.To)
+	return err
+}
+
+// convertFile converts a file of a book and adds the result to the book.
+// Errors which are not fixed by retrying are marked permanent.
+func (h *Handler) convertFile(ctx context.Context, book *model.Book, src *model.File, to string) (*model.File, []byte, error) {
+	from, err := model.GetMimeAlias(src.MimeType)
+	if err != nil {
+		return nil, nil, job.Permanent(err)
+	}
+	mime := mimeOrEmpty(to)
+	if mime == "" {
+		return nil, nil, job.Permanent(model.ErrMimeNotFound)
+	}
+
+	buf := bytes.Buffer{}
+	if err := h.storage.Download(&buf, src.Path); err != nil {
+		return nil, nil, err
+	}
+
+	md := convert.Metadata{
+		Identifier: "urn:uuid:" + book.UUID,
+		Title:      book.Title,
+	}
+	for _, author := range strings.Split(book.Author, ",") {
+		if author = strings.TrimSpace(author); author != "" {
+			md.Authors = append(md.Authors, author)
+		}
+	}
+	if book.CoverPath != "" {
+		cover := bytes.Buffer{}
+		if err := h.storage.Download(&cover, book.CoverPath); err != nil {
+			log.Printf("[WARN] cannot download cover of book %d: %v", book.ID, err)
+		} else {
+			md.Cover = cover.Bytes()
+			md.CoverType = book.CoverType
+		}
+	}
+
+	text, err := charset.Decode(buf.Bytes(), src.Charset)
+	if err != nil {
+		return nil, nil, job.Permanent(err)
+	}
+
+	b, err := h.converter.Convert(ctx, from, to, text, md)
+	switch {
+	case err == convert.ErrUnsupported:
+		return nil, nil, job.Permanent(err)
+	case err != nil:
+		return nil, nil, err
+	}
+	if err := checkContent(mime, b); err != nil {
+		return nil, nil, job.Permanent(fmt.Errorf("invalid conversion output: %v", err))
+	}
+
+	file := model.File{BookID: book.ID, MimeType: mime}
+	if err := h.storeFile(&file, b); err != nil {
+		return nil, nil, err
+	}
+
+	// fill empty book properties such as titles read by converters
+	if err := h.extractMetadata(book, mime, b); err != nil {
+		log.Printf("[WARN] cannot extract metadata of converted file %d: %v", file.ID, err)
+	}
+
+	log.Printf("[INFO] converted file %d of book %d from %s to %s", src.ID, book.ID, from, to)
+	return &file, b, nil
+}
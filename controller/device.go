@@ -0,0 +1,448 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/mailer"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errMailNotConfigured = errors.New("mail is not configured")
+	errNoDeviceFormat    = errors.New("no file in formats accepted by the device")
+)
+
+// sendToDeviceJob is the payload of a job emailing a file to a device.
+type sendToDeviceJob struct {
+	DeliveryID uint64
+}
+
+// GetDevices returns devices of the user
+func (h *Handler) GetDevices(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	devices, err := model.GetDevices(h.db, userIDFromContext(r))
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, devices)
+}
+
+// AddDevice registers an email address of a device of the user
+func (h *Handler) AddDevice(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	device := model.Device{UserID: userIDFromContext(r)}
+	if err := readDeviceForm(r, &device); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err := model.AddDevice(h.db, &device)
+	switch {
+	case err == model.ErrInvalidDevice:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, device)
+}
+
+func (h *Handler) UpdateDevice(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	device, ok := h.getDevice(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := readDeviceForm(r, device); err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err := model.UpdateDevice(h.db, device)
+	switch {
+	case err == model.ErrInvalidDevice:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, device)
+}
+
+func (h *Handler) DeleteDevice(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	device, ok := h.getDevice(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := model.DeleteDevice(h.db, device); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, "successfully deleted")
+}
+
+// SendToDevice enqueues a job emailing a book to a device. The format is
+// given by the Ext form value or chosen from the formats of the device.
+func (h *Handler) SendToDevice(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if h.mailer == nil {
+		h.handleError(w, errMailNotConfigured, http.StatusServiceUnavailable)
+		return
+	}
+
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	deviceID, err := strconv.ParseUint(r.FormValue("DeviceID"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid deviceid"), http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	_, err = model.GetDevice(h.db, userID, deviceID)
+	switch {
+	case err == model.ErrDeviceNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = model.GetBookByID(h.db, bookID)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	delivery := model.Delivery{
+		UserID:   userID,
+		DeviceID: deviceID,
+		BookID:   bookID,
+	}
+	if ext := r.FormValue("Ext"); ext != "" {
+		mime, err := model.MimeByExt("." + strings.TrimPrefix(ext, "."))
+		if err != nil {
+			h.handleError(w, err, http.StatusBadRequest)
+			return
+		}
+		file, err := model.GetFile(h.db, bookID, mime)
+		switch {
+		case err == model.ErrFileNotFound:
+			h.handleError(w, err, http.StatusNotFound)
+			return
+		case err != nil:
+			h.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		delivery.FileID = file.ID
+	}
+
+	if err := model.AddDelivery(h.db, &delivery); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	j, err := h.jobs.Enqueue(jobSendToDevice, sendToDeviceJob{DeliveryID: delivery.ID})
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	delivery.JobID = j.ID
+	if err := model.UpdateDelivery(h.db, &delivery); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, delivery)
+}
+
+// GetDeliveries returns recent deliveries of the user filtered by device
+// and status
+func (h *Handler) GetDeliveries(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+
+	deviceID, err := strconv.ParseUint(q.Get("device"), 10, 64)
+	if err != nil && q.Get("device") != "" {
+		h.handleError(w, errors.New("invalid deviceid"), http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.ParseUint(q.Get("count"), 10, 64)
+	if err != nil && q.Get("count") != "" {
+		h.handleError(w, errors.New("invalid count value"), http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := model.GetDeliveries(h.db, userIDFromContext(r), deviceID, q.Get("status"), count)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, deliveries)
+}
+
+func (h *Handler) GetDelivery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	deliveryID, err := strconv.ParseUint(ps.ByName("deliveryid"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid deliveryid"), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := model.GetDelivery(h.db, userIDFromContext(r), deliveryID)
+	switch {
+	case err == model.ErrDeliveryNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, delivery)
+}
+
+func (h *Handler) getDevice(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*model.Device, bool) {
+	deviceID, err := strconv.ParseUint(ps.ByName("deviceid"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid deviceid"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	device, err := model.GetDevice(h.db, userIDFromContext(r), deviceID)
+	switch {
+	case err == model.ErrDeviceNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return device, true
+}
+
+// readDeviceForm sets device properties given in a form.
+func readDeviceForm(r *http.Request, device *model.Device) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	updateString := func(field string, value *string) {
+		if _, ok := r.Form[field]; ok {
+			*value = r.FormValue(field)
+		}
+	}
+	updateString("Name", &device.Name)
+	updateString("Email", &device.Email)
+	updateString("Formats", &device.Formats)
+	if device.Formats == "" {
+		device.Formats = "epub"
+	}
+	if s := r.FormValue("MaxSize"); s != "" {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("invalid max size")
+		}
+		device.MaxSize = size
+	}
+	return nil
+}
+
+func (h *Handler) runSendToDevice(ctx context.Context, j *job.Job) error {
+	payload := sendToDeviceJob{}
+	if err := j.Decode(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	delivery, err := model.GetDelivery(h.db, 0, payload.DeliveryID)
+	if err != nil {
+		if err == model.ErrDeliveryNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+
+	delivery.Status = model.DeliverySending
+	delivery.Error = ""
+	if err := model.UpdateDelivery(h.db, delivery); err != nil {
+		return err
+	}
+
+	err = h.deliver(ctx, delivery)
+	switch {
+	case err == nil:
+		delivery.Status = model.DeliverySent
+	case j.WillRetry(err):
+		delivery.Status = model.DeliveryQueued
+		delivery.Error = err.Error()
+	default:
+		delivery.Status = model.DeliveryFailed
+		delivery.Error = err.Error()
+	}
+	if err := model.UpdateDelivery(h.db, delivery); err != nil {
+		log.Printf("[ERROR] cannot update delivery %d: %v", delivery.ID, err)
+	}
+	return err
+}
+
+// cancelSendToDevice marks the delivery of a canceled job canceled unless it
+// was sent.
+func (h *Handler) cancelSendToDevice(j *job.Job) {
+	payload := sendToDeviceJob{}
+	if err := j.Decode(&payload); err != nil {
+		log.Printf("[ERROR] cannot decode job %d: %v", j.ID, err)
+		return
+	}
+
+	delivery, err := model.GetDelivery(h.db, 0, payload.DeliveryID)
+	if err != nil {
+		log.Printf("[WARN] cannot get delivery %d: %v", payload.DeliveryID, err)
+		return
+	}
+	if delivery.Status == model.DeliverySent {
+		return
+	}
+	delivery.Status = model.DeliveryCanceled
+	if err := model.UpdateDelivery(h.db, delivery); err != nil {
+		log.Printf("[ERROR] cannot update delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// deliver emails a file of a book to a device, converting the book when
+// no file is in a format accepted by the device.
+func (h *Handler) deliver(ctx context.Context, delivery *model.Delivery) error {
+	if h.mailer == nil {
+		return job.Permanent(errMailNotConfigured)
+	}
+
+	device, err := model.GetDevice(h.db, delivery.UserID, delivery.DeviceID)
+	if err != nil {
+		if err == model.ErrDeviceNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+	book, err := model.GetBookByID(h.db, delivery.BookID)
+	if err != nil {
+		if err == model.ErrBookNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+
+	file, b, err := h.deliveryFile(ctx, book, device, delivery.FileID)
+	if err != nil {
+		return err
+	}
+	if device.MaxSize > 0 && int64(len(b)) > device.MaxSize {
+		return job.Permanent(mailer.ErrTooLarge)
+	}
+	delivery.SentFileID = file.ID
+
+	f, err := format.Default.ByMime(file.MimeType)
+	if err != nil {
+		return job.Permanent(err)
+	}
+	attachment := mailer.Attachment{
+		Filename:    attachmentName(book) + f.Extensions[0],
+		ContentType: file.MimeType,
+		Data:        b,
+	}
+	body := fmt.Sprintf("%s\n%s\n", book.Title, book.Author)
+
+	err = h.mailer.Send(ctx, device.Email, book.Title, body, attachment)
+	if err == mailer.ErrTooLarge {
+		return job.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] sent file %d of book %d to %s", file.ID, book.ID, device.Email)
+	return nil
+}
+
+// deliveryFile returns the requested file if given, or the first file in
+// the formats of a device in order of preference. Books without such files
+// are converted.
+func (h *Handler) deliveryFile(ctx context.Context, book *model.Book, device *model.Device, fileID uint64) (*model.File, []byte, error) {
+	formats := device.FormatList()
+
+	sources := []model.File{}
+	if fileID != 0 {
+		file, err := model.GetFileByID(h.db, fileID)
+		if err != nil {
+			if err == model.ErrFileNotFound {
+				return nil, nil, job.Permanent(err)
+			}
+			return nil, nil, err
+		}
+		sources = append(sources, *file)
+	} else {
+		sources = book.Files
+	}
+
+	aliases := make([]string, len(sources))
+	for i, file := range sources {
+		aliases[i], _ = model.GetMimeAlias(file.MimeType)
+	}
+
+	for _, to := range formats {
+		for i, file := range sources {
+			if aliases[i] == to {
+				buf := bytes.Buffer{}
+				if err := h.storage.Download(&buf, file.Path); err != nil {
+					return nil, nil, err
+				}
+				return &file, buf.Bytes(), nil
+			}
+		}
+	}
+
+	for _, to := range formats {
+		for i, file := range sources {
+			if aliases[i] != "" && h.converter.CanConvert(aliases[i], to) {
+				return h.convertFile(ctx, book, &file, to)
+			}
+		}
+	}
+	return nil, nil, job.Permanent(errNoDeviceFormat)
+}
+
+// attachmentName returns a file name of a book without characters which
+// are not allowed in file names.
+func attachmentName(book *model.Book) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(book.Title))
+	if name == "" {
+		name = fmt.Sprintf("book-%d", book.ID)
+	}
+	return name
+}
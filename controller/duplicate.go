@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultDuplicateThreshold is the minimum title and author similarity of
+// duplicate candidates.
+const defaultDuplicateThreshold = 0.8
+
+// GetDuplicates returns groups of books which are likely duplicates
+func (h *Handler) GetDuplicates(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	threshold := defaultDuplicateThreshold
+	if thresholdString := r.URL.Query().Get("threshold"); thresholdString != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(thresholdString, 64)
+		if err != nil || threshold < 0 || threshold > 1 {
+			h.handleError(w, errors.New("invalid threshold value"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	groups, err := model.FindDuplicateBooks(h.db, threshold)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, groups)
+}
+
+// MergeBooks merges books listed in comma separated Books into the
+// specified book. A property such as Title can be set to the ID of the
+// book whose value is kept.
+func (h *Handler) MergeBooks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	bookIDs, err := parseIDs(r.FormValue("Books"))
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	fields := map[string]uint64{}
+	for _, field := range []string{"ISBN", "Title", "Author", "Description", "Publisher", "PubDate", "Series", "Tags", "Identifiers", "Rating", "Cover"} {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+			return
+		}
+		fields[field] = id
+	}
+
+	book, err := model.MergeBooks(h.db, bookID, bookIDs, fields)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err == model.ErrInvalidMerge:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// a cover taken from a merged book is served by the survivor
+	if book.CoverPath != "" && book.CoverURL != coverURL(book.ID) {
+		book.CoverURL = coverURL(book.ID)
+		if err := model.UpdateBook(h.db, book); err != nil {
+			h.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.handleSuccess(w, book)
+}
+
+// parseIDs parses comma separated IDs.
+func parseIDs(s string) ([]uint64, error) {
+	ids := []uint64{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
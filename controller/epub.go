@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/altescy/bookshelf/epub"
+	"github.com/altescy/bookshelf/model"
+	"github.com/altescy/bookshelf/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	epubCacheSize    = 16
+	epubCacheControl = "private, max-age=86400"
+)
+
+// epubCache keeps recently opened EPUBs so that each resource request does
+// not need to read the central directory of the archive again. Stored files
+// never change, so entries are keyed by their storage path.
+type epubCache struct {
+	mu    sync.Mutex
+	books map[string]*epub.Book
+	keys  []string
+}
+
+func newEPUBCache() *epubCache {
+	return &epubCache{books: map[string]*epub.Book{}}
+}
+
+func (c *epubCache) get(key string) (*epub.Book, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	book, ok := c.books[key]
+	return book, ok
+}
+
+func (c *epubCache) add(key string, book *epub.Book) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.books[key]; ok {
+		return
+	}
+	if len(c.keys) >= epubCacheSize {
+		delete(c.books, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.books[key] = book
+	c.keys = append(c.keys, key)
+}
+
+// GetEPUBManifest returns metadata, manifest, spine and table of contents of
+// the EPUB file of a book for the web reader.
+func (h *Handler) GetEPUBManifest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, book, ok := h.openEPUB(w, ps)
+	if !ok {
+		return
+	}
+
+	h.handleSuccess(w, book)
+}
+
+// GetEPUBContent serves a resource in the EPUB file of a book by its path.
+func (h *Handler) GetEPUBContent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	file, book, ok := h.openEPUB(w, ps)
+	if !ok {
+		return
+	}
+
+	name := path.Clean(ps.ByName("path"))[1:]
+	header, err := book.Stat(name)
+	switch {
+	case err == epub.ErrNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rc, err := book.Open(name)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", book.MediaType(name))
+	w.Header().Set("Cache-Control", epubCacheControl)
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%08x"`, file.ID, header.CRC32))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "script-src 'none'")
+	http.ServeContent(w, r, name, file.UpdatedAt, bytes.NewReader(b))
+}
+
+func (h *Handler) openEPUB(w http.ResponseWriter, ps httprouter.Params) (*model.File, *epub.Book, bool) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	mime, err := model.MimeByExt(".epub")
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	file, err := model.GetFile(h.db, bookID, mime)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	if book, ok := h.epubs.get(file.Path); ok {
+		return file, book, true
+	}
+
+	reader, err := storage.NewReaderAt(h.storage, file.Path)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	book, err := epub.Open(reader, reader.Size())
+	if err != nil {
+		h.handleError(w, err, http.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+	h.epubs.add(file.Path, book)
+
+	return file, book, true
+}
@@ -3,12 +3,17 @@ package controller
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 
+	"github.com/altescy/bookshelf/charset"
+	"github.com/altescy/bookshelf/convert"
+	"github.com/altescy/bookshelf/koreader"
 	"github.com/altescy/bookshelf/model"
 	"github.com/julienschmidt/httprouter"
 )
@@ -74,12 +79,255 @@ func (h *Handler) DownloadFile(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	w.Header().Set("Content-Type", file.MimeType)
+	h.serveFile(w, file)
+}
+
+// GetFileVersions returns all versions of a file format of a book
+func (h *Handler) GetFileVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookID, mime, ok := h.parseFileParams(w, ps)
+	if !ok {
+		return
+	}
+
+	files, err := model.GetFileVersions(h.db, bookID, mime)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, files)
+}
+
+// DownloadFileVersion downloads a specific version of a file
+func (h *Handler) DownloadFileVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookID, mime, ok := h.parseFileParams(w, ps)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(ps.ByName("version"))
+	if err != nil {
+		h.handleError(w, errors.New("invalid version"), http.StatusBadRequest)
+		return
+	}
+
+	file, err := model.GetFileVersion(h.db, bookID, mime, version)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.serveFile(w, file)
+}
+
+// PromoteFileVersion makes a specific version the current one
+func (h *Handler) PromoteFileVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookID, mime, ok := h.parseFileParams(w, ps)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(ps.ByName("version"))
+	if err != nil {
+		h.handleError(w, errors.New("invalid version"), http.StatusBadRequest)
+		return
+	}
+
+	file, err := model.PromoteFileVersion(h.db, bookID, mime, version)
+	switch {
+	case err == model.ErrFileNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, file)
+}
+
+func (h *Handler) parseFileParams(w http.ResponseWriter, ps httprouter.Params) (uint64, string, bool) {
+	ext := "." + ps.ByName("ext")
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return 0, "", false
+	}
+
+	mime, err := model.MimeByExt(ext)
+	switch {
+	case err == model.ErrMimeNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return 0, "", false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return 0, "", false
+	}
+
+	return bookID, mime, true
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, file *model.File) {
+	contentType := file.MimeType
+	if file.Charset != "" && file.Charset != charset.Unknown {
+		contentType += "; charset=" + file.Charset
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 	if err := h.storage.Download(w, file.Path); err != nil {
-		h.handleError(w, err, http.StatusInternalServerError)
+		log.Printf("[WARN] download file failed. %s", err)
+	}
+}
+
+// pruneFileVersions removes old versions of a format exceeding the
+// retention policy together with their blobs.
+func (h *Handler) pruneFileVersions(bookID uint64, mime string) {
+	if h.fileRetention <= 0 {
+		return
+	}
+
+	files, err := model.GetPrunableFiles(h.db, bookID, mime, h.fileRetention)
+	if err != nil {
+		log.Printf("[WARN] cannot find old file versions: %v", err)
 		return
 	}
+
+	for _, file := range *files {
+		if err := model.PurgeFile(h.db, &file); err != nil {
+			log.Printf("[WARN] cannot purge file %d: %v", file.ID, err)
+			continue
+		}
+		h.releaseBlob(file.Path)
+	}
+}
+
+// keyedMutex locks blobs by their paths within a process.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// lock locks a key and returns the function unlocking it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// saveFile stores file content and adds the file to the database. With
+// content addressing, an existing blob of the same digest is reused, and the
+// blob is locked until the file references it so that it is not released
+// meanwhile. Reading positions synced before the file was added are linked
+// to it.
+func (h *Handler) saveFile(file *model.File, b []byte) error {
+	unlock := h.blobLocks.lock(file.Path)
+	defer unlock()
+
+	if err := h.uploadBlob(file.Path, b); err != nil {
+		return err
+	}
+	if err := model.AddFile(h.db, file); err != nil {
+		return err
+	}
+	if err := model.LinkProgresses(h.db, file); err != nil {
+		log.Printf("[WARN] cannot link reading positions to file %d: %v", file.ID, err)
+	}
+	return nil
+}
+
+// uploadBlob stores file content unless the blob is already stored.
+func (h *Handler) uploadBlob(path string, b []byte) error {
+	if h.contentAddressed {
+		if size, err := h.storage.Size(path); err == nil && size == int64(len(b)) {
+			return nil
+		}
+	}
+	return h.storage.Upload(path, bytes.NewReader(b))
+}
+
+// storeFile stores content generated by the server, such as converted
+// books, as the new current version of its format.
+func (h *Handler) storeFile(file *model.File, b []byte) error {
+	mimeAlias, err := model.GetMimeAlias(file.MimeType)
+	if err != nil {
+		return err
+	}
+
+	file.DocumentHash, err = koreader.PartialMD5(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+	file.DocumentHashVersion = koreader.PartialMD5Version
+	file.Hash = model.HashContent(b)
+	file.Size = int64(len(b))
+	if h.contentAddressed {
+		file.Path = model.GenerateBlobPath(file.Hash)
+	} else {
+		file.Path = model.GenerateFilePath(file.BookID, mimeAlias)
+	}
+
+	if err := h.saveFile(file, b); err != nil {
+		return err
+	}
+	h.pruneFileVersions(file.BookID, file.MimeType)
+	return nil
+}
+
+// releaseBlob deletes a blob once no file references it. Deleted files
+// still pointing to the blob are purged with it.
+func (h *Handler) releaseBlob(path string) {
+	unlock := h.blobLocks.lock(path)
+	defer unlock()
+
+	count, err := model.CountFileReferences(h.db, path)
+	if err != nil {
+		log.Printf("[WARN] cannot count references of blob %s: %v", path, err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	if err := model.PurgeDeletedFiles(h.db, path); err != nil {
+		log.Printf("[WARN] cannot purge deleted files of blob %s: %v", path, err)
+		return
+	}
+	if err := h.storage.Delete(path); err != nil {
+		log.Printf("[WARN] cannot delete blob %s: %v", path, err)
+	}
 }
 
 func (h *Handler) UploadFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -109,8 +357,6 @@ func (h *Handler) UploadFiles(w http.ResponseWriter, r *http.Request, ps httprou
 	results := []map[string]interface{}{}
 
 	for {
-		file := model.File{BookID: bookID}
-
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
@@ -121,8 +367,8 @@ func (h *Handler) UploadFiles(w http.ResponseWriter, r *http.Request, ps httprou
 			continue
 		}
 
-		// set MIME type
-		file.MimeType, err = model.MimeByFilename(filename)
+		// read file
+		b, err := ioutil.ReadAll(part)
 		if err != nil {
 			result := map[string]interface{}{
 				"file":    filename,
@@ -134,66 +380,137 @@ func (h *Handler) UploadFiles(w http.ResponseWriter, r *http.Request, ps httprou
 			continue
 		}
 
-		// set file path
-		mimeAlias, err := model.GetMimeAlias(file.MimeType)
-		if err != nil {
-			result := map[string]interface{}{
-				"file":    filename,
-				"status":  "error",
-				"content": err.Error(),
-			}
-			results = append(results, result)
-			log.Printf("[ERROR] %+v", err)
-			continue
+		results = append(results, h.addFile(bookID, filename, b))
+	}
+
+	h.handleSuccess(w, results)
+}
+
+// addFile validates the content of a file and adds it to a book. The
+// result reports the added file or the error.
+func (h *Handler) addFile(bookID uint64, filename string, b []byte) map[string]interface{} {
+	fail := func(err error) map[string]interface{} {
+		log.Printf("[ERROR] %+v", err)
+		return map[string]interface{}{
+			"file":    filename,
+			"status":  "error",
+			"content": err.Error(),
 		}
-		file.Path = model.GenerateFilePath(bookID, mimeAlias)
+	}
 
-		// read file
-		b, err := ioutil.ReadAll(part)
-		if err != nil {
-			result := map[string]interface{}{
-				"file":    filename,
-				"status":  "error",
-				"content": err.Error(),
-			}
-			results = append(results, result)
-			log.Printf("[ERROR] %+v", err)
-			continue
+	var err error
+	file := model.File{BookID: bookID}
+
+	// set MIME type, and sniff and validate the content
+	file.MimeType, err = checkFile(filename, b)
+	if err != nil {
+		return fail(err)
+	}
+
+	// set file path
+	mimeAlias, err := model.GetMimeAlias(file.MimeType)
+	if err != nil {
+		return fail(err)
+	}
+
+	// detect the character set of plain text
+	if model.IsTextMime(file.MimeType) {
+		file.Charset = charset.Detect(b)
+	}
+
+	// compute document hash for KOReader progress sync
+	file.DocumentHash, err = koreader.PartialMD5(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fail(err)
+	}
+	file.DocumentHashVersion = koreader.PartialMD5Version
+
+	// count pages of comic archives
+	if model.IsComicMime(file.MimeType) {
+		if err := h.countComicPages(&file, b); err != nil {
+			log.Printf("[WARN] cannot count pages of %s: %v", filename, err)
 		}
+	}
 
-		// upload file to storage
-		err = h.storage.Upload(file.Path, bytes.NewReader(b))
-		if err != nil {
-			result := map[string]interface{}{
-				"file":    filename,
-				"status":  "error",
-				"content": err.Error(),
-			}
-			results = append(results, result)
-			log.Printf("[ERROR] %+v", err)
-			continue
+	// set content hash and file path
+	file.Hash = model.HashContent(b)
+	file.Size = int64(len(b))
+	if h.contentAddressed {
+		file.Path = model.GenerateBlobPath(file.Hash)
+	} else {
+		file.Path = model.GenerateFilePath(bookID, mimeAlias)
+	}
+
+	// warn about identical files of other books
+	warning := ""
+	if dup, err := model.GetDuplicateFile(h.db, bookID, file.Hash); err == nil {
+		warning = fmt.Sprintf("identical file already exists in book %d", dup.BookID)
+	}
+
+	// upload file to storage unless the blob is already stored, and add
+	// file to database
+	err = h.saveFile(&file, b)
+	if err != nil {
+		return fail(err)
+	}
+
+	// keep the original text as the previous version of UTF-8 text
+	original := file
+	if h.transcodeText && model.IsTextMime(file.MimeType) && !charset.IsUTF8(file.Charset) && file.Charset != charset.Unknown {
+		if err := h.transcodeFile(&file, b); err != nil {
+			log.Printf("[WARN] cannot transcode %s from %s: %v", filename, original.Charset, err)
+			file = original
 		}
+	}
 
-		// add file to database
-		err = model.AddFile(h.db, &file)
-		if err != nil {
-			result := map[string]interface{}{
-				"file":    filename,
-				"status":  "error",
-				"content": err.Error(),
+	// fill empty book properties and cover from the file in background
+	payload := extractMetadataJob{BookID: bookID, FileID: file.ID}
+	if _, err := h.jobs.Enqueue(jobExtractMetadata, payload); err != nil {
+		log.Printf("[WARN] cannot enqueue metadata extraction of %s: %v", filename, err)
+	}
+
+	// add a vertical EPUB of texts from Aozora Bunko in background unless
+	// the book has an EPUB
+	if model.IsTextMime(original.MimeType) {
+		if text, err := charset.Decode(b, original.Charset); err == nil && convert.IsAozora(text) {
+			payload := convertJob{BookID: bookID, FileID: file.ID, To: "epub", Optional: true}
+			if _, err := h.jobs.Enqueue(jobConvert, payload); err != nil {
+				log.Printf("[WARN] cannot enqueue conversion of %s: %v", filename, err)
 			}
-			results = append(results, result)
-			log.Printf("[ERROR] %+v", err)
-			continue
 		}
+	}
 
-		result := map[string]interface{}{
-			"file":    filename,
-			"status":  "ok",
-			"content": file,
-		}
-		results = append(results, result)
+	h.pruneFileVersions(bookID, file.MimeType)
+
+	result := map[string]interface{}{
+		"file":    filename,
+		"status":  "ok",
+		"content": file,
+	}
+	if warning != "" {
+		result["warning"] = warning
+	}
+	if file.ID != original.ID {
+		result["original"] = original
 	}
+	return result
+}
 
-	h.handleSuccess(w, results)
+// transcodeFile adds text converted to UTF-8 as the new current version of
+// a file.
+func (h *Handler) transcodeFile(file *model.File, b []byte) error {
+	text, err := charset.Decode(b, file.Charset)
+	if err != nil {
+		return err
+	}
+	transcoded := model.File{
+		BookID:   file.BookID,
+		MimeType: file.MimeType,
+		Charset:  charset.UTF8,
+	}
+	if err := h.storeFile(&transcoded, text); err != nil {
+		return err
+	}
+	*file = transcoded
+	return nil
 }
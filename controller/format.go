@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GetFormats returns all supported file formats
+func (h *Handler) GetFormats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.handleSuccess(w, format.Default.Formats())
+}
+
+// AddFormat adds a custom file format
+func (h *Handler) AddFormat(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	custom := model.CustomFormat{
+		Alias:      r.FormValue("Alias"),
+		MimeType:   r.FormValue("MimeType"),
+		Extensions: r.FormValue("Extensions"),
+	}
+
+	err := model.AddCustomFormat(h.db, &custom)
+	switch {
+	case err == model.ErrFormatConflict:
+		h.handleError(w, err, http.StatusConflict)
+		return
+	case err == model.ErrInvalidFormat:
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, custom)
+}
+
+// DeleteFormat deletes a custom file format
+func (h *Handler) DeleteFormat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := model.DeleteCustomFormat(h.db, ps.ByName("alias"))
+	switch {
+	case err == model.ErrFormatNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err == model.ErrFormatInUse:
+		h.handleError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, "successfully deleted")
+}
+
+// checkContent verifies that an uploaded file is of the format given by
+// its filename and is not corrupted.
+func checkContent(mime string, b []byte) error {
+	f, err := format.Default.ByMime(mime)
+	if err != nil {
+		return err
+	}
+	return f.Check(bytes.NewReader(b), int64(len(b)))
+}
+
+// checkFile finds the format of an uploaded file by its filename and checks
+// its content. Errors mean that the file is rejected.
+func checkFile(filename string, b []byte) (string, error) {
+	mime, err := model.MimeByFilename(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := checkContent(mime, b); err != nil {
+		return "", err
+	}
+	return mime, nil
+}
+
+// extractMetadata fills empty properties and the cover of a book with the
+// metadata found in an uploaded file. Values entered by users are kept.
+func (h *Handler) extractMetadata(book *model.Book, mime string, b []byte) error {
+	f, err := format.Default.ByMime(mime)
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(b)
+	size := int64(len(b))
+	updated := false
+
+	if f.ExtractMetadata != nil {
+		md, err := f.ExtractMetadata(r, size)
+		if err != nil {
+			return err
+		}
+
+		fill := func(value *string, extracted string) {
+			if strings.TrimSpace(*value) == "" && extracted != "" {
+				*value = extracted
+				updated = true
+			}
+		}
+		fill(&book.Title, md.Title)
+		fill(&book.Author, md.Author)
+		fill(&book.Publisher, md.Publisher)
+		fill(&book.PubDate, md.PubDate)
+		fill(&book.Description, md.Description)
+		if isbn, err := model.NormalizeISBN(md.ISBN); err == nil {
+			fill(&book.ISBN, isbn)
+		}
+	}
+
+	// a cover which cannot be stored does not discard the properties
+	var coverErr error
+	if f.ExtractCover != nil && book.CoverURL == "" {
+		cover, coverType, err := f.ExtractCover(r, size)
+		switch {
+		case err == nil:
+			coverErr = h.saveCover(book, cover, coverType)
+			if coverErr == nil {
+				return nil
+			}
+		case err != format.ErrNoCover:
+			coverErr = err
+		}
+	}
+
+	if updated {
+		if err := model.UpdateBook(h.db, book); err != nil {
+			return err
+		}
+	}
+	return coverErr
+}
@@ -1,12 +1,20 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
+	"github.com/altescy/bookshelf/convert"
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/lookup"
+	"github.com/altescy/bookshelf/mailer"
+	"github.com/altescy/bookshelf/model"
 	"github.com/altescy/bookshelf/storage"
 	"github.com/jinzhu/gorm"
+	"github.com/julienschmidt/httprouter"
 )
 
 type key int
@@ -19,14 +27,129 @@ type Handler struct {
 	db         *gorm.DB
 	storage    storage.Storage
 	enableCors bool
+	adminUsers map[string]bool
+	epubs      *epubCache
+	comics     *comicCache
+	blobLocks  *keyedMutex
+	jobs       *job.Queue
+
+	// fileRetention is the number of old versions kept per format.
+	// Zero keeps all versions.
+	fileRetention int
+
+	// contentAddressed stores files by their SHA-256 digest so that
+	// identical uploads share a single blob.
+	contentAddressed bool
+
+	// lookupProviders are asked in order for metadata of ISBNs.
+	lookupProviders []lookup.Provider
+
+	// transcodeText adds UTF-8 versions of plain text uploaded in other
+	// character sets.
+	transcodeText bool
+
+	// converter converts files of books into other formats.
+	converter *convert.Converter
+
+	// mailer sends books to devices by email. Nil disables sending.
+	mailer *mailer.Mailer
+
+	// cache is the local cache of the storage. Nil if files are not cached.
+	cache *storage.CachedStorage
+}
+
+// Option configures optional features of a Handler.
+type Option func(h *Handler)
+
+// WithAdminUsers sets usernames allowed to call administrative APIs.
+func WithAdminUsers(usernames ...string) Option {
+	return func(h *Handler) {
+		for _, username := range usernames {
+			if username != "" {
+				h.adminUsers[username] = true
+			}
+		}
+	}
+}
+
+// WithFileRetention sets the number of old file versions kept per format.
+func WithFileRetention(keep int) Option {
+	return func(h *Handler) {
+		h.fileRetention = keep
+	}
+}
+
+// WithContentAddressing enables the content-addressed storage layout.
+func WithContentAddressing(enable bool) Option {
+	return func(h *Handler) {
+		h.contentAddressed = enable
+	}
+}
+
+// WithLookupProviders sets providers of metadata looked up by ISBN.
+func WithLookupProviders(providers ...lookup.Provider) Option {
+	return func(h *Handler) {
+		h.lookupProviders = providers
+	}
+}
+
+// WithJobQueue sets the queue running background jobs of the handler.
+func WithJobQueue(queue *job.Queue) Option {
+	return func(h *Handler) {
+		h.jobs = queue
+	}
+}
+
+// WithTextTranscoding enables transcoding of uploaded plain text to UTF-8.
+func WithTextTranscoding(enable bool) Option {
+	return func(h *Handler) {
+		h.transcodeText = enable
+	}
 }
 
-func NewHandler(db *gorm.DB, storage storage.Storage, enableCors bool) *Handler {
-	return &Handler{
+// WithConverter sets the converter of book files.
+func WithConverter(converter *convert.Converter) Option {
+	return func(h *Handler) {
+		h.converter = converter
+	}
+}
+
+// WithMailer sets the mailer sending books to devices.
+func WithMailer(m *mailer.Mailer) Option {
+	return func(h *Handler) {
+		h.mailer = m
+	}
+}
+
+// WithStorageCache sets the cache wrapping the storage to report its usage
+// and warm it.
+func WithStorageCache(cache *storage.CachedStorage) Option {
+	return func(h *Handler) {
+		h.cache = cache
+	}
+}
+
+func NewHandler(db *gorm.DB, storage storage.Storage, enableCors bool, opts ...Option) *Handler {
+	h := &Handler{
 		db:         db,
 		storage:    storage,
 		enableCors: enableCors,
+		adminUsers: map[string]bool{},
+		epubs:      newEPUBCache(),
+		comics:     newComicCache(),
+		blobLocks:  newKeyedMutex(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.converter == nil {
+		h.converter = &convert.Converter{}
 	}
+	if h.jobs == nil {
+		h.jobs = job.NewQueue(db, 1)
+	}
+	h.registerJobs()
+	return h
 }
 
 func (h *Handler) CommonMiddleware(f http.Handler) http.Handler {
@@ -44,6 +167,61 @@ func (h *Handler) CommonMiddleware(f http.Handler) http.Handler {
 	})
 }
 
+// authenticate finds the user from the x-auth-user and x-auth-key headers
+// which KOReader sends with every request.
+func (h *Handler) authenticate(r *http.Request) (*model.User, error) {
+	username := r.Header.Get("x-auth-user")
+	key := r.Header.Get("x-auth-key")
+	return model.AuthenticateUser(h.db, username, key)
+}
+
+// Authenticate wraps a handler so that it is only served to users
+// authenticated by the x-auth-user and x-auth-key headers.
+func (h *Handler) Authenticate(f httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, err := h.authenticate(r)
+		switch {
+		case err == model.ErrUnauthorized:
+			h.handleError(w, err, http.StatusUnauthorized)
+			return
+		case err != nil:
+			h.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		f(w, r.WithContext(withUserID(r.Context(), user.ID)), ps)
+	}
+}
+
+// AuthenticateAdmin wraps a handler so that it is only served to users
+// configured as administrators.
+func (h *Handler) AuthenticateAdmin(f httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, err := h.authenticate(r)
+		switch {
+		case err == model.ErrUnauthorized:
+			h.handleError(w, err, http.StatusUnauthorized)
+			return
+		case err != nil:
+			h.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !h.adminUsers[user.Username] {
+			h.handleError(w, errors.New("forbidden"), http.StatusForbidden)
+			return
+		}
+		f(w, r.WithContext(withUserID(r.Context(), user.ID)), ps)
+	}
+}
+
+func withUserID(ctx context.Context, userID uint64) context.Context {
+	return context.WithValue(ctx, keyUserID, userID)
+}
+
+func userIDFromContext(r *http.Request) uint64 {
+	userID, _ := r.Context().Value(keyUserID).(uint64)
+	return userID
+}
+
 func (h *Handler) handleSuccess(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
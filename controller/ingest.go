@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/altescy/bookshelf/model"
+)
+
+// ingestLogName is the name of the log written in each watched folder.
+const ingestLogName = "ingest.log"
+
+// IngestConfig configures the folders watched for new books.
+type IngestConfig struct {
+	Dirs     []string
+	Interval time.Duration
+	// DoneDir and FailedDir receive processed files. Relative paths are
+	// resolved against each watched folder.
+	DoneDir   string
+	FailedDir string
+}
+
+// ingestEntry is a file seen in a watched folder.
+type ingestEntry struct {
+	size    int64
+	modTime time.Time
+	// ingested marks files which could not be moved after processing
+	ingested bool
+}
+
+// Ingest watches folders until the context is cancelled and adds a book for
+// each group of new files sharing a name, like Foo.epub and Foo.pdf. A file
+// is added once its size and modification time stop changing between two
+// scans, so that files being copied are not read halfway.
+func (h *Handler) Ingest(ctx context.Context, config IngestConfig) {
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.DoneDir == "" {
+		config.DoneDir = "done"
+	}
+	if config.FailedDir == "" {
+		config.FailedDir = "failed"
+	}
+
+	seen := map[string]ingestEntry{}
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, dir := range config.Dirs {
+			if err := h.scanIngestDir(dir, config, seen); err != nil {
+				log.Printf("[ERROR] cannot scan ingest folder %s: %v", dir, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) scanIngestDir(dir string, config IngestConfig, seen map[string]ingestEntry) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	groups := map[string][]string{}
+	pending := map[string]bool{}
+	present := map[string]bool{}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || name == ingestLogName || isPartialFile(name) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		present[path] = true
+		entry := ingestEntry{size: info.Size(), modTime: info.ModTime()}
+		prev, ok := seen[path]
+		if ok && prev.ingested && prev.size == entry.size && prev.modTime.Equal(entry.modTime) {
+			continue
+		}
+		seen[path] = entry
+
+		stem := ingestStem(name)
+		if !ok || prev != entry {
+			pending[stem] = true
+			continue
+		}
+		groups[stem] = append(groups[stem], name)
+	}
+
+	// forget files removed from the folder
+	for path := range seen {
+		if filepath.Dir(path) == filepath.Clean(dir) && !present[path] {
+			delete(seen, path)
+		}
+	}
+
+	stems := []string{}
+	for stem := range groups {
+		// wait until every sibling is complete
+		if !pending[stem] {
+			stems = append(stems, stem)
+		}
+	}
+	sort.Strings(stems)
+
+	for _, stem := range stems {
+		names := groups[stem]
+		sort.Strings(names)
+		if !h.ingestGroup(dir, stem, names, config) {
+			// files left in the folder are tried again
+			continue
+		}
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if _, err := os.Lstat(path); err == nil {
+				entry := seen[path]
+				entry.ingested = true
+				seen[path] = entry
+			} else {
+				delete(seen, path)
+			}
+		}
+	}
+	return nil
+}
+
+// ingestGroup adds files as a new book and moves them out of the folder.
+// It reports whether the files are processed. Rejected files are moved to
+// the failed folder, while files which cannot be read or added, such as by
+// a database error, are left in the folder to be tried again.
+func (h *Handler) ingestGroup(dir, stem string, names []string, config IngestConfig) bool {
+	files := []namedFile{}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("[ERROR] cannot read %s: %v", path, err)
+			return false
+		}
+		if _, err := checkFile(name, b); err != nil {
+			log.Printf("[WARN] rejected %s: %v", path, err)
+			h.finishIngest(dir, name, config.FailedDir, "failed", 0, err.Error())
+			continue
+		}
+		files = append(files, namedFile{Name: name, Data: b})
+	}
+	if len(files) == 0 {
+		return true
+	}
+
+	book, results, err := h.addBookFromFiles(stem, files)
+	if err != nil {
+		log.Printf("[ERROR] cannot add book for %s: %v", stem, err)
+		return false
+	}
+	for _, result := range results {
+		if result["status"] == "ok" {
+			continue
+		}
+		// the files are checked, so they are tried again as a new book
+		log.Printf("[ERROR] cannot add %s: %v", result["file"], result["content"])
+		if book != nil {
+			if err := model.DeleteBook(h.db, book); err != nil {
+				log.Printf("[WARN] cannot delete book %d: %v", book.ID, err)
+			}
+		}
+		return false
+	}
+	for _, f := range files {
+		h.finishIngest(dir, f.Name, config.DoneDir, "done", book.ID, "")
+	}
+	log.Printf("[INFO] ingested %s from %s as book %d", stem, dir, book.ID)
+	return true
+}
+
+// namedFile is the content of a file given with its name.
+type namedFile struct {
+	Name string
+	Data []byte
+}
+
+// addBookFromFiles adds a book having files in different formats, reading
+// its properties from the files or, for the title, from the name shared by
+// the files. The results are those of addFile for each file. The book is
+// deleted and nil is returned when no file is added.
+func (h *Handler) addBookFromFiles(name string, files []namedFile) (*model.Book, []map[string]interface{}, error) {
+	book := model.Book{Files: []model.File{}}
+	if err := model.AddBook(h.db, &book); err != nil {
+		return nil, nil, err
+	}
+
+	results := []map[string]interface{}{}
+	added := 0
+	for _, f := range files {
+		result := h.addFile(book.ID, f.Name, f.Data)
+		results = append(results, result)
+		if result["status"] != "ok" {
+			continue
+		}
+		added++
+
+		// fill the book properties now to fall back on the name below
+		file := result["content"].(model.File)
+		if err := h.extractMetadata(&book, file.MimeType, f.Data); err != nil {
+			log.Printf("[WARN] cannot extract metadata of %s: %v", f.Name, err)
+		}
+	}
+
+	if added == 0 {
+		if err := model.DeleteBook(h.db, &book); err != nil {
+			log.Printf("[WARN] cannot delete empty book %d: %v", book.ID, err)
+		}
+		return nil, results, nil
+	}
+
+	if strings.TrimSpace(book.Title) == "" {
+		book.Title = name
+		if err := model.UpdateBook(h.db, &book); err != nil {
+			log.Printf("[WARN] cannot update title of book %d: %v", book.ID, err)
+		}
+	}
+	return &book, results, nil
+}
+
+// finishIngest moves a processed file to a destination folder and records
+// the result in the log of the watched folder.
+func (h *Handler) finishIngest(dir, name, dest, status string, bookID uint64, message string) {
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(dir, dest)
+	}
+
+	moved, err := moveFile(filepath.Join(dir, name), dest)
+	if err != nil {
+		log.Printf("[ERROR] cannot move %s to %s: %v", name, dest, err)
+		moved = filepath.Join(dir, name)
+	}
+
+	line := fmt.Sprintf("%s\t%s\t%s\t%s", time.Now().Format(time.RFC3339), status, name, moved)
+	if bookID != 0 {
+		line += fmt.Sprintf("\tbook=%d", bookID)
+	}
+	if message != "" {
+		line += "\t" + strings.ReplaceAll(message, "\n", " ")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, ingestLogName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[WARN] cannot open ingest log of %s: %v", dir, err)
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		log.Printf("[WARN] cannot write ingest log of %s: %v", dir, err)
+	}
+}
+
+// ingestStem returns a file name without the extension of its format, so
+// that Foo.kepub.epub and Foo.pdf share the stem Foo.
+func ingestStem(name string) string {
+	if f, err := format.Default.ByFilename(name); err == nil {
+		lower := strings.ToLower(name)
+		for _, ext := range f.Extensions {
+			if strings.HasSuffix(lower, ext) {
+				return name[:len(name)-len(ext)]
+			}
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// isPartialFile reports whether a file is hidden or still being downloaded.
+func isPartialFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".part", ".crdownload", ".download", ".tmp":
+		return true
+	}
+	return false
+}
+
+// moveFile moves a file into a folder without overwriting files of the
+// same name and returns the new path. Files are copied when they cannot be
+// renamed across file systems.
+func moveFile(src, destDir string) (string, error) {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(src)
+	dest := filepath.Join(destDir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		ext := filepath.Ext(name)
+		dest = filepath.Join(destDir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+
+	if err := os.Rename(src, dest); err == nil {
+		return dest, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, os.Remove(src)
+}
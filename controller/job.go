@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Types of jobs run by the handler.
+const (
+	jobExtractMetadata = "extract-metadata"
+	jobMetadataRefresh = "metadata-refresh"
+	jobConvert         = "convert"
+	jobSendToDevice    = "send-to-device"
+)
+
+// extractMetadataJob is the payload of a job filling book properties from
+// an uploaded file.
+type extractMetadataJob struct {
+	BookID uint64
+	FileID uint64
+}
+
+func (h *Handler) registerJobs() {
+	types := []job.Type{
+		{Name: jobExtractMetadata, Run: h.runExtractMetadata},
+		{Name: jobMetadataRefresh, Run: h.runMetadataRefresh, Workers: 1, MaxAttempts: 1},
+		{Name: jobConvert, Run: h.runConvert, MaxAttempts: 2},
+		{Name: jobSendToDevice, Run: h.runSendToDevice, Canceled: h.cancelSendToDevice},
+	}
+	for _, t := range types {
+		if err := h.jobs.Register(t); err != nil {
+			log.Printf("[ERROR] cannot register %s job: %v", t.Name, err)
+		}
+	}
+}
+
+// GetJobs returns recent jobs filtered by type and status
+func (h *Handler) GetJobs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+
+	countString := q.Get("count")
+	count, err := strconv.ParseUint(countString, 10, 64)
+	if err != nil && countString != "" {
+		h.handleError(w, errors.New("invalid count value"), http.StatusBadRequest)
+		return
+	}
+
+	jobs, err := model.GetJobs(h.db, q.Get("type"), q.Get("status"), count)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, jobs)
+}
+
+// GetJob returns the status and progress of a job
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jobID, err := strconv.ParseUint(ps.ByName("jobid"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid jobid"), http.StatusBadRequest)
+		return
+	}
+
+	j, err := model.GetJob(h.db, jobID)
+	switch {
+	case err == model.ErrJobNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, j)
+}
+
+// CancelJob cancels a queued or running job
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jobID, err := strconv.ParseUint(ps.ByName("jobid"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid jobid"), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := model.GetJob(h.db, jobID); err != nil {
+		switch {
+		case err == model.ErrJobNotFound:
+			h.handleError(w, err, http.StatusNotFound)
+		default:
+			h.handleError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = h.jobs.Cancel(jobID)
+	switch {
+	case err == job.ErrNotCancelable:
+		h.handleError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, "successfully canceled")
+}
+
+func (h *Handler) runExtractMetadata(ctx context.Context, j *job.Job) error {
+	payload := extractMetadataJob{}
+	if err := j.Decode(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	book, err := model.GetBookByID(h.db, payload.BookID)
+	if err != nil {
+		if err == model.ErrBookNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+	file, err := model.GetFileByID(h.db, payload.FileID)
+	if err != nil {
+		if err == model.ErrFileNotFound {
+			return job.Permanent(err)
+		}
+		return err
+	}
+
+	buf := bytes.Buffer{}
+	if err := h.storage.Download(&buf, file.Path); err != nil {
+		return err
+	}
+
+	return h.extractMetadata(book, file.MimeType, buf.Bytes())
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Error codes of the KOReader sync server protocol.
+const (
+	kosyncCodeUnauthorized   = 2001
+	kosyncCodeUserExists     = 2002
+	kosyncCodeInvalidRequest = 2003
+	kosyncCodeInvalidField   = 2004
+)
+
+type kosyncUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type kosyncProgress struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp,omitempty"`
+}
+
+// KOSyncCreateUser registers a new user for KOReader progress sync.
+func (h *Handler) KOSyncCreateUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := kosyncUser{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" || req.Password == "" {
+		h.handleKOSyncError(w, kosyncCodeInvalidRequest, "Invalid request", http.StatusForbidden)
+		return
+	}
+
+	user := model.User{Username: req.Username}
+	if err := user.SetKey(req.Password); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err := model.AddUser(h.db, &user)
+	switch {
+	case err == model.ErrUserConflict:
+		h.handleKOSyncError(w, kosyncCodeUserExists, "Username is already registered.", http.StatusPaymentRequired)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleKOSyncSuccess(w, map[string]interface{}{"username": user.Username}, http.StatusCreated)
+}
+
+// KOSyncAuthUser checks the credentials sent in x-auth-user and x-auth-key.
+func (h *Handler) KOSyncAuthUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.handleKOSyncSuccess(w, map[string]interface{}{"authorized": "OK"}, http.StatusOK)
+}
+
+// KOSyncUpdateProgress stores a reading position sent by a device.
+func (h *Handler) KOSyncUpdateProgress(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := kosyncProgress{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.handleKOSyncError(w, kosyncCodeInvalidRequest, "Invalid request", http.StatusForbidden)
+		return
+	}
+	if req.Document == "" {
+		h.handleKOSyncError(w, kosyncCodeInvalidField, "Field 'document' not provided.", http.StatusForbidden)
+		return
+	}
+
+	progress := model.Progress{
+		UserID:     userIDFromContext(r),
+		Document:   req.Document,
+		Progress:   req.Progress,
+		Percentage: req.Percentage,
+		Device:     req.Device,
+		DeviceID:   req.DeviceID,
+		Timestamp:  time.Now().Unix(),
+	}
+	if err := model.UpdateProgress(h.db, &progress); err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"document":  progress.Document,
+		"timestamp": progress.Timestamp,
+	}
+	h.handleKOSyncSuccess(w, data, http.StatusOK)
+}
+
+// KOSyncGetProgress returns the latest reading position of a document.
+func (h *Handler) KOSyncGetProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	progress, err := model.GetProgress(h.db, userIDFromContext(r), ps.ByName("document"))
+	switch {
+	case err == model.ErrProgressNotFound:
+		h.handleKOSyncSuccess(w, map[string]interface{}{}, http.StatusOK)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	data := kosyncProgress{
+		Document:   progress.Document,
+		Progress:   progress.Progress,
+		Percentage: progress.Percentage,
+		Device:     progress.Device,
+		DeviceID:   progress.DeviceID,
+		Timestamp:  progress.Timestamp,
+	}
+	h.handleKOSyncSuccess(w, data, http.StatusOK)
+}
+
+func (h *Handler) KOSyncHealthcheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.handleKOSyncSuccess(w, map[string]interface{}{"state": "OK"}, http.StatusOK)
+}
+
+// KOSyncAuthenticate wraps a handler with the KOReader header authentication.
+func (h *Handler) KOSyncAuthenticate(f httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, err := h.authenticate(r)
+		switch {
+		case err == model.ErrUnauthorized:
+			h.handleKOSyncError(w, kosyncCodeUnauthorized, "Unauthorized", http.StatusUnauthorized)
+			return
+		case err != nil:
+			h.handleError(w, err, http.StatusInternalServerError)
+			return
+		}
+		f(w, r.WithContext(withUserID(r.Context(), user.ID)), ps)
+	}
+}
+
+func (h *Handler) handleKOSyncSuccess(w http.ResponseWriter, data interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("[WARN] write response json failed. %s", err)
+	}
+}
+
+func (h *Handler) handleKOSyncError(w http.ResponseWriter, code int, message string, status int) {
+	log.Printf("[WARN] kosync err: %s", message)
+	data := map[string]interface{}{
+		"code":    code,
+		"message": message,
+	}
+	h.handleKOSyncSuccess(w, data, status)
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/altescy/bookshelf/lookup"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// LookupISBN returns metadata of a book fetched from lookup providers
+func (h *Handler) LookupISBN(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	isbn, err := model.NormalizeISBN(ps.ByName("isbn"))
+	if err != nil {
+		h.handleError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	md, err := lookup.LookupISBN(r.Context(), h.lookupProviders, isbn)
+	switch {
+	case err == lookup.ErrNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("[ERROR] cannot look up isbn %s: %v", isbn, err)
+		h.handleError(w, err, http.StatusBadGateway)
+		return
+	}
+
+	h.handleSuccess(w, md)
+}
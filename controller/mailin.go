@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/altescy/bookshelf/mailin"
+)
+
+// ReceiveMail adds books from the files attached to a message. Attachments
+// sharing a name in different formats become one book, and attachments
+// which are not books, such as images in signatures, are skipped. The
+// sender is answered with the results when a mailer is configured.
+//
+// A group failing to be added, such as by a database error, is reported in
+// the answer. The message is refused with the error only if no book has been
+// added, so that the sending server does not add books twice by retrying.
+func (h *Handler) ReceiveMail(msg *mailin.Message) error {
+	groups := map[string][]namedFile{}
+	skipped := []string{}
+	for _, a := range msg.Attachments {
+		if _, err := format.Default.ByFilename(a.Filename); err != nil {
+			skipped = append(skipped, a.Filename)
+			continue
+		}
+		stem := ingestStem(a.Filename)
+		groups[stem] = append(groups[stem], namedFile{Name: a.Filename, Data: a.Data})
+	}
+
+	stems := []string{}
+	for stem := range groups {
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+
+	lines := []string{}
+	added := 0
+	var lastErr error
+	for _, stem := range stems {
+		files := groups[stem]
+		book, results, err := h.addBookFromFiles(stem, files)
+		if err != nil {
+			log.Printf("[ERROR] cannot add book for %s from mail of %s: %v", stem, msg.Sender, err)
+			for _, f := range files {
+				lines = append(lines, fmt.Sprintf("%s: failed: %v", f.Name, err))
+			}
+			lastErr = err
+			continue
+		}
+		for i, result := range results {
+			if result["status"] != "ok" {
+				lines = append(lines, fmt.Sprintf("%s: failed: %v", files[i].Name, result["content"]))
+				continue
+			}
+			line := fmt.Sprintf("%s: added to book %d %q", files[i].Name, book.ID, book.Title)
+			if warning, ok := result["warning"]; ok {
+				line += fmt.Sprintf(" (%v)", warning)
+			}
+			lines = append(lines, line)
+		}
+		if book != nil {
+			added++
+			log.Printf("[INFO] added book %d from mail of %s", book.ID, msg.Sender)
+		}
+	}
+	if added == 0 && lastErr != nil {
+		return lastErr
+	}
+	for _, name := range skipped {
+		lines = append(lines, fmt.Sprintf("%s: skipped: unsupported format", name))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No books were attached to the message.")
+	}
+
+	h.replyMail(msg, strings.Join(lines, "\n"))
+	return nil
+}
+
+// replyMail sends the results of a received message to the sender unless
+// the message was sent automatically, which may cause a mail loop.
+func (h *Handler) replyMail(msg *mailin.Message, body string) {
+	if h.mailer == nil || msg.AutoSubmitted || msg.From == nil {
+		return
+	}
+
+	subject := "Re: " + msg.Subject
+	if strings.HasPrefix(strings.ToLower(msg.Subject), "re:") {
+		subject = msg.Subject
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := h.mailer.Send(ctx, msg.From.Address, subject, body+"\n"); err != nil {
+			log.Printf("[WARN] cannot reply to %s: %v", msg.From.Address, err)
+		}
+	}()
+}
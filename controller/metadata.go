@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/altescy/bookshelf/job"
+	"github.com/altescy/bookshelf/lookup"
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+const maxCoverSize = 10 << 20
+
+var coverClient = &http.Client{Timeout: 30 * time.Second}
+
+// metadataRefreshJob is the payload of a metadata refresh job.
+type metadataRefreshJob struct {
+	Books []uint64
+	Query string
+}
+
+// RefreshMetadata enqueues a job fetching metadata of books having an
+// ISBN. Books are selected by comma separated Books or by a Query matching
+// titles and authors, and changes are recorded as proposals to review.
+func (h *Handler) RefreshMetadata(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if len(h.lookupProviders) == 0 {
+		h.handleError(w, errors.New("no lookup providers"), http.StatusServiceUnavailable)
+		return
+	}
+
+	bookIDs, err := parseIDs(r.FormValue("Books"))
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	payload := metadataRefreshJob{Books: bookIDs, Query: r.FormValue("Query")}
+	job, err := h.jobs.Enqueue(jobMetadataRefresh, payload)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, job)
+}
+
+// GetMetadataProposals returns proposals filtered by job, book and status
+func (h *Handler) GetMetadataProposals(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+
+	parseID := func(key string) (uint64, error) {
+		if s := q.Get(key); s != "" {
+			return strconv.ParseUint(s, 10, 64)
+		}
+		return 0, nil
+	}
+	jobID, err := parseID("job")
+	if err != nil {
+		h.handleError(w, errors.New("invalid job value"), http.StatusBadRequest)
+		return
+	}
+	bookID, err := parseID("book")
+	if err != nil {
+		h.handleError(w, errors.New("invalid book value"), http.StatusBadRequest)
+		return
+	}
+
+	proposals, err := model.GetMetadataProposals(h.db, jobID, bookID, q.Get("status"))
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, proposals)
+}
+
+// ApproveMetadataProposal applies a proposed change to the book
+func (h *Handler) ApproveMetadataProposal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	proposal, ok := h.getMetadataProposal(w, ps)
+	if !ok {
+		return
+	}
+	if proposal.Status != model.ProposalPending {
+		h.handleError(w, model.ErrProposalNotPending, http.StatusConflict)
+		return
+	}
+
+	if proposal.Field == "Cover" {
+		if err := h.applyCoverProposal(r.Context(), proposal); err != nil {
+			log.Printf("[ERROR] cannot apply cover of proposal %d: %v", proposal.ID, err)
+			h.handleError(w, err, http.StatusBadGateway)
+			return
+		}
+	}
+
+	err := model.ApproveMetadataProposal(h.db, proposal)
+	switch {
+	case err == model.ErrBookNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return
+	case err == model.ErrProposalNotPending:
+		h.handleError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, proposal)
+}
+
+// RejectMetadataProposal discards a proposed change
+func (h *Handler) RejectMetadataProposal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	proposal, ok := h.getMetadataProposal(w, ps)
+	if !ok {
+		return
+	}
+
+	err := model.RejectMetadataProposal(h.db, proposal)
+	switch {
+	case err == model.ErrProposalNotPending:
+		h.handleError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, proposal)
+}
+
+func (h *Handler) getMetadataProposal(w http.ResponseWriter, ps httprouter.Params) (*model.MetadataProposal, bool) {
+	proposalID, err := strconv.ParseUint(ps.ByName("proposalid"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid proposalid"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	proposal, err := model.GetMetadataProposal(h.db, proposalID)
+	switch {
+	case err == model.ErrProposalNotFound:
+		h.handleError(w, err, http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		h.handleError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return proposal, true
+}
+
+func (h *Handler) runMetadataRefresh(ctx context.Context, j *job.Job) error {
+	payload := metadataRefreshJob{}
+	if err := j.Decode(&payload); err != nil {
+		return job.Permanent(err)
+	}
+
+	books, err := model.GetBooksWithISBN(h.db, payload.Books, payload.Query)
+	if err != nil {
+		return err
+	}
+
+	for i, book := range *books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := h.proposeMetadata(ctx, j.ID, &book); err != nil {
+			log.Printf("[WARN] cannot refresh metadata of book %d: %v", book.ID, err)
+		}
+		j.SetProgress(i+1, len(*books))
+	}
+	return nil
+}
+
+// proposeMetadata looks up a book and records proposals for properties
+// differing from the fetched metadata.
+func (h *Handler) proposeMetadata(ctx context.Context, jobID uint64, book *model.Book) error {
+	isbn, err := model.NormalizeISBN(book.ISBN)
+	if err != nil {
+		return err
+	}
+
+	md, err := lookup.LookupISBN(ctx, h.lookupProviders, isbn)
+	switch {
+	case err == lookup.ErrNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	values := []struct {
+		field, old, new string
+	}{
+		{"Title", book.Title, md.Title},
+		{"Author", book.Author, strings.Join(md.Authors, ", ")},
+		{"Publisher", book.Publisher, md.Publisher},
+		{"PubDate", book.PubDate, md.PubDate},
+		{"Description", book.Description, md.Description},
+	}
+	if book.CoverURL == "" {
+		values = append(values, struct{ field, old, new string }{"Cover", "", md.CoverURL})
+	}
+
+	for _, v := range values {
+		if v.new == "" || strings.TrimSpace(v.new) == strings.TrimSpace(v.old) {
+			continue
+		}
+		proposal := model.MetadataProposal{
+			JobID:    jobID,
+			BookID:   book.ID,
+			Field:    v.field,
+			OldValue: v.old,
+			NewValue: v.new,
+			Provider: md.Provider,
+		}
+		if err := model.AddMetadataProposal(h.db, &proposal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyCoverProposal downloads a proposed cover image and sets it to the
+// book.
+func (h *Handler) applyCoverProposal(ctx context.Context, proposal *model.MetadataProposal) error {
+	book, err := model.GetBookByID(h.db, proposal.BookID)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, proposal.NewValue, nil)
+	if err != nil {
+		return err
+	}
+	res, err := coverClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download cover: %s", res.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCoverSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxCoverSize {
+		return errors.New("cover is too large")
+	}
+	coverType := http.DetectContentType(b)
+	if !strings.HasPrefix(coverType, "image/") {
+		return fmt.Errorf("cover is not an image: %s", coverType)
+	}
+
+	return h.saveCover(book, b, coverType)
+}
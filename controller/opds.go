@@ -28,6 +28,9 @@ func (h *Handler) GetOPDSFeed(w http.ResponseWriter, r *http.Request, ps httprou
 		for j, file := range book.Files {
 			alias, _ := model.GetMimeAlias(file.MimeType)
 			(*books)[i].Files[j].Link = fmt.Sprintf("/api/book/%d/file/%s", book.ID, alias)
+			if model.IsComicMime(file.MimeType) {
+				(*books)[i].Files[j].StreamLink = fmt.Sprintf("/api/book/%d/comic/%s/pages/{pageNumber}?width={maxWidth}", book.ID, alias)
+			}
 		}
 	}
 
@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/altescy/bookshelf/model"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GetBookProgress returns reading positions synced from devices for a book
+func (h *Handler) GetBookProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bookidString := ps.ByName("bookid")
+	bookID, err := strconv.ParseUint(bookidString, 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("invalid bookid"), http.StatusBadRequest)
+		return
+	}
+
+	progresses, err := model.GetBookProgresses(h.db, bookID)
+	if err != nil {
+		h.handleError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.handleSuccess(w, progresses)
+}
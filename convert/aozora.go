@@ -0,0 +1,571 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+var (
+	aozoraSeparator = regexp.MustCompile(`^-{20,}\s*$`)
+	aozoraQuoted    = regexp.MustCompile(`^「(.+?)」(?:に|は|の)(.+)$`)
+	aozoraRuby      = regexp.MustCompile(`^「(.+)」のルビ$`)
+	aozoraIndent    = regexp.MustCompile(`^(ここから)?([0-9]+)字下げ`)
+	aozoraRaise     = regexp.MustCompile(`^(ここから)?地から([0-9]+)字上げ$`)
+	aozoraCodePoint = regexp.MustCompile(`U\+([0-9A-Fa-f]{4,6})`)
+)
+
+// Elements of ranges marked by annotations, such as 傍点.
+var aozoraRanges = []struct {
+	suffix string
+	open   string
+	close  string
+}{
+	{"傍点", `<em class="sesame">`, `</em>`},
+	{"傍線", `<span class="underline">`, `</span>`},
+	{"縦中横", `<span class="tcy">`, `</span>`},
+	{"太字", `<strong>`, `</strong>`},
+	{"斜体", `<i>`, `</i>`},
+}
+
+// IsAozora reports whether text is in the annotated format of Aozora Bunko.
+func IsAozora(src []byte) bool {
+	return bytes.Contains(src, []byte("［＃")) ||
+		bytes.Contains(src, []byte("【テキスト中に現れる記号について】")) ||
+		bytes.Count(src, []byte("《")) >= 3 && bytes.Count(src, []byte("》")) >= 3
+}
+
+// AozoraToEPUB converts text in the annotated format of Aozora Bunko to a
+// vertically written EPUB. Ruby, headings, emphasis, indentation and page
+// breaks are kept. The title and the author are read from the header and
+// the colophon starting with 底本 becomes the last chapter.
+func AozoraToEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	header, lines, footer := splitAozora(strings.Split(cleanText(src), "\n"))
+
+	fallback := Metadata{Language: "ja"}
+	for i, line := range header {
+		text := parseAozoraLine(line, nil).text()
+		switch {
+		case i == 0:
+			fallback.Title = text
+		case i == len(header)-1:
+			fallback.Authors = []string{text}
+		}
+	}
+	w := newWriter(md, fallback)
+	w.Direction = "rtl"
+	w.Stylesheet = aozoraStylesheet
+
+	body := strings.Builder{}
+	title := ""
+	flush := func() {
+		if strings.TrimSpace(body.String()) != "" {
+			if title == "" {
+				title = w.Title
+			}
+			w.AddChapter(title, body.String())
+		}
+		body.Reset()
+	}
+
+	// title page
+	if len(header) > 0 {
+		body.WriteString(`<div class="titlepage">` + "\n")
+		for i, line := range header {
+			l := parseAozoraLine(line, nil)
+			switch {
+			case i == 0:
+				body.WriteString("<h1>" + l.html() + "</h1>\n")
+			case i == len(header)-1:
+				body.WriteString(`<p class="author">` + l.html() + "</p>\n")
+			default:
+				body.WriteString(`<p class="subtitle">` + l.html() + "</p>\n")
+			}
+		}
+		body.WriteString("</div>\n")
+		flush()
+	}
+
+	// ranges such as ［＃ここから太字］ which are open across lines
+	open := []string{}
+	indent, raise, end := 0, 0, false
+	for _, line := range lines {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		l := parseAozoraLine(line, open)
+		open = l.closeRanges()
+		if l.pageBreak {
+			flush()
+			title = ""
+		}
+		if l.blockIndent >= 0 {
+			indent = l.blockIndent
+		}
+		if l.blockEnd != nil {
+			end, raise = *l.blockEnd, l.blockRaise
+		}
+		if len(l.units) == 0 && l.annotated {
+			continue
+		}
+		if l.heading == 1 || l.heading == 2 {
+			flush()
+			title = l.text()
+		}
+
+		style := []string{}
+		if n := indent + l.indent; n > 0 {
+			style = append(style, fmt.Sprintf("margin-top: %dem;", n))
+		}
+		class := ""
+		if end || l.end {
+			class = ` class="chitsuki"`
+			if n := raise + l.raise; n > 0 {
+				style = append(style, fmt.Sprintf("margin-bottom: %dem;", n))
+			}
+		}
+		attrs := class
+		if len(style) > 0 {
+			attrs += ` style="` + strings.Join(style, " ") + `"`
+		}
+
+		content := l.html()
+		switch {
+		case l.heading > 0:
+			tag := "h" + strconv.Itoa(l.heading)
+			body.WriteString("<" + tag + attrs + ">" + content + "</" + tag + ">\n")
+		case content == "":
+			body.WriteString("<p><br/></p>\n")
+		default:
+			body.WriteString("<p" + attrs + ">" + content + "</p>\n")
+		}
+		if body.Len() >= chapterSize {
+			flush()
+		}
+	}
+	flush()
+
+	if len(footer) > 0 {
+		body.WriteString(`<div class="colophon">` + "\n")
+		for _, line := range footer {
+			if content := parseAozoraLine(line, nil).html(); content != "" {
+				body.WriteString("<p>" + content + "</p>\n")
+			}
+		}
+		body.WriteString("</div>\n")
+		title = "底本"
+		flush()
+	}
+
+	return writeEPUB(w)
+}
+
+// splitAozora splits lines into the header of the title and the author,
+// the body and the colophon. The explanation of notation between lines of
+// hyphens is dropped.
+func splitAozora(lines []string) (header, body, footer []string) {
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+		i++
+	}
+	header = lines[:i]
+	if len(header) > 5 {
+		// not a header of Aozora Bunko
+		header, i = nil, 0
+	}
+
+	j := i
+	for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+		j++
+	}
+	if j < len(lines) && aozoraSeparator.MatchString(lines[j]) {
+		for k := j + 1; k < len(lines); k++ {
+			if aozoraSeparator.MatchString(lines[k]) {
+				i = k + 1
+				break
+			}
+		}
+	}
+
+	end := len(lines)
+	for k := len(lines) - 1; k >= i; k-- {
+		if strings.HasPrefix(lines[k], "底本：") {
+			end = k
+			break
+		}
+	}
+	body = lines[i:end]
+	for len(body) > 0 && strings.TrimSpace(body[0]) == "" {
+		body = body[1:]
+	}
+	for len(body) > 0 && strings.TrimSpace(body[len(body)-1]) == "" {
+		body = body[:len(body)-1]
+	}
+	return header, body, lines[end:]
+}
+
+// aozoraUnit is a piece of a line. Annotations refer to preceding text by
+// the plain text of units.
+type aozoraUnit struct {
+	text string
+	html string
+	// mark is the name of a range started by an annotation
+	mark string
+}
+
+type aozoraLine struct {
+	units     []aozoraUnit
+	annotated bool
+	heading   int
+	indent    int
+	end       bool
+	raise     int
+	pageBreak bool
+
+	// blockIndent is the indentation of following lines, or -1 if not
+	// changed by the line.
+	blockIndent int
+	// blockEnd is whether following lines are aligned to the end, or
+	// nil if not changed by the line.
+	blockEnd   *bool
+	blockRaise int
+}
+
+// parseAozoraLine parses a line in which ranges left open by preceding
+// lines continue.
+func parseAozoraLine(line string, open []string) *aozoraLine {
+	l := &aozoraLine{blockIndent: -1}
+	for _, name := range open {
+		l.units = append(l.units, aozoraUnit{mark: name})
+	}
+	runes := []rune(line)
+	explicit := -1
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '｜':
+			explicit = len(l.units)
+		case r == '《':
+			end := indexRune(runes, i+1, '》')
+			if end < 0 {
+				l.add(string(r))
+				continue
+			}
+			start := explicit
+			if start < 0 {
+				start = rubyBaseStart(l.units)
+			}
+			if start >= len(l.units) {
+				l.add(string(runes[i : end+1]))
+			} else {
+				l.ruby(start, string(runes[i+1:end]))
+			}
+			explicit = -1
+			i = end
+		case r == '［' && i+1 < len(runes) && runes[i+1] == '＃':
+			end := closingBracket(runes, i)
+			if end < 0 {
+				l.add(string(runes[i:]))
+				i = len(runes)
+				continue
+			}
+			l.annotate(string(runes[i+2 : end]))
+			i = end
+		default:
+			l.add(string(r))
+		}
+	}
+	return l
+}
+
+func (l *aozoraLine) add(s string) {
+	l.units = append(l.units, aozoraUnit{text: s, html: epub.EscapeText(s)})
+}
+
+func (l *aozoraLine) text() string {
+	b := strings.Builder{}
+	for _, u := range l.units {
+		b.WriteString(u.text)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// html returns the markup of a line, keeping leading ideographic spaces
+// which indent paragraphs.
+func (l *aozoraLine) html() string {
+	b := strings.Builder{}
+	for _, u := range l.units {
+		b.WriteString(u.html)
+	}
+	return strings.TrimRight(b.String(), " \t")
+}
+
+// closeRanges encloses the rest of the line in the elements of ranges which
+// are not closed in the line, and returns their names to open them again in
+// the next line.
+func (l *aozoraLine) closeRanges() []string {
+	open := []string{}
+	for i := len(l.units) - 1; i >= 0; i-- {
+		name := l.units[i].mark
+		if name == "" {
+			continue
+		}
+		open = append([]string{name}, open...)
+		l.units = append(l.units[:i], l.units[i+1:]...)
+		if i < len(l.units) {
+			l.wrapRange(i, name)
+		}
+	}
+	return open
+}
+
+// wrapRange encloses units from start in the element of a range.
+func (l *aozoraLine) wrapRange(start int, name string) {
+	for _, r := range aozoraRanges {
+		if strings.HasSuffix(name, r.suffix) {
+			l.wrap(start, len(l.units), r.open, r.close)
+			return
+		}
+	}
+}
+
+// ruby merges units from start into a ruby element.
+func (l *aozoraLine) ruby(start int, ruby string) {
+	l.wrap(start, len(l.units), "<ruby>", "<rt>"+epub.EscapeText(ruby)+"</rt></ruby>")
+}
+
+// wrap merges units from start to end into a unit enclosed by markup.
+// Marks of ranges inside are dropped.
+func (l *aozoraLine) wrap(start, end int, open, close string) {
+	u := aozoraUnit{html: open}
+	for _, v := range l.units[start:end] {
+		u.text += v.text
+		u.html += v.html
+	}
+	u.html += close
+	l.units = append(l.units[:start], append([]aozoraUnit{u}, l.units[end:]...)...)
+}
+
+// find returns the range of the last units whose text is s.
+func (l *aozoraLine) find(s string) (int, int, bool) {
+	for start := len(l.units) - 1; start >= 0; start-- {
+		text := ""
+		for end := start; end < len(l.units); end++ {
+			text += l.units[end].text
+			if text == s {
+				return start, end + 1, true
+			}
+			if len(text) >= len(s) {
+				break
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (l *aozoraLine) annotate(note string) {
+	l.annotated = true
+	note = toHalfwidthDigits(note)
+
+	// characters not in JIS X 0208 written as ※ followed by a description
+	if n := len(l.units); n > 0 && l.units[n-1].text == "※" && strings.HasPrefix(note, "「") {
+		if m := aozoraCodePoint.FindStringSubmatch(note); m != nil {
+			if code, err := strconv.ParseUint(m[1], 16, 32); err == nil {
+				l.units[n-1] = aozoraUnit{text: string(rune(code)), html: epub.EscapeText(string(rune(code)))}
+				return
+			}
+		}
+		l.units[n-1].html = `<span class="gaiji">〓</span>`
+		return
+	}
+
+	if m := aozoraQuoted.FindStringSubmatch(note); m != nil {
+		target, kind := m[1], m[2]
+		if level := headingLevel(kind); level > 0 {
+			l.heading = level
+			return
+		}
+		start, end, ok := l.find(target)
+		if !ok {
+			return
+		}
+		if r := aozoraRuby.FindStringSubmatch(kind); r != nil {
+			l.wrap(start, end, "<ruby>", "<rt>"+epub.EscapeText(r[1])+"</rt></ruby>")
+			return
+		}
+		for _, r := range aozoraRanges {
+			if strings.HasSuffix(kind, r.suffix) {
+				l.wrap(start, end, r.open, r.close)
+				return
+			}
+		}
+		return
+	}
+
+	switch {
+	case note == "改ページ" || note == "改丁" || note == "改見開き" || note == "改段":
+		l.pageBreak = true
+	case note == "地付き":
+		l.end = true
+	case note == "ここから地付き":
+		end := true
+		l.blockEnd = &end
+	case strings.HasPrefix(note, "ここで地付き終わり") || strings.HasPrefix(note, "ここで字上げ終わり"):
+		end := false
+		l.blockEnd = &end
+	case strings.HasPrefix(note, "ここで字下げ終わり"):
+		l.blockIndent = 0
+	case aozoraIndent.MatchString(note):
+		m := aozoraIndent.FindStringSubmatch(note)
+		n, _ := strconv.Atoi(m[2])
+		if m[1] != "" {
+			l.blockIndent = n
+		} else {
+			l.indent = n
+		}
+	case aozoraRaise.MatchString(note):
+		m := aozoraRaise.FindStringSubmatch(note)
+		n, _ := strconv.Atoi(m[2])
+		if m[1] != "" {
+			end := true
+			l.blockEnd, l.blockRaise = &end, n
+		} else {
+			l.end, l.raise = true, n
+		}
+	case headingLevel(note) > 0 && !strings.HasSuffix(note, "終わり"):
+		l.heading = headingLevel(note)
+	case strings.HasSuffix(note, "終わり"):
+		// ［＃ここで太字終わり］ closes ［＃ここから太字］
+		name := strings.TrimPrefix(strings.TrimSuffix(note, "終わり"), "ここで")
+		for i := len(l.units) - 1; i >= 0; i-- {
+			if l.units[i].mark == name {
+				l.units = append(l.units[:i], l.units[i+1:]...)
+				if i < len(l.units) {
+					l.wrapRange(i, name)
+				}
+				return
+			}
+		}
+	default:
+		for _, r := range aozoraRanges {
+			if strings.HasSuffix(note, r.suffix) {
+				l.units = append(l.units, aozoraUnit{mark: strings.TrimPrefix(note, "ここから")})
+				return
+			}
+		}
+	}
+}
+
+func headingLevel(note string) int {
+	switch {
+	case strings.Contains(note, "大見出し"):
+		return 1
+	case strings.Contains(note, "中見出し"):
+		return 2
+	case strings.Contains(note, "小見出し"):
+		return 3
+	}
+	return 0
+}
+
+// rubyBaseStart returns the start of the run of characters of the same
+// kind preceding ruby without an explicit start.
+func rubyBaseStart(units []aozoraUnit) int {
+	if len(units) == 0 {
+		return 0
+	}
+	kind := charKind(units[len(units)-1].text)
+	if kind == 0 {
+		return len(units)
+	}
+	i := len(units) - 1
+	for i > 0 && charKind(units[i-1].text) == kind {
+		i--
+	}
+	return i
+}
+
+// charKind classifies a character into kanji, hiragana, katakana and
+// alphanumerics. Zero is returned for others and merged units.
+func charKind(s string) int {
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0
+	}
+	r := runes[0]
+	switch {
+	case unicode.Is(unicode.Han, r) || strings.ContainsRune("々〆〇ヶヵ", r):
+		return 1
+	case unicode.Is(unicode.Hiragana, r):
+		return 2
+	case unicode.Is(unicode.Katakana, r) || r == 'ー':
+		return 3
+	case r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)),
+		r >= 0xff10 && r <= 0xff5a && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		return 4
+	}
+	return 0
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// closingBracket returns the index of the bracket closing an annotation,
+// which may contain brackets.
+func closingBracket(runes []rune, start int) int {
+	depth := 0
+	for i := start; i < len(runes); i++ {
+		switch runes[i] {
+		case '［':
+			depth++
+		case '］':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func toHalfwidthDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '０' && r <= '９' {
+			return r - '０' + '0'
+		}
+		return r
+	}, s)
+}
+
+const aozoraStylesheet = `html { writing-mode: vertical-rl; -webkit-writing-mode: vertical-rl; -epub-writing-mode: vertical-rl; }
+body { margin: 0; line-height: 1.75; font-family: serif; }
+p { margin: 0; }
+h1, h2, h3 { margin: 0 0 0 2em; line-height: 1.5; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.3em; }
+h3 { font-size: 1.1em; }
+rt { font-size: 0.5em; }
+.sesame { font-style: normal; text-emphasis-style: sesame; -webkit-text-emphasis-style: sesame; -epub-text-emphasis-style: sesame; }
+.underline { text-decoration: underline; }
+.tcy { text-combine-upright: all; -webkit-text-combine: horizontal; -epub-text-combine: horizontal; }
+.chitsuki { text-align: end; }
+.titlepage { margin-right: 4em; }
+.titlepage .author { margin-top: 4em; }
+.colophon { font-size: 0.8em; }
+.cover { text-align: center; }
+.cover img { height: 100%; }
+`
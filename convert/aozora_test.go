@@ -0,0 +1,119 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+const aozoraSample = `吾輩は猫である
+夏目漱石
+
+-------------------------------------------------------
+【テキスト中に現れる記号について】
+
+《》：ルビ
+（例）吾輩《わがはい》
+-------------------------------------------------------
+
+［＃３字下げ］一［＃「一」は大見出し］
+
+　吾輩《わがはい》は猫である。名前はまだ無い。
+　どこで｜生《うま》れたかとんと［＃「とんと」に傍点］見当がつかぬ。
+［＃ここから太字］
+　何でも薄暗いじめじめした所で
+　ニャーニャー泣いていた事だけは記憶している。
+［＃ここで太字終わり］
+　吾輩はここで［＃傍線］始めて人間［＃傍線終わり］というものを見た。
+［＃改ページ］
+［＃３字下げ］二［＃「二」は大見出し］
+
+　吾輩は新年来多少有名になったので、猫ながらちょっと鼻が高く感ぜらるるのはありがたい。
+
+
+底本：「吾輩は猫である」新潮文庫、新潮社
+`
+
+func convertAozoraSample(t *testing.T) (*epub.Book, string) {
+	b, err := AozoraToEPUB(context.Background(), []byte(aozoraSample), Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := epub.Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Builder{}
+	for _, item := range book.Spine.Items {
+		rc, err := book.Open(item.Href)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.Write(b)
+	}
+	return book, content.String()
+}
+
+func TestAozoraToEPUB(t *testing.T) {
+	book, content := convertAozoraSample(t)
+
+	if book.Metadata.Title != "吾輩は猫である" || len(book.Metadata.Authors) != 1 || book.Metadata.Authors[0] != "夏目漱石" {
+		t.Errorf("metadata: got %q by %v", book.Metadata.Title, book.Metadata.Authors)
+	}
+	if book.Spine.PageProgressionDirection != "rtl" {
+		t.Errorf("page progression direction: got %q", book.Spine.PageProgressionDirection)
+	}
+
+	labels := []string{}
+	for _, p := range book.TOC {
+		labels = append(labels, p.Label)
+	}
+	if strings.Join(labels, ",") != "吾輩は猫である,一,二,底本" {
+		t.Errorf("table of contents: got %v", labels)
+	}
+
+	expected := []string{
+		`<h1 style="margin-top: 3em;">一</h1>`,
+		`<ruby>吾輩<rt>わがはい</rt></ruby>は猫である。`,
+		`どこで<ruby>生<rt>うま</rt></ruby>れたか`,
+		`<em class="sesame">とんと</em>見当がつかぬ。`,
+		`<span class="underline">始めて人間</span>というもの`,
+		`底本：「吾輩は猫である」新潮文庫、新潮社`,
+	}
+	for _, s := range expected {
+		if !strings.Contains(content, s) {
+			t.Errorf("%s not found in:\n%s", s, content)
+		}
+	}
+	if strings.Contains(content, "［＃") || strings.Contains(content, "《") {
+		t.Errorf("annotations are left:\n%s", content)
+	}
+}
+
+func TestAozoraRangeAcrossLines(t *testing.T) {
+	_, content := convertAozoraSample(t)
+
+	expected := []string{
+		`<p><strong>　何でも薄暗いじめじめした所で</strong></p>`,
+		`<p><strong>　ニャーニャー泣いていた事だけは記憶している。</strong></p>`,
+		`<p>　吾輩はここで`,
+	}
+	for _, s := range expected {
+		if !strings.Contains(content, s) {
+			t.Errorf("%s not found in:\n%s", s, content)
+		}
+	}
+	if strings.Contains(content, "<strong></strong>") {
+		t.Errorf("empty range is left:\n%s", content)
+	}
+}
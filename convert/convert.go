@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+var ErrUnsupported = errors.New("unsupported conversion")
+
+// Metadata is written into converted books. Converters prefer metadata
+// found in the source for empty fields.
+type Metadata struct {
+	Identifier string
+	Title      string
+	Authors    []string
+	Language   string
+	Cover      []byte
+	CoverType  string
+}
+
+// Func converts a book from a format to another.
+type Func func(ctx context.Context, src []byte, md Metadata) ([]byte, error)
+
+// builtin converters keyed by source and target format aliases.
+var builtin = map[[2]string]Func{
+	{"txt", "epub"}:   TextToEPUB,
+	{"md", "epub"}:    MarkdownToEPUB,
+	{"html", "epub"}:  HTMLToEPUB,
+	{"fb2", "epub"}:   FB2ToEPUB,
+	{"epub", "kepub"}: EPUBToKEPUB,
+}
+
+// Converter converts books with builtin converters written in Go, falling
+// back to an external ebook-convert command for other formats.
+type Converter struct {
+	// EbookConvert is the path of Calibre's ebook-convert command. Empty
+	// disables external conversion.
+	EbookConvert string
+}
+
+// CanConvert reports whether books can be converted between formats.
+func (c *Converter) CanConvert(from, to string) bool {
+	if _, ok := builtin[[2]string{from, to}]; ok {
+		return true
+	}
+	return c.EbookConvert != "" && from != to
+}
+
+// Convert converts a book from a format to another, both given by aliases.
+func (c *Converter) Convert(ctx context.Context, from, to string, src []byte, md Metadata) ([]byte, error) {
+	if f, ok := builtin[[2]string{from, to}]; ok {
+		return f(ctx, src, md)
+	}
+	if c.EbookConvert != "" && from != to {
+		return c.external(ctx, from, to, src, md)
+	}
+	return nil, ErrUnsupported
+}
+
+// newWriter returns an EPUB writer filled with metadata, preferring the
+// given one over the fallback found in the source.
+func newWriter(md Metadata, fallback Metadata) *epub.Writer {
+	w := &epub.Writer{
+		Identifier: md.Identifier,
+		Title:      md.Title,
+		Authors:    md.Authors,
+		Language:   md.Language,
+		Stylesheet: defaultStylesheet,
+	}
+	if w.Title == "" {
+		w.Title = fallback.Title
+	}
+	if len(w.Authors) == 0 {
+		w.Authors = fallback.Authors
+	}
+	if w.Language == "" {
+		w.Language = fallback.Language
+	}
+	switch {
+	case len(md.Cover) > 0:
+		w.SetCover(md.Cover, md.CoverType)
+	case len(fallback.Cover) > 0:
+		w.SetCover(fallback.Cover, fallback.CoverType)
+	}
+	return w
+}
+
+func writeEPUB(w *epub.Writer) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if _, err := w.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const defaultStylesheet = `body { margin: 0 1em; line-height: 1.6; }
+h1, h2, h3 { line-height: 1.3; }
+pre { white-space: pre-wrap; }
+blockquote { margin: 1em 2em; }
+img { max-width: 100%; }
+.cover { text-align: center; }
+.cover img { height: 100%; }
+`
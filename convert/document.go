@@ -0,0 +1,102 @@
+package convert
+
+import (
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+// linkMarker encloses ids of internal links until chapters are known.
+const linkMarker = "\x00"
+
+// document collects chapters of a converted book and resolves internal
+// links between them.
+type document struct {
+	w        *epub.Writer
+	titles   []string
+	bodies   []string
+	body     strings.Builder
+	title    string
+	ids      map[string]int
+	images   map[string]string
+	fallback string
+}
+
+func newDocument(w *epub.Writer) *document {
+	return &document{w: w, ids: map[string]int{}, images: map[string]string{}, fallback: w.Title}
+}
+
+// startChapter ends the current chapter unless it is empty.
+func (d *document) startChapter(title string) {
+	if strings.TrimSpace(d.body.String()) != "" {
+		d.endChapter()
+	}
+	d.title = title
+}
+
+// setTitle sets the title of the current chapter unless already set.
+func (d *document) setTitle(title string) {
+	if d.title == "" {
+		d.title = title
+	}
+}
+
+func (d *document) endChapter() {
+	title := d.title
+	if title == "" {
+		title = d.fallback
+	}
+	d.titles = append(d.titles, title)
+	d.bodies = append(d.bodies, d.body.String())
+	d.body.Reset()
+	d.title = ""
+}
+
+// addID records the chapter of an element id.
+func (d *document) addID(id string) {
+	if _, ok := d.ids[id]; !ok {
+		d.ids[id] = len(d.bodies)
+	}
+}
+
+// image adds a FictionBook binary as a resource on first reference and
+// returns its path.
+func (d *document) image(id string, binaries map[string]fb2Binary) string {
+	if src, ok := d.images[id]; ok {
+		return src
+	}
+	b, ok := binaries[id]
+	if !ok {
+		return ""
+	}
+	src := d.w.AddResource(id+imageExt(b.contentType, b.data), b.data)
+	d.images[id] = src
+	return src
+}
+
+// href returns a link target, deferring internal links.
+func (d *document) href(href string) string {
+	if strings.HasPrefix(href, "#") {
+		return linkMarker + href[1:] + linkMarker
+	}
+	return href
+}
+
+// finish adds chapters to the writer with internal links resolved.
+func (d *document) finish() {
+	if strings.TrimSpace(d.body.String()) != "" || len(d.bodies) == 0 {
+		d.endChapter()
+	}
+	for i, body := range d.bodies {
+		parts := strings.Split(body, linkMarker)
+		for j := 1; j < len(parts); j += 2 {
+			id := parts[j]
+			if n, ok := d.ids[id]; ok && n != i {
+				parts[j] = epub.ChapterFilename(n) + "#" + id
+			} else {
+				parts[j] = "#" + id
+			}
+		}
+		d.w.AddChapter(d.titles[i], strings.Join(parts, ""))
+	}
+}
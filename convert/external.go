@@ -0,0 +1,56 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// external converts a book with Calibre's ebook-convert, which detects
+// formats by file extensions.
+func (c *Converter) external(ctx context.Context, from, to string, src []byte, md Metadata) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "bookshelf-convert")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input."+from)
+	output := filepath.Join(dir, "output."+to)
+	if err := ioutil.WriteFile(input, src, 0600); err != nil {
+		return nil, err
+	}
+
+	args := []string{input, output}
+	if md.Title != "" {
+		args = append(args, "--title", md.Title)
+	}
+	if len(md.Authors) > 0 {
+		args = append(args, "--authors", strings.Join(md.Authors, "&"))
+	}
+	if md.Language != "" {
+		args = append(args, "--language", md.Language)
+	}
+
+	stderr := bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, c.EbookConvert, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ebook-convert: %v: %s", err, strings.TrimSpace(lastLine(stderr.String())))
+	}
+
+	return ioutil.ReadFile(output)
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
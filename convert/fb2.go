@@ -0,0 +1,256 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+	"github.com/altescy/bookshelf/format"
+)
+
+// FictionBook elements mapped to XHTML elements and classes.
+var fb2Elements = map[string][2]string{
+	"section":       {"div", "section"},
+	"p":             {"p", ""},
+	"v":             {"p", "verse"},
+	"subtitle":      {"p", "subtitle"},
+	"text-author":   {"p", "text-author"},
+	"emphasis":      {"em", ""},
+	"strong":        {"strong", ""},
+	"strikethrough": {"del", ""},
+	"sub":           {"sub", ""},
+	"sup":           {"sup", ""},
+	"code":          {"code", ""},
+	"style":         {"span", ""},
+	"epigraph":      {"blockquote", "epigraph"},
+	"cite":          {"blockquote", "cite"},
+	"annotation":    {"div", "annotation"},
+	"poem":          {"div", "poem"},
+	"stanza":        {"div", "stanza"},
+	"table":         {"table", ""},
+	"tr":            {"tr", ""},
+	"th":            {"th", ""},
+	"td":            {"td", ""},
+}
+
+const fb2Stylesheet = `.subtitle, .text-author { text-align: center; }
+.epigraph { font-style: italic; }
+.verse { margin: 0; text-indent: 0; }
+.stanza { margin: 1em 0; }
+`
+
+type fb2Binary struct {
+	contentType string
+	data        []byte
+}
+
+// FB2ToEPUB converts a FictionBook document, optionally zipped, to EPUB.
+// Top level sections of the main body become chapters and other bodies
+// such as notes follow them.
+func FB2ToEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	fr, err := format.OpenFB2(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		return nil, err
+	}
+	d := xml.NewDecoder(fr)
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	binaries := map[string]fb2Binary{}
+	bodies := [][]xml.Token{}
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "body":
+			tokens := []xml.Token{se.Copy()}
+			for depth := 1; depth > 0; {
+				t, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				switch t.(type) {
+				case xml.StartElement:
+					depth++
+				case xml.EndElement:
+					depth--
+				}
+				tokens = append(tokens, xml.CopyToken(t))
+			}
+			bodies = append(bodies, tokens)
+		case "binary":
+			b := struct {
+				ID          string `xml:"id,attr"`
+				ContentType string `xml:"content-type,attr"`
+				Data        string `xml:",chardata"`
+			}{}
+			if err := d.DecodeElement(&b, &se); err != nil {
+				return nil, err
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b.Data), ""))
+			if err == nil {
+				binaries[b.ID] = fb2Binary{b.ContentType, data}
+			}
+		}
+	}
+
+	w := newWriter(md, fb2Metadata(src))
+	w.Stylesheet += fb2Stylesheet
+
+	doc := newDocument(w)
+	for _, tokens := range bodies {
+		if err := writeFB2Body(ctx, doc, tokens, binaries); err != nil {
+			return nil, err
+		}
+	}
+	doc.finish()
+	return writeEPUB(w)
+}
+
+func writeFB2Body(ctx context.Context, doc *document, tokens []xml.Token, binaries map[string]fb2Binary) error {
+	closers := []string{}
+	depth := 0
+	inTitle, titleLines := false, 0
+
+	main := true
+	if se, ok := tokens[0].(xml.StartElement); ok {
+		main = fb2Attr(se.Attr, "name") == ""
+	}
+	if !main {
+		doc.startChapter("")
+	}
+
+	for i, t := range tokens[1 : len(tokens)-1] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			closer := ""
+			id := fb2Attr(t.Attr, "id")
+			if id != "" {
+				doc.addID(id)
+			}
+			attrs := ""
+			if id != "" {
+				attrs = ` id="` + epub.EscapeText(id) + `"`
+			}
+
+			switch {
+			case name == "title":
+				level := depth + 1
+				if level > 6 {
+					level = 6
+				}
+				tag := "h" + strconv.Itoa(level)
+				if main && depth == 1 || !main && depth == 0 {
+					doc.setTitle(elementText(tokens[i+2:]))
+				}
+				doc.body.WriteString("<" + tag + attrs + ">")
+				closer = "</" + tag + ">"
+				inTitle, titleLines = true, 0
+			case inTitle && name == "p":
+				if titleLines > 0 {
+					doc.body.WriteString("<br/>")
+				}
+				titleLines++
+			case name == "empty-line":
+				doc.body.WriteString("<br/>")
+			case name == "image":
+				if src := doc.image(strings.TrimPrefix(fb2Href(t.Attr), "#"), binaries); src != "" {
+					alt := epub.EscapeText(fb2Attr(t.Attr, "alt"))
+					doc.body.WriteString(`<img src="` + src + `" alt="` + alt + `"` + attrs + "/>")
+				}
+			case name == "a":
+				href := epub.EscapeText(doc.href(fb2Href(t.Attr)))
+				doc.body.WriteString(`<a href="` + href + `"` + attrs + ">")
+				closer = "</a>"
+			default:
+				if name == "section" {
+					depth++
+					if main && depth == 1 {
+						doc.startChapter("")
+					}
+				}
+				if e, ok := fb2Elements[name]; ok {
+					if e[1] != "" {
+						attrs += ` class="` + e[1] + `"`
+					}
+					doc.body.WriteString("<" + e[0] + attrs + ">")
+					closer = "</" + e[0] + ">"
+				}
+			}
+			closers = append(closers, closer)
+		case xml.EndElement:
+			if len(closers) == 0 {
+				continue
+			}
+			doc.body.WriteString(closers[len(closers)-1])
+			closers = closers[:len(closers)-1]
+			switch t.Name.Local {
+			case "title":
+				inTitle = false
+			case "section":
+				depth--
+			}
+		case xml.CharData:
+			doc.body.WriteString(epub.EscapeText(string(t)))
+		}
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		doc.body.WriteString(closers[i])
+	}
+	return nil
+}
+
+// fb2Href returns the xlink:href attribute, whose prefix varies by file.
+func fb2Href(attrs []xml.Attr) string {
+	return fb2Attr(attrs, "href")
+}
+
+func fb2Attr(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// fb2Metadata returns metadata and the cover declared in the description.
+func fb2Metadata(src []byte) Metadata {
+	md := Metadata{}
+	f, err := format.Default.ByAlias("fb2")
+	if err != nil {
+		return md
+	}
+	r, size := bytes.NewReader(src), int64(len(src))
+	if m, err := f.ExtractMetadata(r, size); err == nil {
+		md.Title, md.Language = m.Title, m.Language
+		if m.Author != "" {
+			md.Authors = strings.Split(m.Author, ", ")
+		}
+	}
+	if cover, coverType, err := f.ExtractCover(r, size); err == nil {
+		md.Cover, md.CoverType = cover, coverType
+	}
+	return md
+}
@@ -0,0 +1,261 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+// Elements dropped with their content.
+var htmlDropped = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true,
+	"embed": true, "form": true, "noscript": true, "template": true,
+	"button": true, "select": true, "textarea": true, "head": true,
+}
+
+// Elements written without end tags in XHTML.
+var htmlVoid = map[string]bool{
+	"br": true, "hr": true, "img": true, "wbr": true, "col": true,
+	"area": true, "input": true, "meta": true, "link": true, "base": true,
+}
+
+// Obsolete elements replaced by generic ones.
+var htmlRenamed = map[string]string{
+	"center": "div", "font": "span", "big": "span", "tt": "code",
+}
+
+// Elements implicitly closing an open paragraph.
+var htmlClosesParagraph = map[string]bool{
+	"p": true, "div": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "ul": true, "ol": true, "dl": true, "pre": true,
+	"table": true, "blockquote": true, "hr": true, "section": true,
+}
+
+var htmlAttributes = map[string]bool{
+	"id": true, "class": true, "href": true, "src": true, "alt": true,
+	"title": true, "lang": true, "dir": true, "colspan": true,
+	"rowspan": true, "style": true,
+}
+
+var htmlDataURI = regexp.MustCompile(`^data:(image/[a-z+.-]+);base64,`)
+
+// HTMLToEPUB converts an HTML document to EPUB. The document is parsed
+// leniently and written back as well-formed XHTML. Headings at the top
+// level of the body start chapters. Images are kept only if embedded as
+// data URIs.
+func HTMLToEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	d := xml.NewDecoder(strings.NewReader(cleanText(src)))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	title := ""
+	tokens := []xml.Token{}
+	inTitle := false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			// keep what was parsed from broken documents
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "html", "body":
+				continue
+			case "title":
+				inTitle = true
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "html", "body":
+				continue
+			case "title":
+				inTitle = false
+			}
+		case xml.CharData:
+			if inTitle {
+				title += string(t)
+			}
+		}
+		tokens = append(tokens, xml.CopyToken(t))
+	}
+
+	w := newWriter(md, Metadata{Title: strings.TrimSpace(title)})
+	doc := newDocument(w)
+	if err := writeXHTML(ctx, doc, tokens); err != nil {
+		return nil, err
+	}
+	doc.finish()
+	return writeEPUB(w)
+}
+
+// writeXHTML writes HTML tokens to a document. Unknown end tags are
+// ignored and unclosed elements are closed so that the output is
+// well-formed.
+func writeXHTML(ctx context.Context, doc *document, tokens []xml.Token) error {
+	stack := []string{}
+	dropped := 0
+
+	for i, t := range tokens {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if dropped > 0 || htmlDropped[name] {
+				if !htmlVoid[name] {
+					dropped++
+				}
+				continue
+			}
+			if renamed, ok := htmlRenamed[name]; ok {
+				name = renamed
+			}
+			if htmlClosesParagraph[name] {
+				stack = closeElement(doc, stack, "p")
+			}
+			if len(stack) == 0 && (name == "h1" || name == "h2") {
+				doc.startChapter(elementText(tokens[i+1:]))
+			}
+
+			attrs := xhtmlAttributes(doc, name, t.Attr)
+			if name == "img" && attrs == "" {
+				continue
+			}
+			if htmlVoid[name] {
+				if name != "meta" && name != "link" && name != "base" && name != "input" {
+					doc.body.WriteString("<" + name + attrs + "/>")
+				}
+				continue
+			}
+			doc.body.WriteString("<" + name + attrs + ">")
+			stack = append(stack, name)
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if dropped > 0 {
+				if !htmlVoid[name] {
+					dropped--
+				}
+				continue
+			}
+			if renamed, ok := htmlRenamed[name]; ok {
+				name = renamed
+			}
+			stack = closeElement(doc, stack, name)
+		case xml.CharData:
+			if dropped == 0 {
+				doc.body.WriteString(epub.EscapeText(string(t)))
+			}
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		doc.body.WriteString("</" + stack[i] + ">")
+	}
+	return nil
+}
+
+// closeElement closes the innermost open element of a name and the
+// elements inside it. The stack is returned as it is if none is open.
+func closeElement(doc *document, stack []string, name string) []string {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == name {
+			for j := len(stack) - 1; j >= i; j-- {
+				doc.body.WriteString("</" + stack[j] + ">")
+			}
+			return stack[:i]
+		}
+	}
+	return stack
+}
+
+// xhtmlAttributes returns allowed attributes of an element. Images are
+// kept only if embedded, in which case an empty string is never returned.
+func xhtmlAttributes(doc *document, name string, attrs []xml.Attr) string {
+	b := strings.Builder{}
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Name.Local)
+		if attr.Name.Space != "" && attr.Name.Space != "xml" || !htmlAttributes[key] {
+			continue
+		}
+		value := attr.Value
+		switch key {
+		case "id":
+			doc.addID(value)
+		case "href":
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "javascript:") {
+				continue
+			}
+			value = doc.href(value)
+		case "src":
+			if name != "img" {
+				continue
+			}
+			m := htmlDataURI.FindStringSubmatch(value)
+			if m == nil {
+				return ""
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[len(m[0]):]))
+			if err != nil {
+				return ""
+			}
+			value = doc.w.AddResource("image"+imageExt(m[1], data), data)
+		}
+		b.WriteString(" " + key + `="` + epub.EscapeText(value) + `"`)
+	}
+	if name == "img" && !strings.Contains(b.String(), ` src="`) {
+		return ""
+	}
+	return b.String()
+}
+
+// elementText returns the text of an element whose content starts at
+// tokens.
+func elementText(tokens []xml.Token) string {
+	text := strings.Builder{}
+	depth := 0
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text.Write(t)
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+func imageExt(mediaType string, data []byte) string {
+	switch mediaType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/svg+xml":
+		return ".svg"
+	case "image/webp":
+		return ".webp"
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	}
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		return ".png"
+	}
+	return ".jpg"
+}
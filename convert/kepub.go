@@ -0,0 +1,221 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+// Elements starting a paragraph of Kobo spans.
+var kepubBlocks = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "li": true, "div": true, "blockquote": true, "td": true,
+	"th": true, "dt": true, "dd": true, "pre": true, "figcaption": true,
+}
+
+// Elements whose text is not wrapped.
+var kepubSkipped = map[string]bool{
+	"head": true, "script": true, "style": true, "svg": true, "math": true,
+	"title": true,
+}
+
+var kepubSentence = regexp.MustCompile(`[.!?。！？]+["'”’」』)）]*\s*`)
+
+// EPUBToKEPUB converts an EPUB to a Kobo EPUB by wrapping sentences of
+// content documents in koboSpan elements, which Kobo readers use to track
+// reading positions and highlights.
+func EPUBToKEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	r := bytes.NewReader(src)
+	book, err := epub.Open(r, r.Size())
+	if err != nil {
+		return nil, err
+	}
+	documents := map[string]bool{}
+	for _, item := range book.Manifest {
+		if item.MediaType == "application/xhtml+xml" && !strings.Contains(item.Properties, "nav") {
+			documents[item.Href] = true
+		}
+	}
+
+	zr, err := zip.NewReader(r, r.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(f, "application/epub+zip"); err != nil {
+		return nil, err
+	}
+
+	for _, file := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if file.Name == "mimetype" || strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if documents[file.Name] {
+			b = []byte(addKoboSpans(string(b)))
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addKoboSpans wraps sentences in the body of an XHTML document in spans
+// numbered by paragraph and sentence, and wraps the body content in the
+// divs used by Kobo for pagination. Documents already containing Kobo
+// spans are returned as they are.
+func addKoboSpans(doc string) string {
+	if strings.Contains(doc, "koboSpan") {
+		return doc
+	}
+
+	out := strings.Builder{}
+	inBody := false
+	skipped := 0
+	paragraph, sentence := 0, 0
+
+	for len(doc) > 0 {
+		if !strings.HasPrefix(doc, "<") {
+			end := strings.IndexByte(doc, '<')
+			if end < 0 {
+				end = len(doc)
+			}
+			text := doc[:end]
+			doc = doc[end:]
+			if !inBody || skipped > 0 || strings.TrimSpace(text) == "" {
+				out.WriteString(text)
+				continue
+			}
+			if paragraph == 0 {
+				paragraph = 1
+			}
+			for _, s := range splitSentences(text) {
+				trimmed := strings.TrimSpace(s)
+				if trimmed == "" {
+					out.WriteString(s)
+					continue
+				}
+				lead := s[:strings.Index(s, trimmed)]
+				trail := s[len(lead)+len(trimmed):]
+				sentence++
+				fmt.Fprintf(&out, `%s<span class="koboSpan" id="kobo.%d.%d">%s</span>%s`, lead, paragraph, sentence, trimmed, trail)
+			}
+			continue
+		}
+
+		// copy comments, CDATA sections and declarations as they are
+		tagEnd := ">"
+		switch {
+		case strings.HasPrefix(doc, "<!--"):
+			tagEnd = "-->"
+		case strings.HasPrefix(doc, "<![CDATA["):
+			tagEnd = "]]>"
+		case strings.HasPrefix(doc, "<?"):
+			tagEnd = "?>"
+		}
+		end := strings.Index(doc, tagEnd)
+		if end < 0 {
+			out.WriteString(doc)
+			break
+		}
+		tag := doc[:end+len(tagEnd)]
+		doc = doc[end+len(tagEnd):]
+
+		name, closing, selfClosing := parseTag(tag)
+		switch {
+		case name == "body" && !closing:
+			out.WriteString(tag)
+			out.WriteString(`<div id="book-columns"><div id="book-inner">`)
+			inBody = true
+			continue
+		case name == "body" && closing:
+			out.WriteString(`</div></div>`)
+			out.WriteString(tag)
+			inBody = false
+			continue
+		case kepubSkipped[name] && !selfClosing:
+			if closing {
+				skipped--
+			} else {
+				skipped++
+			}
+		case kepubBlocks[name] && !closing:
+			paragraph++
+			sentence = 0
+		}
+		out.WriteString(tag)
+	}
+	return out.String()
+}
+
+// parseTag returns the local name of an element tag.
+func parseTag(tag string) (name string, closing, selfClosing bool) {
+	if !strings.HasPrefix(tag, "<") || strings.HasPrefix(tag, "<!") || strings.HasPrefix(tag, "<?") {
+		return "", false, false
+	}
+	s := strings.TrimPrefix(tag, "<")
+	if strings.HasPrefix(s, "/") {
+		closing = true
+		s = s[1:]
+	}
+	selfClosing = strings.HasSuffix(tag, "/>")
+	end := strings.IndexAny(s, " \t\r\n/>")
+	if end < 0 {
+		end = len(s)
+	}
+	name = strings.ToLower(s[:end])
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, closing, selfClosing
+}
+
+// splitSentences splits text after sentence terminators, keeping all of
+// the text.
+func splitSentences(text string) []string {
+	sentences := []string{}
+	for {
+		loc := kepubSentence.FindStringIndex(text)
+		if loc == nil || loc[1] == len(text) {
+			break
+		}
+		sentences = append(sentences, text[:loc[1]])
+		text = text[loc[1]:]
+	}
+	return append(sentences, text)
+}
@@ -0,0 +1,139 @@
+package convert
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRule        = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	mdBullet      = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered     = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdImage       = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+&quot;[^)]*&quot;)?\)`)
+	mdStrong      = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	mdEmphasis    = regexp.MustCompile(`(\*|_)(\S(?:.*?\S)?)(\*|_)`)
+	mdFrontMatter = regexp.MustCompile(`(?s)^---\n.*?\n---\n`)
+)
+
+// MarkdownToEPUB converts Markdown to EPUB. Level 1 and 2 headings start
+// chapters. Common block and inline syntax is supported; raw HTML is
+// escaped.
+func MarkdownToEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	w := newWriter(md, Metadata{})
+
+	text := mdFrontMatter.ReplaceAllString(cleanText(src), "")
+	lines := strings.Split(text, "\n")
+
+	title := ""
+	body := strings.Builder{}
+	flush := func() {
+		if strings.TrimSpace(body.String()) != "" {
+			if title == "" {
+				title = w.Title
+			}
+			w.AddChapter(title, body.String())
+		}
+		body.Reset()
+	}
+
+	paragraph := []string{}
+	endParagraph := func() {
+		if len(paragraph) > 0 {
+			body.WriteString("<p>" + strings.Join(paragraph, "\n") + "</p>\n")
+			paragraph = paragraph[:0]
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line := lines[i]
+
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			endParagraph()
+			code := []string{}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, epub.EscapeText(lines[i]))
+			}
+			body.WriteString("<pre><code>" + strings.Join(code, "\n") + "</code></pre>\n")
+		case mdHeading.MatchString(line):
+			endParagraph()
+			m := mdHeading.FindStringSubmatch(line)
+			level := len(m[1])
+			if level <= 2 {
+				flush()
+				title = m[2]
+			}
+			tag := "h" + string(rune('0'+level))
+			body.WriteString("<" + tag + ">" + mdInline(m[2]) + "</" + tag + ">\n")
+		case mdRule.MatchString(line):
+			endParagraph()
+			body.WriteString("<hr/>\n")
+		case strings.HasPrefix(strings.TrimSpace(line), ">"):
+			endParagraph()
+			quote := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, mdInline(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")))
+			}
+			i--
+			body.WriteString("<blockquote><p>" + strings.Join(quote, "\n") + "</p></blockquote>\n")
+		case mdBullet.MatchString(line) || mdOrdered.MatchString(line):
+			endParagraph()
+			pattern, tag := mdBullet, "ul"
+			if !mdBullet.MatchString(line) {
+				pattern, tag = mdOrdered, "ol"
+			}
+			body.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && pattern.MatchString(lines[i]); i++ {
+				item := pattern.FindStringSubmatch(lines[i])[1]
+				body.WriteString("<li>" + mdInline(item) + "</li>\n")
+			}
+			i--
+			body.WriteString("</" + tag + ">\n")
+		case strings.TrimSpace(line) == "":
+			endParagraph()
+		default:
+			text := mdInline(strings.TrimSpace(line))
+			if strings.HasSuffix(line, "  ") {
+				text += "<br/>"
+			}
+			paragraph = append(paragraph, text)
+		}
+	}
+	endParagraph()
+	flush()
+
+	if w.NumChapters() == 0 {
+		w.AddChapter(w.Title, "")
+	}
+	return writeEPUB(w)
+}
+
+// mdInline renders inline syntax of escaped text. Code spans are kept as
+// they are.
+func mdInline(s string) string {
+	parts := strings.Split(s, "`")
+	for i, part := range parts {
+		part = epub.EscapeText(part)
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + part + "</code>"
+			continue
+		}
+		part = mdImage.ReplaceAllString(part, "$1")
+		part = mdLink.ReplaceAllString(part, `<a href="$2">$1</a>`)
+		part = mdStrong.ReplaceAllString(part, "<strong>$2</strong>")
+		part = mdEmphasis.ReplaceAllString(part, "<em>$2</em>")
+		if i%2 == 1 {
+			part = "`" + part
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,79 @@
+package convert
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+// chapterSize is the approximate size of chapters split from plain text,
+// since some readers are slow to open large documents.
+const chapterSize = 64 << 10
+
+// TextToEPUB converts plain text to EPUB. Paragraphs are separated by blank
+// lines. Texts of Aozora Bunko are converted by AozoraToEPUB.
+func TextToEPUB(ctx context.Context, src []byte, md Metadata) ([]byte, error) {
+	if IsAozora(src) {
+		return AozoraToEPUB(ctx, src, md)
+	}
+
+	w := newWriter(md, Metadata{})
+
+	body := strings.Builder{}
+	part := 1
+	flush := func() {
+		title := w.Title
+		if part > 1 || body.Len() >= chapterSize {
+			title = w.Title + " " + strconv.Itoa(part)
+		}
+		w.AddChapter(title, body.String())
+		body.Reset()
+		part++
+	}
+
+	for _, paragraph := range splitParagraphs(cleanText(src)) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lines := strings.Split(paragraph, "\n")
+		for i, line := range lines {
+			lines[i] = epub.EscapeText(line)
+		}
+		body.WriteString("<p>" + strings.Join(lines, "<br/>") + "</p>\n")
+		if body.Len() >= chapterSize {
+			flush()
+		}
+	}
+	if body.Len() > 0 || part == 1 {
+		flush()
+	}
+
+	return writeEPUB(w)
+}
+
+// cleanText returns text as valid UTF-8 without a BOM, carriage returns
+// and control characters which are not allowed in XML.
+func cleanText(src []byte) string {
+	s := strings.ToValidUTF8(string(src), "\ufffd")
+	s = strings.TrimPrefix(s, "\ufeff")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func splitParagraphs(s string) []string {
+	paragraphs := []string{}
+	for _, p := range strings.Split(s, "\n\n") {
+		if p = strings.Trim(p, "\n"); strings.TrimSpace(p) != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	return paragraphs
+}
@@ -0,0 +1,479 @@
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const containerPath = "META-INF/container.xml"
+
+var (
+	ErrNoContainer = errors.New("epub: META-INF/container.xml not found")
+	ErrNoPackage   = errors.New("epub: package document not found")
+	ErrNotFound    = errors.New("epub: resource not found")
+)
+
+// Book is an opened EPUB archive. Only the package document is parsed on
+// open; other resources are read from the archive on demand.
+type Book struct {
+	zip   *zip.Reader
+	files map[string]*zip.File
+
+	PackagePath string     `json:"PackagePath"`
+	Metadata    Metadata   `json:"Metadata"`
+	Manifest    []Item     `json:"Manifest"`
+	Spine       Spine      `json:"Spine"`
+	TOC         []NavPoint `json:"TOC"`
+}
+
+type Metadata struct {
+	Title       string   `json:"Title"`
+	Authors     []string `json:"Authors"`
+	Language    string   `json:"Language"`
+	Identifiers []string `json:"Identifiers"`
+	Publisher   string   `json:"Publisher"`
+	Date        string   `json:"Date"`
+	Description string   `json:"Description"`
+	// Cover is the archive path of the cover image if declared.
+	Cover string `json:"Cover"`
+}
+
+// Item is a manifest entry. Href is the path inside the archive.
+type Item struct {
+	ID         string `json:"ID"`
+	Href       string `json:"Href"`
+	MediaType  string `json:"MediaType"`
+	Properties string `json:"Properties"`
+}
+
+type Spine struct {
+	PageProgressionDirection string      `json:"PageProgressionDirection"`
+	Items                    []SpineItem `json:"Items"`
+}
+
+type SpineItem struct {
+	IDRef  string `json:"IDRef"`
+	Href   string `json:"Href"`
+	Linear bool   `json:"Linear"`
+}
+
+type NavPoint struct {
+	Label    string     `json:"Label"`
+	Href     string     `json:"Href"`
+	Children []NavPoint `json:"Children"`
+}
+
+type container struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfPackage struct {
+	Metadata struct {
+		Titles      []string `xml:"title"`
+		Creators    []string `xml:"creator"`
+		Languages   []string `xml:"language"`
+		Identifiers []string `xml:"identifier"`
+		Publisher   string   `xml:"publisher"`
+		Date        string   `xml:"date"`
+		Description string   `xml:"description"`
+		Metas       []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Items []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC                      string `xml:"toc,attr"`
+		PageProgressionDirection string `xml:"page-progression-direction,attr"`
+		ItemRefs                 []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// Open reads the container and package documents of an EPUB archive.
+func Open(r io.ReaderAt, size int64) (*Book, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Book{
+		zip:   zr,
+		files: make(map[string]*zip.File, len(zr.File)),
+	}
+	for _, f := range zr.File {
+		b.files[f.Name] = f
+	}
+
+	c := container{}
+	if err := b.decodeXML(containerPath, &c); err != nil {
+		if err == ErrNotFound {
+			return nil, ErrNoContainer
+		}
+		return nil, err
+	}
+	for _, rootfile := range c.Rootfiles {
+		if rootfile.MediaType == "" || rootfile.MediaType == "application/oebps-package+xml" {
+			b.PackagePath = rootfile.FullPath
+			break
+		}
+	}
+	if b.PackagePath == "" {
+		return nil, ErrNoPackage
+	}
+
+	opf := opfPackage{}
+	if err := b.decodeXML(b.PackagePath, &opf); err != nil {
+		if err == ErrNotFound {
+			return nil, ErrNoPackage
+		}
+		return nil, err
+	}
+	b.readPackage(&opf)
+
+	return b, nil
+}
+
+func (b *Book) readPackage(opf *opfPackage) {
+	base := path.Dir(b.PackagePath)
+
+	md := &b.Metadata
+	md.Title = first(opf.Metadata.Titles)
+	md.Authors = trimAll(opf.Metadata.Creators)
+	md.Language = first(opf.Metadata.Languages)
+	md.Identifiers = trimAll(opf.Metadata.Identifiers)
+	md.Publisher = strings.TrimSpace(opf.Metadata.Publisher)
+	md.Date = strings.TrimSpace(opf.Metadata.Date)
+	md.Description = strings.TrimSpace(opf.Metadata.Description)
+
+	coverID := ""
+	for _, meta := range opf.Metadata.Metas {
+		if meta.Name == "cover" {
+			coverID = meta.Content
+		}
+	}
+
+	hrefs := map[string]string{}
+	navHref, ncxHref := "", ""
+	for _, item := range opf.Items {
+		href := resolve(base, item.Href)
+		hrefs[item.ID] = href
+		b.Manifest = append(b.Manifest, Item{
+			ID:         item.ID,
+			Href:       href,
+			MediaType:  item.MediaType,
+			Properties: item.Properties,
+		})
+
+		properties := strings.Fields(item.Properties)
+		switch {
+		case contains(properties, "cover-image"), item.ID == coverID && md.Cover == "":
+			md.Cover = href
+		}
+		if contains(properties, "nav") {
+			navHref = href
+		}
+		if item.ID == opf.Spine.TOC || (ncxHref == "" && item.MediaType == "application/x-dtbncx+xml") {
+			ncxHref = href
+		}
+	}
+
+	b.Spine.PageProgressionDirection = opf.Spine.PageProgressionDirection
+	for _, ref := range opf.Spine.ItemRefs {
+		b.Spine.Items = append(b.Spine.Items, SpineItem{
+			IDRef:  ref.IDRef,
+			Href:   hrefs[ref.IDRef],
+			Linear: ref.Linear != "no",
+		})
+	}
+
+	if navHref != "" {
+		b.TOC = b.readNav(navHref)
+	}
+	if len(b.TOC) == 0 && ncxHref != "" {
+		b.TOC = b.readNCX(ncxHref)
+	}
+}
+
+// Files returns names of all entries in the archive.
+func (b *Book) Files() []string {
+	names := make([]string, 0, len(b.zip.File))
+	for _, f := range b.zip.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// Open opens an entry of the archive by its path.
+func (b *Book) Open(name string) (io.ReadCloser, error) {
+	f, ok := b.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return f.Open()
+}
+
+// Stat returns the header of an entry of the archive.
+func (b *Book) Stat(name string) (*zip.FileHeader, error) {
+	f, ok := b.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &f.FileHeader, nil
+}
+
+// MediaType returns the media type of an entry declared in the manifest,
+// falling back to a guess from the file extension.
+func (b *Book) MediaType(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	for _, item := range b.Manifest {
+		if item.Href == name && item.MediaType != "" {
+			return item.MediaType
+		}
+	}
+	return MediaTypeByExt(path.Ext(name))
+}
+
+var mediaTypes = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".html":  "text/html",
+	".htm":   "text/html",
+	".css":   "text/css",
+	".ncx":   "application/x-dtbncx+xml",
+	".opf":   "application/oebps-package+xml",
+	".smil":  "application/smil+xml",
+	".svg":   "image/svg+xml",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".otf":   "font/otf",
+	".ttf":   "font/ttf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".js":    "application/javascript",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".xml":   "application/xml",
+}
+
+// MediaTypeByExt guesses a media type of an EPUB resource.
+func MediaTypeByExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (b *Book) decodeXML(name string, v interface{}) error {
+	f, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := xml.NewDecoder(f)
+	d.Strict = false
+	d.CharsetReader = charsetReader
+	return d.Decode(v)
+}
+
+type navList struct {
+	Items []struct {
+		A    navLabel `xml:"a"`
+		Span navLabel `xml:"span"`
+		List *navList `xml:"ol"`
+	} `xml:"li"`
+}
+
+func (b *Book) readNav(href string) []NavPoint {
+	f, err := b.Open(href)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	d := xml.NewDecoder(f)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charsetReader
+
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "nav" || !isTOCNav(se) {
+			continue
+		}
+
+		nav := struct {
+			List navList `xml:"ol"`
+		}{}
+		if err := d.DecodeElement(&nav, &se); err != nil {
+			return nil
+		}
+		return navPoints(path.Dir(href), &nav.List)
+	}
+}
+
+func isTOCNav(se xml.StartElement) bool {
+	for _, attr := range se.Attr {
+		if attr.Name.Local == "type" && contains(strings.Fields(attr.Value), "toc") {
+			return true
+		}
+	}
+	return false
+}
+
+// navLabel collects all text in an element including nested ones.
+type navLabel struct {
+	Href string
+	Text string
+}
+
+func (l *navLabel) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "href" {
+			l.Href = attr.Value
+		}
+	}
+
+	sb := strings.Builder{}
+	for depth := 1; depth > 0; {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			sb.Write(t)
+		}
+	}
+	l.Text = strings.Join(strings.Fields(sb.String()), " ")
+	return nil
+}
+
+func navPoints(base string, list *navList) []NavPoint {
+	points := []NavPoint{}
+	for _, li := range list.Items {
+		p := NavPoint{Children: []NavPoint{}}
+		if li.A.Href != "" {
+			p.Href = resolve(base, li.A.Href)
+		}
+		p.Label = li.A.Text
+		if p.Label == "" {
+			p.Label = li.Span.Text
+		}
+		if li.List != nil {
+			p.Children = navPoints(base, li.List)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+type ncxPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Points []ncxPoint `xml:"navPoint"`
+}
+
+func (b *Book) readNCX(href string) []NavPoint {
+	ncx := struct {
+		Points []ncxPoint `xml:"navMap>navPoint"`
+	}{}
+	if err := b.decodeXML(href, &ncx); err != nil {
+		return nil
+	}
+	return ncxPoints(path.Dir(href), ncx.Points)
+}
+
+func ncxPoints(base string, points []ncxPoint) []NavPoint {
+	result := make([]NavPoint, 0, len(points))
+	for _, p := range points {
+		result = append(result, NavPoint{
+			Label:    strings.TrimSpace(p.Label),
+			Href:     resolve(base, p.Content.Src),
+			Children: ncxPoints(base, p.Points),
+		})
+	}
+	return result
+}
+
+// resolve converts an href relative to base into an archive path,
+// keeping its fragment.
+func resolve(base, href string) string {
+	u, err := url.Parse(href)
+	if err != nil || u.IsAbs() {
+		return href
+	}
+	resolved := path.Join(base, u.Path)
+	if u.Path == "" {
+		resolved = ""
+	}
+	if u.Fragment != "" {
+		resolved += "#" + u.Fragment
+	}
+	return strings.TrimPrefix(resolved, "/")
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	// EPUB requires UTF-8 or UTF-16 but some books declare aliases.
+	return input, nil
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+func trimAll(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
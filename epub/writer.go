@@ -0,0 +1,341 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Writer builds an EPUB 3 book from XHTML chapters. A navigation document
+// and an NCX are generated so that EPUB 2 readers can use the TOC as well.
+type Writer struct {
+	Identifier string
+	Title      string
+	Authors    []string
+	Language   string
+	// Direction is the page progression direction, "ltr" or "rtl".
+	Direction string
+	// Stylesheet is CSS applied to every chapter.
+	Stylesheet string
+
+	cover     *resource
+	chapters  []chapter
+	resources []resource
+}
+
+type chapter struct {
+	ID    string
+	Href  string
+	Title string
+	Body  string
+	Order int
+}
+
+type resource struct {
+	ID         string
+	Href       string
+	MediaType  string
+	Properties string
+	Data       []byte
+}
+
+// ChapterFilename returns the file name of the nth chapter counted from
+// zero, which chapters use to link to each other.
+func ChapterFilename(n int) string {
+	return fmt.Sprintf("chapter%04d.xhtml", n+1)
+}
+
+// AddChapter adds a chapter. body is the XHTML content of the body element
+// and may refer to resources by the paths returned by AddResource.
+func (w *Writer) AddChapter(title, body string) {
+	n := len(w.chapters) + 1
+	w.chapters = append(w.chapters, chapter{
+		ID:    fmt.Sprintf("chapter%04d", n),
+		Href:  "text/" + ChapterFilename(n-1),
+		Title: title,
+		Body:  body,
+		Order: n,
+	})
+}
+
+// NumChapters returns the number of chapters added.
+func (w *Writer) NumChapters() int {
+	return len(w.chapters)
+}
+
+// AddResource adds a resource such as an image and returns its path
+// relative to chapters.
+func (w *Writer) AddResource(name string, data []byte) string {
+	n := len(w.resources) + 1
+	href := fmt.Sprintf("resources/%04d%s", n, strings.ToLower(path.Ext(name)))
+	w.resources = append(w.resources, resource{
+		ID:        fmt.Sprintf("resource%04d", n),
+		Href:      href,
+		MediaType: MediaTypeByExt(path.Ext(name)),
+		Data:      data,
+	})
+	return "../" + href
+}
+
+// SetCover sets the cover image, which is also shown on the first page.
+func (w *Writer) SetCover(data []byte, mediaType string) {
+	ext := ".jpg"
+	switch mediaType {
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	case "image/webp":
+		ext = ".webp"
+	}
+	w.cover = &resource{
+		ID:         "cover-image",
+		Href:       "images/cover" + ext,
+		MediaType:  mediaType,
+		Properties: "cover-image",
+		Data:       data,
+	}
+}
+
+// WriteTo writes the book as an EPUB archive.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+
+	// the mimetype has to be the first and uncompressed entry
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(f, "application/epub+zip"); err != nil {
+		return 0, err
+	}
+
+	files := []struct {
+		name string
+		tmpl *template.Template
+	}{
+		{containerPath, containerTemplate},
+		{"OEBPS/content.opf", packageTemplate},
+		{"OEBPS/nav.xhtml", navTemplate},
+		{"OEBPS/toc.ncx", ncxTemplate},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return 0, err
+		}
+		if err := file.tmpl.Execute(f, w.data()); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err = zw.Create("OEBPS/style.css")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(f, w.Stylesheet); err != nil {
+		return 0, err
+	}
+
+	chapters := w.chapters
+	if w.cover != nil {
+		chapters = append([]chapter{{
+			ID:   "cover",
+			Href: "text/cover.xhtml",
+			Body: fmt.Sprintf(`<div class="cover"><img src="../%s" alt=""/></div>`, w.cover.Href),
+		}}, chapters...)
+	}
+	for _, c := range chapters {
+		f, err := zw.Create("OEBPS/" + c.Href)
+		if err != nil {
+			return 0, err
+		}
+		data := struct {
+			Language string
+			Title    string
+			Body     string
+		}{w.language(), c.Title, c.Body}
+		if err := chapterTemplate.Execute(f, data); err != nil {
+			return 0, err
+		}
+	}
+
+	resources := w.resources
+	if w.cover != nil {
+		resources = append(resources, *w.cover)
+	}
+	for _, r := range resources {
+		f, err := zw.Create("OEBPS/" + r.Href)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(r.Data); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(out)
+}
+
+func (w *Writer) language() string {
+	if w.Language == "" {
+		return "und"
+	}
+	return w.Language
+}
+
+func (w *Writer) data() interface{} {
+	title := w.Title
+	if title == "" {
+		title = "Untitled"
+	}
+	direction := w.Direction
+	if direction == "" {
+		direction = "ltr"
+	}
+	resources := w.resources
+	var cover *chapter
+	if w.cover != nil {
+		resources = append(resources, *w.cover)
+		cover = &chapter{ID: "cover", Href: "text/cover.xhtml"}
+	}
+	return struct {
+		Identifier string
+		Title      string
+		Authors    []string
+		Language   string
+		Direction  string
+		Modified   string
+		Cover      *chapter
+		Chapters   []chapter
+		Resources  []resource
+	}{
+		Identifier: w.Identifier,
+		Title:      title,
+		Authors:    w.Authors,
+		Language:   w.language(),
+		Direction:  direction,
+		Modified:   time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Cover:      cover,
+		Chapters:   w.chapters,
+		Resources:  resources,
+	}
+}
+
+// EscapeText escapes text to be embedded in XHTML.
+func EscapeText(s string) string {
+	return xmlEscaper.Replace(s)
+}
+
+var xmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&#39;",
+)
+
+var funcs = template.FuncMap{"xml": EscapeText}
+
+var containerTemplate = template.Must(template.New("container").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`))
+
+var packageTemplate = template.Must(template.New("package").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid" xml:lang="{{xml .Language}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">{{xml .Identifier}}</dc:identifier>
+    <dc:title>{{xml .Title}}</dc:title>
+{{- range .Authors}}
+    <dc:creator>{{xml .}}</dc:creator>
+{{- end}}
+    <dc:language>{{xml .Language}}</dc:language>
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+{{- if .Cover}}
+    <meta name="cover" content="cover-image"/>
+{{- end}}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+{{- with .Cover}}
+    <item id="{{.ID}}-page" href="{{.Href}}" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range .Chapters}}
+    <item id="{{.ID}}" href="{{.Href}}" media-type="application/xhtml+xml"/>
+{{- end}}
+{{- range .Resources}}
+    <item id="{{.ID}}" href="{{.Href}}" media-type="{{xml .MediaType}}"{{if .Properties}} properties="{{.Properties}}"{{end}}/>
+{{- end}}
+  </manifest>
+  <spine toc="ncx" page-progression-direction="{{.Direction}}">
+{{- with .Cover}}
+    <itemref idref="{{.ID}}-page"/>
+{{- end}}
+{{- range .Chapters}}
+    <itemref idref="{{.ID}}"/>
+{{- end}}
+  </spine>
+</package>
+`))
+
+var navTemplate = template.Must(template.New("nav").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{xml .Language}}" lang="{{xml .Language}}">
+<head>
+<meta charset="UTF-8"/>
+<title>{{xml .Title}}</title>
+</head>
+<body>
+<nav epub:type="toc" id="toc">
+<ol>
+{{- range .Chapters}}
+<li><a href="{{.Href}}">{{if .Title}}{{xml .Title}}{{else}}{{.ID}}{{end}}</a></li>
+{{- end}}
+</ol>
+</nav>
+</body>
+</html>
+`))
+
+var ncxTemplate = template.Must(template.New("ncx").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head>
+<meta name="dtb:uid" content="{{xml .Identifier}}"/>
+</head>
+<docTitle><text>{{xml .Title}}</text></docTitle>
+<navMap>
+{{- range .Chapters}}
+<navPoint id="nav-{{.ID}}" playOrder="{{.Order}}"><navLabel><text>{{if .Title}}{{xml .Title}}{{else}}{{.ID}}{{end}}</text></navLabel><content src="{{.Href}}"/></navPoint>
+{{- end}}
+</navMap>
+</ncx>
+`))
+
+var chapterTemplate = template.Must(template.New("chapter").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{xml .Language}}" lang="{{xml .Language}}">
+<head>
+<meta charset="UTF-8"/>
+<title>{{xml .Title}}</title>
+<link rel="stylesheet" type="text/css" href="../style.css"/>
+</head>
+<body>
+{{.Body}}
+</body>
+</html>
+`))
@@ -0,0 +1,149 @@
+package format
+
+// Default is the registry of formats used by bookshelf. Custom formats
+// added by administrators are registered into it at runtime.
+var Default = NewRegistry()
+
+func init() {
+	for _, f := range builtinFormats() {
+		f.Builtin = true
+		if err := Default.Register(f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func builtinFormats() []Format {
+	return []Format{
+		{
+			Alias:           "azw",
+			Mime:            "application/vnd.amazon.ebook",
+			Extensions:      []string{".azw"},
+			ExtractMetadata: extractMOBIMetadata,
+			ExtractCover:    extractMOBICover,
+			Detect:          detectMOBI,
+			Validate:        validateMOBI,
+		},
+		{
+			Alias:           "azw3",
+			Mime:            "application/x-mobi8-ebook",
+			Extensions:      []string{".azw3"},
+			ExtractMetadata: extractMOBIMetadata,
+			ExtractCover:    extractMOBICover,
+			Detect:          detectMOBI,
+			Validate:        validateMOBI,
+		},
+		{
+			Alias:        "cb7",
+			Mime:         "application/x-cb7",
+			Extensions:   []string{".cb7"},
+			ExtractCover: extractExternalComicCover,
+			Detect:       detectCB7,
+		},
+		{
+			Alias:        "cbr",
+			Mime:         "application/vnd.comicbook-rar",
+			Extensions:   []string{".cbr"},
+			ExtractCover: extractExternalComicCover,
+			Detect:       detectCBR,
+		},
+		{
+			Alias:        "cbz",
+			Mime:         "application/vnd.comicbook+zip",
+			Extensions:   []string{".cbz"},
+			ExtractCover: extractZipComicCover,
+			Detect:       detectCBZ,
+			Validate:     validateCBZ,
+			generic:      true,
+		},
+		{
+			Alias:      "djvu",
+			Mime:       "image/vnd.djvu",
+			Extensions: []string{".djvu", ".djv"},
+			Detect:     detectDJVU,
+			Validate:   validateDJVU,
+		},
+		{
+			Alias:           "docx",
+			Mime:            "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			Extensions:      []string{".docx"},
+			ExtractMetadata: extractDOCXMetadata,
+			Detect:          detectDOCX,
+			Validate:        validateZip,
+		},
+		{
+			Alias:           "epub",
+			Mime:            "application/epub+zip",
+			Extensions:      []string{".epub"},
+			ExtractMetadata: extractEPUBMetadata,
+			ExtractCover:    extractEPUBCover,
+			Detect:          detectEPUB,
+			Validate:        validateEPUB,
+		},
+		{
+			Alias:           "fb2",
+			Mime:            "application/fb2+zip",
+			Extensions:      []string{".fb2", ".fb2.zip"},
+			ExtractMetadata: extractFB2Metadata,
+			ExtractCover:    extractFB2Cover,
+			Detect:          detectFB2,
+			Validate:        validateFB2,
+		},
+		{
+			Alias:           "html",
+			Mime:            "text/html",
+			Extensions:      []string{".html", ".htm", ".xhtml"},
+			ExtractMetadata: extractHTMLMetadata,
+			Detect:          detectHTML,
+		},
+		{
+			Alias:           "kepub",
+			Mime:            "application/kepub+zip",
+			Extensions:      []string{".kepub.epub", ".kepub"},
+			ExtractMetadata: extractEPUBMetadata,
+			ExtractCover:    extractEPUBCover,
+			Detect:          detectEPUB,
+			Validate:        validateEPUB,
+		},
+		{
+			Alias:           "md",
+			Mime:            "text/markdown",
+			Extensions:      []string{".md", ".markdown"},
+			ExtractMetadata: extractMarkdownMetadata,
+			Detect:          detectText,
+			textual:         true,
+		},
+		{
+			Alias:           "mobi",
+			Mime:            "application/x-mobipocket-ebook",
+			Extensions:      []string{".mobi", ".prc"},
+			ExtractMetadata: extractMOBIMetadata,
+			ExtractCover:    extractMOBICover,
+			Detect:          detectMOBI,
+			Validate:        validateMOBI,
+		},
+		{
+			Alias:           "pdf",
+			Mime:            "application/pdf",
+			Extensions:      []string{".pdf"},
+			ExtractMetadata: extractPDFMetadata,
+			Detect:          detectPDF,
+			Validate:        validatePDF,
+		},
+		{
+			Alias:           "rtf",
+			Mime:            "application/rtf",
+			Extensions:      []string{".rtf"},
+			ExtractMetadata: extractRTFMetadata,
+			Detect:          detectRTF,
+			Validate:        validateRTF,
+		},
+		{
+			Alias:      "txt",
+			Mime:       "text/plain",
+			Extensions: []string{".txt"},
+			Detect:     detectText,
+			textual:    true,
+		},
+	}
+}
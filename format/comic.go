@@ -0,0 +1,52 @@
+package format
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/altescy/bookshelf/comic"
+)
+
+func extractZipComicCover(r io.ReaderAt, size int64) ([]byte, string, error) {
+	archive, err := comic.OpenZip(r, size)
+	if err != nil {
+		return nil, "", err
+	}
+	defer archive.Close()
+	return readFirstPage(archive)
+}
+
+func extractExternalComicCover(r io.ReaderAt, size int64) ([]byte, string, error) {
+	if !comic.IsExternalAvailable() {
+		return nil, "", comic.ErrUnsupportedArchive
+	}
+
+	path, cleanup, err := comic.TempFile(func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(r, 0, size))
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	archive, err := comic.OpenExternal(path, cleanup)
+	if err != nil {
+		return nil, "", err
+	}
+	defer archive.Close()
+	return readFirstPage(archive)
+}
+
+func readFirstPage(archive comic.Archive) ([]byte, string, error) {
+	rc, imageType, err := comic.OpenPage(archive, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, imageType, nil
+}
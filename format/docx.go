@@ -0,0 +1,54 @@
+package format
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// extractDOCXMetadata reads the core properties of an Office Open XML
+// document.
+func extractDOCXMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		if f.Name != "docProps/core.xml" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		core := struct {
+			Title       string `xml:"title"`
+			Creator     string `xml:"creator"`
+			Description string `xml:"description"`
+			Created     string `xml:"created"`
+			Language    string `xml:"language"`
+		}{}
+		if err := xml.NewDecoder(rc).Decode(&core); err != nil {
+			return nil, err
+		}
+
+		date := strings.TrimSpace(core.Created)
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		return &Metadata{
+			Title:       strings.TrimSpace(core.Title),
+			Author:      strings.TrimSpace(core.Creator),
+			PubDate:     date,
+			Description: strings.TrimSpace(core.Description),
+			Language:    strings.TrimSpace(core.Language),
+		}, nil
+	}
+
+	return &Metadata{}, nil
+}
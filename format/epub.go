@@ -0,0 +1,49 @@
+package format
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/altescy/bookshelf/epub"
+)
+
+func extractEPUBMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	book, err := epub.Open(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	md := book.Metadata
+	return &Metadata{
+		Title:       md.Title,
+		Author:      strings.Join(md.Authors, ", "),
+		Publisher:   md.Publisher,
+		PubDate:     md.Date,
+		Description: md.Description,
+		ISBN:        findISBN(md.Identifiers...),
+		Language:    md.Language,
+	}, nil
+}
+
+func extractEPUBCover(r io.ReaderAt, size int64) ([]byte, string, error) {
+	book, err := epub.Open(r, size)
+	if err != nil {
+		return nil, "", err
+	}
+	if book.Metadata.Cover == "" {
+		return nil, "", ErrNoCover
+	}
+
+	rc, err := book.Open(book.Metadata.Cover)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, book.MediaType(book.Metadata.Cover), nil
+}
@@ -0,0 +1,187 @@
+package format
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"path"
+	"strings"
+)
+
+type fb2Author struct {
+	FirstName  string `xml:"first-name"`
+	MiddleName string `xml:"middle-name"`
+	LastName   string `xml:"last-name"`
+	Nickname   string `xml:"nickname"`
+}
+
+func (a fb2Author) String() string {
+	name := strings.Join(strings.Fields(a.FirstName+" "+a.MiddleName+" "+a.LastName), " ")
+	if name == "" {
+		name = strings.TrimSpace(a.Nickname)
+	}
+	return name
+}
+
+type fb2Description struct {
+	TitleInfo struct {
+		Authors    []fb2Author `xml:"author"`
+		BookTitle  string      `xml:"book-title"`
+		Annotation struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"annotation"`
+		Date  string `xml:"date"`
+		Lang  string `xml:"lang"`
+		Cover struct {
+			Images []struct {
+				Attrs []xml.Attr `xml:",any,attr"`
+			} `xml:"image"`
+		} `xml:"coverpage"`
+	} `xml:"title-info"`
+	PublishInfo struct {
+		Publisher string `xml:"publisher"`
+		Year      string `xml:"year"`
+		ISBN      string `xml:"isbn"`
+	} `xml:"publish-info"`
+}
+
+// OpenFB2 returns the FictionBook XML, which may be wrapped in a zip
+// archive as in .fb2.zip files.
+func OpenFB2(r io.ReaderAt, size int64) (io.Reader, error) {
+	head := make([]byte, 4)
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(head, []byte("PK\x03\x04")) {
+		return io.NewSectionReader(r, 0, size), nil
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if strings.EqualFold(path.Ext(f.Name), ".fb2") {
+			return f.Open()
+		}
+	}
+	return nil, ErrInvalidFormat
+}
+
+func newFB2Decoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return d
+}
+
+func readFB2Description(r io.ReaderAt, size int64) (*fb2Description, *xml.Decoder, error) {
+	fr, err := OpenFB2(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := newFB2Decoder(fr)
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == "description" {
+			desc := &fb2Description{}
+			if err := d.DecodeElement(desc, &se); err != nil {
+				return nil, nil, err
+			}
+			return desc, d, nil
+		}
+	}
+}
+
+func extractFB2Metadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	desc, _, err := readFB2Description(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	ti, pi := desc.TitleInfo, desc.PublishInfo
+	authors := []string{}
+	for _, a := range ti.Authors {
+		if name := a.String(); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	date := strings.TrimSpace(ti.Date)
+	if date == "" {
+		date = strings.TrimSpace(pi.Year)
+	}
+
+	return &Metadata{
+		Title:       strings.TrimSpace(ti.BookTitle),
+		Author:      strings.Join(authors, ", "),
+		Publisher:   strings.TrimSpace(pi.Publisher),
+		PubDate:     date,
+		Description: strings.TrimSpace(tagPattern.ReplaceAllString(ti.Annotation.Inner, "")),
+		ISBN:        findISBN(pi.ISBN),
+		Language:    strings.TrimSpace(ti.Lang),
+	}, nil
+}
+
+// extractFB2Cover decodes the binary referenced by the coverpage image.
+func extractFB2Cover(r io.ReaderAt, size int64) ([]byte, string, error) {
+	desc, d, err := readFB2Description(r, size)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id := ""
+	for _, image := range desc.TitleInfo.Cover.Images {
+		for _, attr := range image.Attrs {
+			if attr.Name.Local == "href" {
+				id = strings.TrimPrefix(attr.Value, "#")
+			}
+		}
+	}
+	if id == "" {
+		return nil, "", ErrNoCover
+	}
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil, "", ErrNoCover
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "binary" || attrValue(se, "id") != id {
+			continue
+		}
+
+		binary := struct {
+			ContentType string `xml:"content-type,attr"`
+			Data        string `xml:",chardata"`
+		}{}
+		if err := d.DecodeElement(&binary, &se); err != nil {
+			return nil, "", err
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(binary.Data), ""))
+		if err != nil {
+			return nil, "", err
+		}
+		return b, binary.ContentType, nil
+	}
+}
+
+func attrValue(se xml.StartElement, name string) string {
+	for _, attr := range se.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,240 @@
+package format
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrFormatConflict = errors.New("format conflict")
+	ErrFormatNotFound = errors.New("format not found")
+	ErrInvalidFormat  = errors.New("invalid format")
+	ErrBuiltinFormat  = errors.New("builtin format cannot be removed")
+	ErrNoCover        = errors.New("cover not found")
+)
+
+// Metadata is bibliographic information extracted from a file.
+type Metadata struct {
+	Title       string
+	Author      string
+	Publisher   string
+	PubDate     string
+	Description string
+	ISBN        string
+	Language    string
+}
+
+type (
+	// MetadataExtractor reads bibliographic information of a file.
+	MetadataExtractor func(r io.ReaderAt, size int64) (*Metadata, error)
+	// CoverExtractor reads a cover image of a file and returns its MIME type.
+	CoverExtractor func(r io.ReaderAt, size int64) ([]byte, string, error)
+	// Detector reports whether the content of a file looks like the format,
+	// usually by its magic bytes.
+	Detector func(r io.ReaderAt, size int64) bool
+	// Validator checks that the structure of a file is not broken.
+	Validator func(r io.ReaderAt, size int64) error
+)
+
+// Format is a file format which can be stored in bookshelf.
+type Format struct {
+	// Alias is a short name of the format used in URLs like /file/:ext.
+	Alias string `json:"Alias"`
+	Mime  string `json:"MimeType"`
+	// Extensions are lower-case filename suffixes including the leading
+	// dot. Multi-part suffixes like ".kepub.epub" are allowed.
+	Extensions []string `json:"Extensions"`
+	Builtin    bool     `json:"Builtin"`
+
+	ExtractMetadata MetadataExtractor `json:"-"`
+	ExtractCover    CoverExtractor    `json:"-"`
+	Detect          Detector          `json:"-"`
+	Validate        Validator         `json:"-"`
+
+	// textual formats have no magic bytes and are not used for sniffing
+	textual bool
+	// generic formats match containers of other formats, like any ZIP
+	// archive of images, and are sniffed after the other formats
+	generic bool
+}
+
+// Registry holds known formats. It is safe for concurrent use because
+// custom formats can be registered while the server is running.
+type Registry struct {
+	mu      sync.RWMutex
+	formats map[string]*Format
+	byExt   map[string]*Format
+	byMime  map[string]*Format
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		formats: map[string]*Format{},
+		byExt:   map[string]*Format{},
+		byMime:  map[string]*Format{},
+	}
+}
+
+// Register adds a new format. The alias, MIME type and extensions must not
+// be used by other formats.
+func (r *Registry) Register(f Format) error {
+	f.Alias = strings.ToLower(strings.TrimSpace(f.Alias))
+	f.Mime = strings.ToLower(strings.TrimSpace(f.Mime))
+	if f.Alias == "" || f.Mime == "" || strings.ContainsAny(f.Alias, "./ ") {
+		return ErrInvalidFormat
+	}
+
+	exts := []string{}
+	for _, ext := range f.Extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	if len(exts) == 0 {
+		exts = append(exts, "."+f.Alias)
+	}
+	f.Extensions = exts
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.formats[f.Alias]; ok {
+		return ErrFormatConflict
+	}
+	if _, ok := r.byMime[f.Mime]; ok {
+		return ErrFormatConflict
+	}
+	for _, ext := range f.Extensions {
+		if _, ok := r.byExt[ext]; ok {
+			return ErrFormatConflict
+		}
+	}
+
+	r.formats[f.Alias] = &f
+	r.byMime[f.Mime] = &f
+	for _, ext := range f.Extensions {
+		r.byExt[ext] = &f
+	}
+	return nil
+}
+
+// Unregister removes a custom format.
+func (r *Registry) Unregister(alias string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.formats[alias]
+	if !ok {
+		return ErrFormatNotFound
+	}
+	if f.Builtin {
+		return ErrBuiltinFormat
+	}
+
+	delete(r.formats, f.Alias)
+	delete(r.byMime, f.Mime)
+	for _, ext := range f.Extensions {
+		delete(r.byExt, ext)
+	}
+	return nil
+}
+
+func (r *Registry) ByAlias(alias string) (*Format, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.formats[strings.ToLower(alias)]
+	if !ok {
+		return nil, ErrFormatNotFound
+	}
+	return f, nil
+}
+
+func (r *Registry) ByMime(mime string) (*Format, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	f, ok := r.byMime[strings.ToLower(mime)]
+	if !ok {
+		return nil, ErrFormatNotFound
+	}
+	return f, nil
+}
+
+// ByExt finds a format by an extension or, for URLs, by an alias
+// prefixed with a dot.
+func (r *Registry) ByExt(ext string) (*Format, error) {
+	ext = strings.ToLower(ext)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if f, ok := r.byExt[ext]; ok {
+		return f, nil
+	}
+	if f, ok := r.formats[strings.TrimPrefix(ext, ".")]; ok {
+		return f, nil
+	}
+	return nil, ErrFormatNotFound
+}
+
+// ByFilename finds a format by the longest registered suffix of the name.
+func (r *Registry) ByFilename(filename string) (*Format, error) {
+	name := strings.ToLower(filepath.Base(filename))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found *Format
+	longest := 0
+	for ext, f := range r.byExt {
+		if len(ext) > longest && strings.HasSuffix(name, ext) {
+			found = f
+			longest = len(ext)
+		}
+	}
+	if found == nil {
+		return nil, ErrFormatNotFound
+	}
+	return found, nil
+}
+
+// Formats returns all formats sorted by alias.
+func (r *Registry) Formats() []Format {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	formats := make([]Format, 0, len(r.formats))
+	for _, f := range r.formats {
+		formats = append(formats, *f)
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		return formats[i].Alias < formats[j].Alias
+	})
+	return formats
+}
+
+// findISBN returns the first value which looks like an ISBN, removing
+// prefixes like "urn:isbn:" and hyphens.
+func findISBN(values ...string) string {
+	for _, v := range values {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		v = strings.TrimPrefix(v, "URN:ISBN:")
+		v = strings.TrimPrefix(v, "ISBN")
+		v = strings.TrimLeft(v, ": ")
+		v = strings.NewReplacer("-", "", " ", "").Replace(v)
+		if (len(v) == 10 || len(v) == 13) && strings.Trim(v, "0123456789X") == "" {
+			return v
+		}
+	}
+	return ""
+}
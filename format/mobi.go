@@ -0,0 +1,198 @@
+package format
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidMOBI = errors.New("invalid mobi file")
+
+// EXTH record types
+const (
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthISBN        = 104
+	exthPubDate     = 106
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+type mobiFile struct {
+	r       io.ReaderAt
+	size    int64
+	records []uint32
+
+	title      string
+	encoding   uint32
+	firstImage uint32
+	exth       map[uint32][][]byte
+}
+
+// readMOBI parses the PalmDB header, the MOBI header in record 0 and
+// the EXTH header following it, which is shared by MOBI, AZW and AZW3.
+func readMOBI(r io.ReaderAt, size int64) (*mobiFile, error) {
+	header := make([]byte, 78)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errInvalidMOBI
+	}
+	if string(header[60:68]) != "BOOKMOBI" {
+		return nil, errInvalidMOBI
+	}
+
+	n := int(binary.BigEndian.Uint16(header[76:78]))
+	if n == 0 || int64(78+8*n) > size {
+		return nil, errInvalidMOBI
+	}
+	info := make([]byte, 8*n)
+	if _, err := r.ReadAt(info, 78); err != nil {
+		return nil, errInvalidMOBI
+	}
+
+	m := &mobiFile{r: r, size: size, exth: map[uint32][][]byte{}}
+	for i := 0; i < n; i++ {
+		m.records = append(m.records, binary.BigEndian.Uint32(info[8*i:]))
+	}
+
+	record0, err := m.record(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(record0) < 0x84 || string(record0[16:20]) != "MOBI" {
+		return nil, errInvalidMOBI
+	}
+
+	be := binary.BigEndian
+	headerLength := be.Uint32(record0[0x14:])
+	m.encoding = be.Uint32(record0[0x1C:])
+	nameOffset, nameLength := be.Uint32(record0[0x54:]), be.Uint32(record0[0x58:])
+	m.firstImage = be.Uint32(record0[0x6C:])
+	exthFlags := be.Uint32(record0[0x80:])
+
+	if end := uint64(nameOffset) + uint64(nameLength); end <= uint64(len(record0)) {
+		m.title = m.decode(record0[nameOffset:end])
+	}
+
+	exthOffset := 16 + uint64(headerLength)
+	if exthFlags&0x40 != 0 && exthOffset+12 <= uint64(len(record0)) && string(record0[exthOffset:exthOffset+4]) == "EXTH" {
+		count := be.Uint32(record0[exthOffset+8:])
+		p := exthOffset + 12
+		for i := uint32(0); i < count && p+8 <= uint64(len(record0)); i++ {
+			typ, length := be.Uint32(record0[p:]), uint64(be.Uint32(record0[p+4:]))
+			if length < 8 || p+length > uint64(len(record0)) {
+				break
+			}
+			m.exth[typ] = append(m.exth[typ], record0[p+8:p+length])
+			p += length
+		}
+	}
+
+	return m, nil
+}
+
+func (m *mobiFile) record(i int) ([]byte, error) {
+	if i >= len(m.records) {
+		return nil, errInvalidMOBI
+	}
+	start := int64(m.records[i])
+	end := m.size
+	if i+1 < len(m.records) {
+		end = int64(m.records[i+1])
+	}
+	if start >= end || end > m.size {
+		return nil, errInvalidMOBI
+	}
+
+	b := make([]byte, end-start)
+	if _, err := m.r.ReadAt(b, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (m *mobiFile) decode(b []byte) string {
+	if m.encoding == 65001 || utf8.Valid(b) {
+		return strings.TrimSpace(string(b))
+	}
+	return strings.TrimSpace(decodeCP1252(b))
+}
+
+func (m *mobiFile) exthString(typ uint32) string {
+	values := []string{}
+	for _, v := range m.exth[typ] {
+		values = append(values, m.decode(v))
+	}
+	return strings.Join(values, ", ")
+}
+
+func extractMOBIMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	m, err := readMOBI(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	title := m.exthString(exthTitle)
+	if title == "" {
+		title = m.title
+	}
+	return &Metadata{
+		Title:       title,
+		Author:      m.exthString(exthAuthor),
+		Publisher:   m.exthString(exthPublisher),
+		PubDate:     m.exthString(exthPubDate),
+		Description: m.exthString(exthDescription),
+		ISBN:        findISBN(m.exthString(exthISBN)),
+		Language:    m.exthString(exthLanguage),
+	}, nil
+}
+
+func extractMOBICover(r io.ReaderAt, size int64) ([]byte, string, error) {
+	m, err := readMOBI(r, size)
+	if err != nil {
+		return nil, "", err
+	}
+
+	values := m.exth[exthCoverOffset]
+	if len(values) == 0 || len(values[0]) < 4 || m.firstImage == 0xFFFFFFFF {
+		return nil, "", ErrNoCover
+	}
+
+	index := uint64(m.firstImage) + uint64(binary.BigEndian.Uint32(values[0]))
+	if index >= uint64(len(m.records)) {
+		return nil, "", ErrNoCover
+	}
+	b, err := m.record(int(index))
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := http.DetectContentType(b)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", ErrNoCover
+	}
+	return b, contentType, nil
+}
+
+// cp1252 maps the bytes 0x80-0x9F of Windows-1252 which differ from Latin-1.
+var cp1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+func decodeCP1252(b []byte) string {
+	sb := strings.Builder{}
+	for _, c := range b {
+		switch {
+		case c >= 0x80 && c < 0xA0:
+			sb.WriteRune(cp1252[c-0x80])
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,117 @@
+package format
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// pdfScanSize is the size of the head and tail of a PDF scanned for the
+// document information dictionary, which is usually near either end.
+const pdfScanSize = 1 << 20
+
+var pdfInfoPattern = regexp.MustCompile(`/(Title|Author|Subject)\s*(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)`)
+
+// extractPDFMetadata reads the document information dictionary. Values in
+// compressed object streams cannot be found without a full PDF parser and
+// are left empty.
+func extractPDFMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	md := &Metadata{}
+
+	for _, offset := range []int64{0, size - pdfScanSize} {
+		if offset < 0 {
+			offset = 0
+		}
+		b := make([]byte, pdfScanSize)
+		n, err := r.ReadAt(b, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for _, m := range pdfInfoPattern.FindAllSubmatch(b[:n], -1) {
+			value := decodePDFString(m[2])
+			switch string(m[1]) {
+			case "Title":
+				if md.Title == "" {
+					md.Title = value
+				}
+			case "Author":
+				if md.Author == "" {
+					md.Author = value
+				}
+			case "Subject":
+				if md.Description == "" {
+					md.Description = value
+				}
+			}
+		}
+	}
+
+	return md, nil
+}
+
+func decodePDFString(b []byte) string {
+	var raw []byte
+	if b[0] == '<' {
+		s := strings.Join(strings.Fields(string(b[1:len(b)-1])), "")
+		if len(s)%2 == 1 {
+			s += "0"
+		}
+		raw, _ = hex.DecodeString(s)
+	} else {
+		raw = unescapePDFLiteral(b[1 : len(b)-1])
+	}
+
+	if bytes.HasPrefix(raw, []byte{0xFE, 0xFF}) {
+		u := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			u = append(u, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	if utf8.Valid(raw) {
+		return strings.TrimSpace(string(raw))
+	}
+	return strings.TrimSpace(decodeCP1252(raw))
+}
+
+func unescapePDFLiteral(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' || i+1 == len(b) {
+			out = append(out, b[i])
+			continue
+		}
+		i++
+		switch c := b[i]; c {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case '\n':
+		default:
+			if c >= '0' && c <= '7' {
+				v := 0
+				j := i
+				for ; j < len(b) && j < i+3 && b[j] >= '0' && b[j] <= '7'; j++ {
+					v = v*8 + int(b[j]-'0')
+				}
+				out = append(out, byte(v))
+				i = j - 1
+			} else {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
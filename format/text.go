@@ -0,0 +1,132 @@
+package format
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// textScanSize limits how much of a text document is read for metadata.
+const textScanSize = 64 * 1024
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func extractHTMLMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	d := xml.NewDecoder(io.NewSectionReader(r, 0, textScanSize))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	md := &Metadata{}
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(se.Name.Local) {
+		case "html":
+			md.Language = attrValue(se, "lang")
+		case "title":
+			title := ""
+			if err := d.DecodeElement(&title, &se); err == nil {
+				md.Title = strings.TrimSpace(title)
+			}
+		case "meta":
+			content := strings.TrimSpace(attrValue(se, "content"))
+			switch strings.ToLower(attrValue(se, "name")) {
+			case "author", "dc.creator":
+				md.Author = content
+			case "description", "dc.description":
+				md.Description = content
+			case "dc.publisher":
+				md.Publisher = content
+			case "dc.date":
+				md.PubDate = content
+			}
+		case "body":
+			return md, nil
+		}
+	}
+	return md, nil
+}
+
+// extractMarkdownMetadata reads a YAML front matter if present, or takes
+// the first level-1 heading as the title.
+func extractMarkdownMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	md := &Metadata{}
+	scanner := bufio.NewScanner(io.NewSectionReader(r, 0, textScanSize))
+
+	inFrontMatter := false
+	for lineno := 0; scanner.Scan(); lineno++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case lineno == 0 && line == "---":
+			inFrontMatter = true
+		case inFrontMatter && line == "---":
+			inFrontMatter = false
+		case inFrontMatter:
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "title":
+				md.Title = value
+			case "author":
+				md.Author = value
+			case "date":
+				md.PubDate = value
+			case "description":
+				md.Description = value
+			case "publisher":
+				md.Publisher = value
+			case "lang", "language":
+				md.Language = value
+			case "isbn":
+				md.ISBN = findISBN(value)
+			}
+		case md.Title == "" && strings.HasPrefix(line, "# "):
+			md.Title = strings.TrimSpace(strings.TrimPrefix(line, "# "))
+			return md, nil
+		}
+	}
+	return md, nil
+}
+
+var rtfInfoPattern = regexp.MustCompile(`\{\\(title|author|subject|company)\s+((?:\\[{}]|[^{}])*)\}`)
+
+// extractRTFMetadata reads the \info group of an RTF document.
+func extractRTFMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	b := make([]byte, textScanSize)
+	n, err := r.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	md := &Metadata{}
+	for _, m := range rtfInfoPattern.FindAllSubmatch(b[:n], -1) {
+		value := strings.TrimSpace(decodeCP1252(m[2]))
+		switch string(m[1]) {
+		case "title":
+			md.Title = value
+		case "author":
+			md.Author = value
+		case "subject":
+			md.Description = value
+		case "company":
+			md.Publisher = value
+		}
+	}
+	return md, nil
+}
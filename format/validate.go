@@ -0,0 +1,351 @@
+package format
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/altescy/bookshelf/comic"
+	"github.com/altescy/bookshelf/epub"
+)
+
+var (
+	ErrContentMismatch = errors.New("content does not match the format")
+	ErrCorrupted       = errors.New("corrupted file")
+)
+
+// sniffSize is the size of the head of a file read for magic bytes.
+const sniffSize = 1024
+
+// Check sniffs the content of a file and validates its structure. It
+// returns ErrContentMismatch if the file looks like another format and
+// ErrCorrupted if it is broken, wrapped with details.
+func (f *Format) Check(r io.ReaderAt, size int64) error {
+	if f.Detect != nil && !f.Detect(r, size) {
+		if detected := Default.Sniff(r, size); detected != nil {
+			return fmt.Errorf("%w: expected %s but got %s", ErrContentMismatch, f.Alias, detected.Alias)
+		}
+		return fmt.Errorf("%w: expected %s", ErrContentMismatch, f.Alias)
+	}
+	if f.Validate != nil {
+		if err := f.Validate(r, size); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupted, f.Alias, err)
+		}
+	}
+	return nil
+}
+
+// Sniff finds a format by the content of a file. Formats without magic
+// bytes like plain text are not considered, and specific formats like EPUB
+// are preferred to the generic ones like CBZ which they also look like.
+func (r *Registry) Sniff(ra io.ReaderAt, size int64) *Format {
+	formats := r.Formats()
+	for _, generic := range []bool{false, true} {
+		for _, f := range formats {
+			if f.Detect != nil && !f.textual && f.generic == generic && f.Detect(ra, size) {
+				return &f
+			}
+		}
+	}
+	return nil
+}
+
+func readHead(r io.ReaderAt, size int64) []byte {
+	n := int64(sniffSize)
+	if size < n {
+		n = size
+	}
+	b := make([]byte, n)
+	n2, _ := r.ReadAt(b, 0)
+	return b[:n2]
+}
+
+func hasMagic(magic string) Detector {
+	return func(r io.ReaderAt, size int64) bool {
+		return bytes.HasPrefix(readHead(r, size), []byte(magic))
+	}
+}
+
+func isZip(r io.ReaderAt, size int64) bool {
+	return bytes.HasPrefix(readHead(r, size), []byte("PK\x03\x04"))
+}
+
+// zipHasEntry detects zip based formats by a characteristic entry.
+func zipHasEntry(match func(name string) bool) Detector {
+	return func(r io.ReaderAt, size int64) bool {
+		if !isZip(r, size) {
+			return false
+		}
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			// a truncated archive is detected, and rejected by validation
+			return true
+		}
+		for _, f := range zr.File {
+			if match(f.Name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// epubMimetype is the content of the mimetype entry of EPUB containers.
+const epubMimetype = "application/epub+zip"
+
+// detectEPUB checks the mimetype entry which must be the first entry of an
+// EPUB container. Many EPUBs have extra fields or a compressed entry unlike
+// the specification, so the entry is read through the central directory, or
+// through its local header if the archive is truncated.
+func detectEPUB(r io.ReaderAt, size int64) bool {
+	if !isZip(r, size) {
+		return false
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return firstEntryIsEPUBMimetype(r, size)
+	}
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" {
+		return false
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	return hasEPUBMimetype(rc)
+}
+
+// firstEntryIsEPUBMimetype reads the mimetype entry by the local header at
+// the start of an archive.
+func firstEntryIsEPUBMimetype(r io.ReaderAt, size int64) bool {
+	head := readHead(r, size)
+	if len(head) < 30 {
+		return false
+	}
+	method := binary.LittleEndian.Uint16(head[8:10])
+	nameLen := int(binary.LittleEndian.Uint16(head[26:28]))
+	extraLen := int(binary.LittleEndian.Uint16(head[28:30]))
+	if len(head) < 30+nameLen || string(head[30:30+nameLen]) != "mimetype" {
+		return false
+	}
+
+	data := io.NewSectionReader(r, int64(30+nameLen+extraLen), size)
+	switch method {
+	case zip.Store:
+		return hasEPUBMimetype(data)
+	case zip.Deflate:
+		fr := flate.NewReader(data)
+		defer fr.Close()
+		return hasEPUBMimetype(fr)
+	}
+	return false
+}
+
+func hasEPUBMimetype(r io.Reader) bool {
+	b := make([]byte, len(epubMimetype))
+	_, err := io.ReadFull(r, b)
+	return err == nil && string(b) == epubMimetype
+}
+
+// detectPDF finds the header in the head of a file, where readers accept it
+// after leading garbage.
+func detectPDF(r io.ReaderAt, size int64) bool {
+	return bytes.Contains(readHead(r, size), []byte("%PDF-"))
+}
+
+func detectMOBI(r io.ReaderAt, size int64) bool {
+	head := readHead(r, size)
+	return len(head) >= 68 && string(head[60:68]) == "BOOKMOBI"
+}
+
+func detectDJVU(r io.ReaderAt, size int64) bool {
+	head := readHead(r, size)
+	return len(head) >= 16 && string(head[:8]) == "AT&TFORM" &&
+		(string(head[12:16]) == "DJVU" || string(head[12:16]) == "DJVM")
+}
+
+func detectFB2(r io.ReaderAt, size int64) bool {
+	if isZip(r, size) {
+		return zipHasEntry(func(name string) bool {
+			return strings.HasSuffix(strings.ToLower(name), ".fb2")
+		})(r, size)
+	}
+	return bytes.Contains(readHead(r, size), []byte("<FictionBook"))
+}
+
+func detectHTML(r io.ReaderAt, size int64) bool {
+	head := strings.ToLower(string(readHead(r, size)))
+	return strings.Contains(head, "<!doctype html") || strings.Contains(head, "<html")
+}
+
+// detectText accepts any content without NUL bytes, which covers UTF-8 and
+// legacy multi-byte encodings like Shift_JIS but rejects binaries.
+func detectText(r io.ReaderAt, size int64) bool {
+	head := readHead(r, size)
+	if bytes.HasPrefix(head, []byte{0xFF, 0xFE}) || bytes.HasPrefix(head, []byte{0xFE, 0xFF}) {
+		return true
+	}
+	return bytes.IndexByte(head, 0) < 0
+}
+
+var (
+	detectCBZ = zipHasEntry(func(name string) bool {
+		return comic.ImageType(name) != ""
+	})
+	detectDOCX = zipHasEntry(func(name string) bool {
+		return name == "word/document.xml"
+	})
+	detectCBR = hasMagic("Rar!\x1a\x07")
+	detectCB7 = hasMagic("7z\xbc\xaf\x27\x1c")
+	detectRTF = hasMagic(`{\rtf`)
+)
+
+func validateEPUB(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" {
+		return errors.New("mimetype entry not found")
+	}
+	if _, err := epub.Open(r, size); err != nil {
+		return err
+	}
+	return validateZipEntries(zr)
+}
+
+func validateZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	return validateZipEntries(zr)
+}
+
+// validateZipEntries reads all entries so that checksums are verified.
+func validateZipEntries(zr *zip.Reader) error {
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateCBZ(r io.ReaderAt, size int64) error {
+	if _, err := comic.OpenZip(r, size); err != nil {
+		return err
+	}
+	return validateZip(r, size)
+}
+
+// validatePDF checks the header and the trailer, which is missing if the
+// file is truncated.
+func validatePDF(r io.ReaderAt, size int64) error {
+	if !detectPDF(r, size) {
+		return errors.New("header not found")
+	}
+
+	n := int64(sniffSize)
+	if size < n {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := r.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return errors.New("trailer not found")
+	}
+	if !bytes.Contains(tail, []byte("startxref")) {
+		return errors.New("startxref not found")
+	}
+	return nil
+}
+
+// validateMOBI checks the PalmDB record table and the MOBI header.
+func validateMOBI(r io.ReaderAt, size int64) error {
+	m, err := readMOBI(r, size)
+	if err != nil {
+		return err
+	}
+	last := uint32(0)
+	for i, offset := range m.records {
+		if int64(offset) >= size || (i > 0 && offset < last) {
+			return fmt.Errorf("invalid offset of record %d", i)
+		}
+		last = offset
+	}
+	return nil
+}
+
+// validateFB2 checks that the FictionBook document is well-formed XML.
+func validateFB2(r io.ReaderAt, size int64) error {
+	fr, err := OpenFB2(r, size)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(fr)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	root := ""
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if se, ok := t.(xml.StartElement); ok && root == "" {
+			root = se.Name.Local
+		}
+	}
+	if root != "FictionBook" {
+		return errors.New("FictionBook element not found")
+	}
+	return nil
+}
+
+func validateRTF(r io.ReaderAt, size int64) error {
+	n := int64(sniffSize)
+	if size < n {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := r.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.HasSuffix(bytes.TrimRight(tail, " \t\r\n\x00"), []byte("}")) {
+		return errors.New("unterminated document")
+	}
+	return nil
+}
+
+func validateDJVU(r io.ReaderAt, size int64) error {
+	head := readHead(r, size)
+	if len(head) < 12 {
+		return errors.New("header not found")
+	}
+	// the FORM chunk length covers the rest of the file
+	if length := int64(binary.BigEndian.Uint32(head[8:12])); 12+length > size {
+		return errors.New("truncated file")
+	}
+	return nil
+}
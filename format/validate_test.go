@@ -0,0 +1,100 @@
+package format
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// buildEPUB writes an EPUB container whose mimetype entry is written by the
+// given header, like the various tools making EPUBs do.
+func buildEPUB(t *testing.T, mimetype *zip.FileHeader, images bool) []byte {
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	entries := []struct {
+		header *zip.FileHeader
+		body   string
+	}{
+		{mimetype, "application/epub+zip"},
+		{&zip.FileHeader{Name: "META-INF/container.xml", Method: zip.Deflate}, `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+		{&zip.FileHeader{Name: "content.opf", Method: zip.Deflate}, `<?xml version="1.0"?>
+<package version="3.0" xmlns="http://www.idpf.org/2007/opf">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Book</dc:title></metadata>
+  <manifest><item id="c1" href="c1.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="c1"/></spine>
+</package>`},
+		{&zip.FileHeader{Name: "c1.xhtml", Method: zip.Deflate}, `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>text</p></body></html>`},
+	}
+	if images {
+		entries = append(entries, struct {
+			header *zip.FileHeader
+			body   string
+		}{&zip.FileHeader{Name: "images/cover.jpg", Method: zip.Store}, "\xff\xd8\xff\xe0"})
+	}
+	for _, e := range entries {
+		w, err := zw.CreateHeader(e.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckEPUB(t *testing.T) {
+	epub, err := Default.ByAlias("epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		mimetype *zip.FileHeader
+	}{
+		{"stored", &zip.FileHeader{Name: "mimetype", Method: zip.Store}},
+		// zip -r compresses the entry and adds timestamps as an extra field
+		{"deflated", &zip.FileHeader{Name: "mimetype", Method: zip.Deflate}},
+		{"extra field", &zip.FileHeader{Name: "mimetype", Method: zip.Store, Extra: []byte{0x55, 0x54, 0x05, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := buildEPUB(t, c.mimetype, true)
+			if err := epub.Check(bytes.NewReader(b), int64(len(b))); err != nil {
+				t.Errorf("check: %v", err)
+			}
+			if f := Default.Sniff(bytes.NewReader(b), int64(len(b))); f == nil || f.Alias != "epub" {
+				t.Errorf("sniff: got %v", f)
+			}
+
+			// a truncated EPUB is detected and rejected as corrupted
+			truncated := b[:len(b)-40]
+			err := epub.Check(bytes.NewReader(truncated), int64(len(truncated)))
+			if !errors.Is(err, ErrCorrupted) {
+				t.Errorf("truncated: expected ErrCorrupted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckEPUBMismatch(t *testing.T) {
+	epub, err := Default.ByAlias("epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a comic archive is not taken for an EPUB
+	b := buildEPUB(t, &zip.FileHeader{Name: "images/000.jpg", Method: zip.Store}, false)
+	err = epub.Check(bytes.NewReader(b), int64(len(b)))
+	if !errors.Is(err, ErrContentMismatch) {
+		t.Errorf("expected ErrContentMismatch, got %v", err)
+	}
+}
@@ -11,4 +11,9 @@ require (
 	github.com/lib/pq v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/oklog/ulid v1.3.1
+	github.com/pkg/sftp v1.13.5
+	github.com/studio-b12/gowebdav v0.9.0
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/net v0.6.0
+	golang.org/x/text v0.13.0
 )
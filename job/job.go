@@ -0,0 +1,342 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/altescy/bookshelf/model"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultMaxAttempts = 3
+	pollInterval       = 5 * time.Second
+	backoffBase        = 10 * time.Second
+	backoffMax         = time.Hour
+)
+
+var (
+	ErrUnknownType   = errors.New("unknown job type")
+	ErrTypeConflict  = errors.New("job type conflict")
+	ErrNotCancelable = errors.New("job is not cancelable")
+)
+
+// Func runs a job. It should return early when ctx is canceled.
+type Func func(ctx context.Context, job *Job) error
+
+// Type is a kind of job run by a pool of workers.
+type Type struct {
+	Name string
+	Run  Func
+	// Workers is the number of jobs of this type run at once.
+	// Zero uses the default of the queue.
+	Workers int
+	// MaxAttempts is the number of attempts before a job fails.
+	// Zero uses the default of three attempts.
+	MaxAttempts int
+	// Canceled is called after a job is canceled, whether it was queued or
+	// running, e.g. to update records tracking the job. Optional.
+	Canceled func(job *Job)
+}
+
+// Job is a running job passed to a Func.
+type Job struct {
+	*model.Job
+	db *gorm.DB
+}
+
+// Decode unmarshals the payload of the job.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// SetProgress records how much of the job is done.
+func (j *Job) SetProgress(progress, total int) {
+	j.Progress, j.Total = progress, total
+	if err := model.UpdateJobProgress(j.db, j.ID, progress, total); err != nil {
+		log.Printf("[WARN] cannot update progress of job %d: %v", j.ID, err)
+	}
+}
+
+// WillRetry reports whether the job is attempted again after failing with
+// an error.
+func (j *Job) WillRetry(err error) bool {
+	var perm *permanentError
+	return err != nil && !errors.As(err, &perm) && j.Attempts < j.MaxAttempts
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error so that the job fails without retrying.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Queue runs jobs persisted in the database. Jobs left running when the
+// process stopped are queued again on Start.
+type Queue struct {
+	db      *gorm.DB
+	workers int
+
+	mu      sync.Mutex
+	types   map[string]*Type
+	wake    map[string]chan struct{}
+	cancels map[uint64]context.CancelFunc
+
+	// claims is held by workers while they claim jobs and register their
+	// cancel funcs, and by Cancel so that it finds claimed jobs running
+	claims sync.RWMutex
+}
+
+// NewQueue returns a queue running workers jobs of each type at once.
+func NewQueue(db *gorm.DB, workers int) *Queue {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Queue{
+		db:      db,
+		workers: workers,
+		types:   map[string]*Type{},
+		wake:    map[string]chan struct{}{},
+		cancels: map[uint64]context.CancelFunc{},
+	}
+}
+
+// Register adds a job type. Types have to be registered before Start.
+func (q *Queue) Register(t Type) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t.Name == "" || t.Run == nil {
+		return fmt.Errorf("invalid job type: %q", t.Name)
+	}
+	if _, ok := q.types[t.Name]; ok {
+		return ErrTypeConflict
+	}
+	if t.Workers <= 0 {
+		t.Workers = q.workers
+	}
+	if t.MaxAttempts <= 0 {
+		t.MaxAttempts = defaultMaxAttempts
+	}
+	q.types[t.Name] = &t
+	q.wake[t.Name] = make(chan struct{}, 1)
+	return nil
+}
+
+// Enqueue adds a job with a payload marshaled to JSON.
+func (q *Queue) Enqueue(jobType string, payload interface{}) (*model.Job, error) {
+	q.mu.Lock()
+	t, ok := q.types[jobType]
+	q.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownType
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := model.Job{
+		Type:        jobType,
+		Payload:     string(b),
+		MaxAttempts: t.MaxAttempts,
+	}
+	if err := model.AddJob(q.db, &job); err != nil {
+		return nil, err
+	}
+	q.notify(jobType)
+	return &job, nil
+}
+
+// Cancel cancels a queued or running job.
+func (q *Queue) Cancel(jobID uint64) error {
+	q.claims.Lock()
+	q.mu.Lock()
+	cancel, running := q.cancels[jobID]
+	q.mu.Unlock()
+	if running {
+		q.claims.Unlock()
+		cancel()
+		return nil
+	}
+
+	ok, err := model.CancelQueuedJob(q.db, jobID)
+	q.claims.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotCancelable
+	}
+
+	job, err := model.GetJob(q.db, jobID)
+	if err != nil {
+		log.Printf("[WARN] cannot get canceled job %d: %v", jobID, err)
+		return nil
+	}
+	q.mu.Lock()
+	t, ok := q.types[job.Type]
+	q.mu.Unlock()
+	if ok {
+		q.canceled(t, job)
+	}
+	return nil
+}
+
+// Start starts workers of registered types, which stop when ctx is done.
+func (q *Queue) Start(ctx context.Context) error {
+	if err := model.RequeueRunningJobs(q.db); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.types {
+		for i := 0; i < t.Workers; i++ {
+			go q.work(ctx, t, q.wake[t.Name])
+		}
+	}
+	return nil
+}
+
+func (q *Queue) notify(jobType string) {
+	q.mu.Lock()
+	wake := q.wake[jobType]
+	q.mu.Unlock()
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work(ctx context.Context, t *Type, wake chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, jobCtx, err := q.claim(ctx, t)
+			if err == model.ErrJobNotFound {
+				break
+			}
+			if err != nil {
+				log.Printf("[ERROR] cannot claim %s job: %v", t.Name, err)
+				break
+			}
+			q.run(ctx, jobCtx, t, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim claims a queued job and registers the cancel func of the context
+// it runs with, so that Cancel never sees a claimed job without it.
+func (q *Queue) claim(parent context.Context, t *Type) (*model.Job, context.Context, error) {
+	q.claims.RLock()
+	defer q.claims.RUnlock()
+
+	job, err := model.ClaimJob(q.db, t.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(parent)
+	q.mu.Lock()
+	q.cancels[job.ID] = cancel
+	q.mu.Unlock()
+	return job, ctx, nil
+}
+
+// run runs a claimed job with the context registered by claim.
+func (q *Queue) run(parent, ctx context.Context, t *Type, job *model.Job) {
+	defer func() {
+		q.mu.Lock()
+		cancel := q.cancels[job.ID]
+		delete(q.cancels, job.ID)
+		q.mu.Unlock()
+		cancel()
+	}()
+
+	err := q.call(ctx, t, &Job{Job: job, db: q.db})
+
+	var (
+		status = model.JobDone
+		runAt  time.Time
+		perm   *permanentError
+	)
+	switch {
+	case err == nil:
+	case parent.Err() != nil:
+		// the queue is stopping, so the job is run again on next start
+		status = model.JobQueued
+		runAt = time.Now()
+	case ctx.Err() != nil:
+		status = model.JobCanceled
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		status = model.JobFailed
+		log.Printf("[ERROR] %s job %d failed: %v", t.Name, job.ID, err)
+	default:
+		status = model.JobQueued
+		runAt = time.Now().Add(backoff(job.Attempts))
+		log.Printf("[WARN] %s job %d will be retried at %s: %v", t.Name, job.ID, runAt.Format(time.RFC3339), err)
+	}
+
+	if err := model.FinishJob(q.db, job, status, runAt, err); err != nil {
+		log.Printf("[ERROR] cannot update job %d: %v", job.ID, err)
+	}
+	if status == model.JobCanceled {
+		q.canceled(t, job)
+	}
+}
+
+func (q *Queue) canceled(t *Type, job *model.Job) {
+	if t.Canceled == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERROR] panic after canceling %s job %d: %v", t.Name, job.ID, r)
+		}
+	}()
+	t.Canceled(&Job{Job: job, db: q.db})
+}
+
+// call runs a job, turning a panic into an error so that a broken job does
+// not stop the worker.
+func (q *Queue) call(ctx context.Context, t *Type, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return t.Run(ctx, job)
+}
+
+// backoff returns the delay before an attempt, doubling from backoffBase.
+func backoff(attempts int) time.Duration {
+	d := backoffBase
+	for i := 1; i < attempts && d < backoffMax; i++ {
+		d *= 2
+	}
+	if d > backoffMax {
+		d = backoffMax
+	}
+	return d
+}
@@ -0,0 +1,162 @@
+package koreader
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const datetimeLayout = "2006-01-02 15:04:05"
+
+// Annotation is a highlight, note or bookmark found in a KOReader sidecar.
+type Annotation struct {
+	Kind     string
+	Chapter  string
+	Text     string
+	Note     string
+	Color    string
+	Pos0     string
+	Pos1     string
+	Page     int
+	Rect     *Rect
+	Datetime time.Time
+}
+
+// Rect is the area of a highlight on a page of a fixed layout document.
+type Rect struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+// Kinds of annotations.
+const (
+	KindHighlight = "highlight"
+	KindNote      = "note"
+	KindBookmark  = "bookmark"
+)
+
+// ReadAnnotations extracts annotations from a metadata.*.lua file.
+// Both the "annotations" list written by recent KOReader versions and the
+// older "bookmarks" list are supported.
+func ReadAnnotations(r io.Reader) ([]Annotation, error) {
+	table, err := ParseLuaTable(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if items, ok := table["annotations"].(map[interface{}]interface{}); ok {
+		return collectAnnotations(items, readAnnotation), nil
+	}
+	if items, ok := table["bookmarks"].(map[interface{}]interface{}); ok {
+		return collectAnnotations(items, readBookmark), nil
+	}
+	return []Annotation{}, nil
+}
+
+func collectAnnotations(items map[interface{}]interface{}, read func(map[interface{}]interface{}) Annotation) []Annotation {
+	keys := []float64{}
+	for k := range items {
+		if i, ok := k.(float64); ok {
+			keys = append(keys, i)
+		}
+	}
+	sort.Float64s(keys)
+
+	annotations := make([]Annotation, 0, len(keys))
+	for _, k := range keys {
+		if item, ok := items[k].(map[interface{}]interface{}); ok {
+			annotations = append(annotations, read(item))
+		}
+	}
+	return annotations
+}
+
+func readAnnotation(item map[interface{}]interface{}) Annotation {
+	a := readCommon(item)
+	a.Text = stringField(item, "text")
+	a.Note = stringField(item, "note")
+	a.Color = stringField(item, "color")
+	_, hasPos := item["pos0"]
+	switch {
+	case !hasPos:
+		a.Kind = KindBookmark
+	case a.Note != "":
+		a.Kind = KindNote
+	default:
+		a.Kind = KindHighlight
+	}
+	return a
+}
+
+func readBookmark(item map[interface{}]interface{}) Annotation {
+	a := readCommon(item)
+	highlighted, _ := item["highlighted"].(bool)
+	notes := stringField(item, "notes")
+	a.Text = stringField(item, "text")
+	switch {
+	case !highlighted:
+		a.Kind = KindBookmark
+		a.Note = notes
+	case notes != "" && notes != a.Text:
+		a.Kind = KindNote
+		a.Note = a.Text
+		a.Text = notes
+	default:
+		a.Kind = KindHighlight
+		a.Text = notes
+	}
+	return a
+}
+
+func readCommon(item map[interface{}]interface{}) Annotation {
+	a := Annotation{
+		Chapter: stringField(item, "chapter"),
+		Pos0:    stringField(item, "pos0"),
+		Pos1:    stringField(item, "pos1"),
+	}
+
+	// fixed layout documents store positions as {page, x, y} tables
+	pos0, ok0 := item["pos0"].(map[interface{}]interface{})
+	pos1, ok1 := item["pos1"].(map[interface{}]interface{})
+	if ok0 && ok1 {
+		x0, y0 := numberField(pos0, "x"), numberField(pos0, "y")
+		x1, y1 := numberField(pos1, "x"), numberField(pos1, "y")
+		a.Page = int(numberField(pos0, "page"))
+		a.Rect = &Rect{
+			X:      math.Min(x0, x1),
+			Y:      math.Min(y0, y1),
+			Width:  math.Abs(x1 - x0),
+			Height: math.Abs(y1 - y0),
+		}
+	}
+
+	switch page := item["page"].(type) {
+	case float64:
+		a.Page = int(page)
+	case string:
+		if a.Pos0 == "" {
+			a.Pos0 = page
+		}
+	}
+	if pageno, ok := item["pageno"].(float64); ok {
+		a.Page = int(pageno)
+	}
+
+	if t, err := time.ParseInLocation(datetimeLayout, stringField(item, "datetime"), time.Local); err == nil {
+		a.Datetime = t
+	}
+	return a
+}
+
+func stringField(item map[interface{}]interface{}, key string) string {
+	s, _ := item[key].(string)
+	return s
+}
+
+func numberField(item map[interface{}]interface{}, key string) float64 {
+	n, _ := item[key].(float64)
+	return n
+}
@@ -0,0 +1,46 @@
+package koreader
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+)
+
+const (
+	hashBlockSize = 1024
+	hashSteps     = 10
+)
+
+// PartialMD5Version is increased when hashes computed before are wrong, so
+// that stored hashes are computed again.
+const PartialMD5Version = 1
+
+// PartialMD5 computes the document hash used by KOReader to identify a book.
+// It hashes 1KiB blocks taken at exponentially growing offsets instead of
+// the whole file, so it is cheap even for large documents.
+func PartialMD5(r io.ReaderAt, size int64) (string, error) {
+	h := md5.New()
+	buf := make([]byte, hashBlockSize)
+
+	for i := -1; i <= hashSteps; i++ {
+		// KOReader computes lshift(1024, -2) for the first block, which
+		// LuaJIT evaluates to 0 because the shift count is taken modulo 32
+		var offset int64
+		if i < 0 {
+			offset = 0
+		} else {
+			offset = hashBlockSize << uint(2*i)
+		}
+		if offset >= size {
+			break
+		}
+
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		h.Write(buf[:n])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
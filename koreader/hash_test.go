@@ -0,0 +1,48 @@
+package koreader
+
+import (
+	"bytes"
+	"testing"
+)
+
+func hashFixture(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
+
+// The expected digests are computed by the partialMD5 loop of KOReader with
+// the 32-bit lshift of LuaJIT.
+func TestPartialMD5(t *testing.T) {
+	cases := []struct {
+		size     int
+		expected string
+	}{
+		{300000, "cdb5d632f29ff21c01725beabde70dd9"},
+		{1500, "3484b4e75da7d6b8b7edbf198f1fddf1"},
+	}
+	for _, c := range cases {
+		b := hashFixture(c.size)
+		actual, err := PartialMD5(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != c.expected {
+			t.Errorf("size %d: expected %s but got %s", c.size, c.expected, actual)
+		}
+	}
+}
+
+func TestPartialMD5HashesFirstBlock(t *testing.T) {
+	a := hashFixture(10000)
+	b := hashFixture(10000)
+	b[0]++
+
+	hashA, _ := PartialMD5(bytes.NewReader(a), int64(len(a)))
+	hashB, _ := PartialMD5(bytes.NewReader(b), int64(len(b)))
+	if hashA == hashB {
+		t.Error("the first byte is not hashed")
+	}
+}
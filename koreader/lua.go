@@ -0,0 +1,304 @@
+package koreader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidLuaTable = errors.New("invalid lua table")
+
+// ParseLuaTable parses the `return { ... }` literal which KOReader writes
+// into metadata.*.lua files of .sdr directories. Tables are returned as
+// map[interface{}]interface{} whose keys are strings or float64.
+func ParseLuaTable(r io.Reader) (map[interface{}]interface{}, error) {
+	p := &luaParser{r: bufio.NewReader(r)}
+
+	p.skipSpace()
+	if p.peekWord() == "return" {
+		p.readWord()
+	}
+
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrInvalidLuaTable
+	}
+	return table, nil
+}
+
+type luaParser struct {
+	r *bufio.Reader
+}
+
+func (p *luaParser) peek() (rune, error) {
+	c, _, err := p.r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	return c, p.r.UnreadRune()
+}
+
+func (p *luaParser) skipSpace() {
+	for {
+		c, err := p.peek()
+		if err != nil {
+			return
+		}
+		switch {
+		case unicode.IsSpace(c):
+			p.r.ReadRune()
+		case c == '-':
+			b, _ := p.r.Peek(2)
+			if string(b) != "--" {
+				return
+			}
+			p.r.ReadString('\n')
+		default:
+			return
+		}
+	}
+}
+
+// peekWord returns the Lua identifier or keyword at the current position,
+// which is a letter or underscore followed by letters, digits and
+// underscores.
+func (p *luaParser) peekWord() string {
+	n := 0
+	for {
+		b, _ := p.r.Peek(n + 1)
+		if len(b) <= n || !isWordByte(b[n], n == 0) {
+			break
+		}
+		n++
+	}
+	b, _ := p.r.Peek(n)
+	return string(b)
+}
+
+func isWordByte(c byte, first bool) bool {
+	switch {
+	case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return true
+	case '0' <= c && c <= '9':
+		return !first
+	}
+	return false
+}
+
+func (p *luaParser) readWord() string {
+	w := p.peekWord()
+	p.r.Discard(len(w))
+	return w
+}
+
+func (p *luaParser) expect(c rune) error {
+	p.skipSpace()
+	got, _, err := p.r.ReadRune()
+	if err != nil {
+		return err
+	}
+	if got != c {
+		return fmt.Errorf("%w: expected %q but got %q", ErrInvalidLuaTable, c, got)
+	}
+	return nil
+}
+
+func (p *luaParser) parseValue() (interface{}, error) {
+	p.skipSpace()
+	c, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == '{':
+		return p.parseTable()
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		b, _ := p.r.Peek(2)
+		if string(b) == "[[" {
+			return p.parseLongString()
+		}
+	case c == '-' || c == '.' || unicode.IsDigit(c):
+		return p.parseNumber()
+	}
+
+	switch w := p.readWord(); w {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "nil":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected token %q", ErrInvalidLuaTable, w)
+	}
+}
+
+func (p *luaParser) parseTable() (interface{}, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	table := map[interface{}]interface{}{}
+	index := 1.0
+
+	for {
+		p.skipSpace()
+		c, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if c == '}' {
+			p.r.ReadRune()
+			return table, nil
+		}
+
+		var key interface{}
+		switch {
+		case c == '[' && p.peekString("[["):
+			key = nil
+		case c == '[':
+			p.r.ReadRune()
+			if key, err = p.parseValue(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(']'); err != nil {
+				return nil, err
+			}
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+		case c < unicode.MaxASCII && isWordByte(byte(c), true):
+			w := p.peekWord()
+			if w != "true" && w != "false" && w != "nil" {
+				p.readWord()
+				key = w
+				if err := p.expect('='); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			key = index
+			index++
+		}
+		if value != nil {
+			table[key] = value
+		}
+
+		p.skipSpace()
+		if c, err := p.peek(); err == nil && (c == ',' || c == ';') {
+			p.r.ReadRune()
+		}
+	}
+}
+
+func (p *luaParser) peekString(s string) bool {
+	b, _ := p.r.Peek(len(s))
+	return string(b) == s
+}
+
+func (p *luaParser) parseString() (interface{}, error) {
+	quote, _, err := p.r.ReadRune()
+	if err != nil {
+		return nil, err
+	}
+
+	sb := strings.Builder{}
+	for {
+		c, _, err := p.r.ReadRune()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case quote:
+			return sb.String(), nil
+		case '\\':
+			e, _, err := p.r.ReadRune()
+			if err != nil {
+				return nil, err
+			}
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case '\n':
+				sb.WriteByte('\n')
+			default:
+				if unicode.IsDigit(e) {
+					digits := string(e)
+					for len(digits) < 3 {
+						d, err := p.peek()
+						if err != nil || !unicode.IsDigit(d) {
+							break
+						}
+						p.r.ReadRune()
+						digits += string(d)
+					}
+					n, _ := strconv.Atoi(digits)
+					sb.WriteByte(byte(n))
+				} else {
+					sb.WriteRune(e)
+				}
+			}
+		default:
+			sb.WriteRune(c)
+		}
+	}
+}
+
+func (p *luaParser) parseLongString() (interface{}, error) {
+	p.r.Discard(2)
+	s, err := p.r.ReadString(']')
+	for err == nil && !p.peekString("]") {
+		var rest string
+		rest, err = p.r.ReadString(']')
+		s += rest
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.r.Discard(1)
+	return strings.TrimPrefix(strings.TrimSuffix(s, "]"), "\n"), nil
+}
+
+func (p *luaParser) parseNumber() (interface{}, error) {
+	sb := strings.Builder{}
+	for {
+		c, err := p.peek()
+		if err != nil || !(unicode.IsDigit(c) || strings.ContainsRune("+-.eExXabcdefABCDEF", c)) {
+			break
+		}
+		p.r.ReadRune()
+		sb.WriteRune(c)
+	}
+
+	s := sb.String()
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseInt(s[2:], 16, 64)
+		return float64(n), err
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid number %q", ErrInvalidLuaTable, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package koreader
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLuaTable(t *testing.T) {
+	f, err := os.Open("testdata/metadata.epub.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	table, err := ParseLuaTable(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := table["partial_md5_checksum"]; v != "4c0b1ea2e8a194d97ebf426ae7bbe16b" {
+		t.Errorf("partial_md5_checksum: got %v", v)
+	}
+	if v := table["percent_finished"]; v != 0.0160256 {
+		t.Errorf("percent_finished: got %v", v)
+	}
+	props, ok := table["doc_props"].(map[interface{}]interface{})
+	if !ok || props["title"] != "吾輩は猫である" {
+		t.Errorf("doc_props: got %v", table["doc_props"])
+	}
+}
+
+func TestParseLuaTableBareKeys(t *testing.T) {
+	src := `return {
+		pos0 = "a", pos1 = 'b', -- comment
+		long_identifier_of_key = true,
+		_private = nil,
+		[3] = 0x1F;
+		"first", [[long
+string]],
+	}`
+	table, err := ParseLuaTable(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[interface{}]interface{}{
+		"pos0":                   "a",
+		"pos1":                   "b",
+		"long_identifier_of_key": true,
+		3.0:                      31.0,
+		1.0:                      "first",
+		2.0:                      "long\nstring",
+	}
+	if len(table) != len(expected) {
+		t.Errorf("got %v", table)
+	}
+	for k, v := range expected {
+		if table[k] != v {
+			t.Errorf("%v: got %v, expected %v", k, table[k], v)
+		}
+	}
+}
+
+func TestReadAnnotations(t *testing.T) {
+	f, err := os.Open("testdata/metadata.epub.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	annotations, err := ReadAnnotations(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 2 {
+		t.Fatalf("got %d annotations", len(annotations))
+	}
+
+	note := annotations[0]
+	if note.Kind != KindNote || note.Note != "猫の名前" || note.Text != "吾輩は猫である。名前はまだ無い。" {
+		t.Errorf("note: got %+v", note)
+	}
+	if note.Pos1 != "/body/DocFragment[3]/body/p[1]/text().9" || note.Page != 5 || note.Color != "yellow" {
+		t.Errorf("note position: got %+v", note)
+	}
+	datetime := time.Date(2024, 3, 2, 21, 14, 5, 0, time.Local)
+	if !note.Datetime.Equal(datetime) {
+		t.Errorf("note datetime: got %v", note.Datetime)
+	}
+
+	bookmark := annotations[1]
+	if bookmark.Kind != KindBookmark || bookmark.Chapter != "第二章" || bookmark.Page != 31 {
+		t.Errorf("bookmark: got %+v", bookmark)
+	}
+	if bookmark.Pos0 != "/body/DocFragment[5]/body/p[12]/text().0" {
+		t.Errorf("bookmark position: got %q", bookmark.Pos0)
+	}
+	if bookmark.Text != "in chapter \"two\"\nsecond line" {
+		t.Errorf("bookmark text: got %q", bookmark.Text)
+	}
+}
@@ -0,0 +1,44 @@
+-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["chapter"] = "第一章",
+            ["color"] = "yellow",
+            ["datetime"] = "2024-03-02 21:14:05",
+            ["datetime_updated"] = "2024-03-02 21:15:40",
+            ["drawer"] = "lighten",
+            ["note"] = "猫の名前",
+            ["page"] = "/body/DocFragment[3]/body/p[1]/text().0",
+            ["pageno"] = 5,
+            ["pos0"] = "/body/DocFragment[3]/body/p[1]/text().0",
+            ["pos1"] = "/body/DocFragment[3]/body/p[1]/text().9",
+            ["text"] = "吾輩は猫である。名前はまだ無い。",
+        },
+        [2] = {
+            ["chapter"] = "第二章",
+            ["datetime"] = "2024-03-03 08:01:00",
+            ["page"] = "/body/DocFragment[5]/body/p[12]/text().0",
+            ["pageno"] = 31,
+            ["text"] = "in chapter \"two\"\
+second line",
+        },
+    },
+    ["cre_dom_version"] = 20240114,
+    ["doc_pages"] = 312,
+    ["doc_props"] = {
+        ["authors"] = "夏目漱石",
+        ["language"] = "ja",
+        ["title"] = "吾輩は猫である",
+    },
+    ["partial_md5_checksum"] = "4c0b1ea2e8a194d97ebf426ae7bbe16b",
+    ["percent_finished"] = 0.0160256,
+    ["stats"] = {
+        ["highlights"] = 1,
+        ["notes"] = 1,
+        ["pages"] = 312,
+    },
+    ["summary"] = {
+        ["modified"] = "2024-03-03",
+        ["status"] = "reading",
+    },
+}
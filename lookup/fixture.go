@@ -0,0 +1,39 @@
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+)
+
+// Fixture serves metadata from a local JSON file mapping ISBN-13 to
+// metadata, which is useful for offline testing.
+type Fixture struct {
+	books map[string]Metadata
+}
+
+func NewFixture(path string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	books := map[string]Metadata{}
+	if err := json.NewDecoder(f).Decode(&books); err != nil {
+		return nil, err
+	}
+	return &Fixture{books: books}, nil
+}
+
+func (p *Fixture) Name() string {
+	return "fixture"
+}
+
+func (p *Fixture) LookupISBN(ctx context.Context, isbn string) (*Metadata, error) {
+	md, ok := p.books[isbn]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &md, nil
+}
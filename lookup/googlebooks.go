@@ -0,0 +1,65 @@
+package lookup
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const googleBooksURL = "https://www.googleapis.com/books/v1/volumes"
+
+// GoogleBooks fetches metadata from the Google Books API. APIKey is
+// optional but raises the request quota.
+type GoogleBooks struct {
+	Client *http.Client
+	APIKey string
+}
+
+func NewGoogleBooks() *GoogleBooks {
+	return &GoogleBooks{Client: defaultClient}
+}
+
+func (p *GoogleBooks) Name() string {
+	return "googlebooks"
+}
+
+func (p *GoogleBooks) LookupISBN(ctx context.Context, isbn string) (*Metadata, error) {
+	res := struct {
+		Items []struct {
+			VolumeInfo struct {
+				Title         string   `json:"title"`
+				Subtitle      string   `json:"subtitle"`
+				Authors       []string `json:"authors"`
+				Publisher     string   `json:"publisher"`
+				PublishedDate string   `json:"publishedDate"`
+				Description   string   `json:"description"`
+				ImageLinks    struct {
+					Thumbnail string `json:"thumbnail"`
+				} `json:"imageLinks"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}{}
+
+	q := url.Values{"q": {"isbn:" + isbn}}
+	if p.APIKey != "" {
+		q.Set("key", p.APIKey)
+	}
+	if err := getJSON(ctx, p.Client, googleBooksURL+"?"+q.Encode(), &res); err != nil {
+		return nil, err
+	}
+	if len(res.Items) == 0 {
+		return nil, ErrNotFound
+	}
+
+	info := res.Items[0].VolumeInfo
+	return &Metadata{
+		ISBN:        isbn,
+		Title:       joinTitle(info.Title, info.Subtitle),
+		Authors:     info.Authors,
+		Publisher:   info.Publisher,
+		PubDate:     info.PublishedDate,
+		Description: info.Description,
+		CoverURL:    strings.Replace(info.ImageLinks.Thumbnail, "http://", "https://", 1),
+	}, nil
+}
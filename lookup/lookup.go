@@ -0,0 +1,102 @@
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrNotFound is returned by providers which know no book of an ISBN.
+var ErrNotFound = errors.New("book not found")
+
+// Metadata is bibliographic information of a book fetched by ISBN.
+type Metadata struct {
+	Provider    string   `json:"Provider"`
+	ISBN        string   `json:"ISBN"`
+	Title       string   `json:"Title"`
+	Authors     []string `json:"Authors"`
+	Publisher   string   `json:"Publisher"`
+	PubDate     string   `json:"PubDate"`
+	Description string   `json:"Description"`
+	CoverURL    string   `json:"CoverURL"`
+}
+
+// Provider fetches metadata of a book by a normalized ISBN-13.
+type Provider interface {
+	Name() string
+	LookupISBN(ctx context.Context, isbn string) (*Metadata, error)
+}
+
+// LookupISBN asks providers in order and returns the first metadata found.
+// ErrNotFound is returned only if every provider answered that it knows no
+// such book.
+func LookupISBN(ctx context.Context, providers []Provider, isbn string) (*Metadata, error) {
+	var lastErr error
+	for _, p := range providers {
+		md, err := p.LookupISBN(ctx, isbn)
+		switch {
+		case err == nil:
+			md.Provider = p.Name()
+			if md.ISBN == "" {
+				md.ISBN = isbn
+			}
+			return md, nil
+		case err != ErrNotFound:
+			lastErr = fmt.Errorf("%s: %w", p.Name(), err)
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNotFound
+}
+
+// NewProvider returns a builtin provider by name.
+func NewProvider(name string) (Provider, error) {
+	switch name {
+	case "openlibrary":
+		return NewOpenLibrary(), nil
+	case "googlebooks":
+		return NewGoogleBooks(), nil
+	case "ndl":
+		return NewNDL(), nil
+	default:
+		return nil, fmt.Errorf("unknown lookup provider: %s", name)
+	}
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// get requests a URL and returns the body of a successful response.
+func get(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return res.Body, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	body, err := get(ctx, client, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
@@ -0,0 +1,66 @@
+package lookup
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingProvider fails every lookup like an unreachable service.
+type failingProvider struct{}
+
+func (failingProvider) Name() string {
+	return "failing"
+}
+
+func (failingProvider) LookupISBN(ctx context.Context, isbn string) (*Metadata, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLookupISBNFixture(t *testing.T) {
+	fixture, err := NewFixture("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := []Provider{failingProvider{}, fixture}
+
+	md, err := LookupISBN(context.Background(), providers, "9784101010014")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Provider != "fixture" || md.ISBN != "9784101010014" {
+		t.Errorf("provider and ISBN: got %q and %q", md.Provider, md.ISBN)
+	}
+	if md.Title != "吾輩は猫である" || len(md.Authors) != 1 || md.Authors[0] != "夏目漱石" {
+		t.Errorf("title and authors: got %q and %v", md.Title, md.Authors)
+	}
+	if md.Publisher != "新潮社" || md.PubDate != "2003-06" {
+		t.Errorf("publisher and date: got %q and %q", md.Publisher, md.PubDate)
+	}
+
+	md, err = LookupISBN(context.Background(), providers, "9780306406157")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Authors) != 2 {
+		t.Errorf("authors: got %v", md.Authors)
+	}
+}
+
+func TestLookupISBNNotFound(t *testing.T) {
+	fixture, err := NewFixture("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LookupISBN(context.Background(), []Provider{fixture}, "9780804429573")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// a failure is reported rather than that the book does not exist
+	_, err = LookupISBN(context.Background(), []Provider{fixture, failingProvider{}}, "9780804429573")
+	if err == nil || err == ErrNotFound {
+		t.Errorf("expected the failure of the provider, got %v", err)
+	}
+}
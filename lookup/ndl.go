@@ -0,0 +1,64 @@
+package lookup
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ndlSearchURL    = "https://ndlsearch.ndl.go.jp/api/opensearch"
+	ndlThumbnailURL = "https://ndlsearch.ndl.go.jp/thumbnail/"
+)
+
+// NDL fetches metadata from the OpenSearch API of the National Diet
+// Library, which covers Japanese books missing in other providers.
+type NDL struct {
+	Client *http.Client
+}
+
+func NewNDL() *NDL {
+	return &NDL{Client: defaultClient}
+}
+
+func (p *NDL) Name() string {
+	return "ndl"
+}
+
+func (p *NDL) LookupISBN(ctx context.Context, isbn string) (*Metadata, error) {
+	q := url.Values{"isbn": {isbn}, "cnt": {"1"}}
+	body, err := get(ctx, p.Client, ndlSearchURL+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	rss := struct {
+		Items []struct {
+			Title       string   `xml:"http://purl.org/dc/elements/1.1/ title"`
+			Creators    []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			Publisher   string   `xml:"http://purl.org/dc/elements/1.1/ publisher"`
+			Issued      string   `xml:"http://purl.org/dc/terms/ issued"`
+			Description []string `xml:"http://purl.org/dc/elements/1.1/ description"`
+		} `xml:"channel>item"`
+	}{}
+	if err := xml.NewDecoder(body).Decode(&rss); err != nil {
+		return nil, err
+	}
+	if len(rss.Items) == 0 {
+		return nil, ErrNotFound
+	}
+
+	item := rss.Items[0]
+	return &Metadata{
+		ISBN:        isbn,
+		Title:       strings.TrimSpace(item.Title),
+		Authors:     item.Creators,
+		Publisher:   item.Publisher,
+		PubDate:     item.Issued,
+		Description: strings.Join(item.Description, "\n"),
+		CoverURL:    ndlThumbnailURL + isbn + ".jpg",
+	}, nil
+}
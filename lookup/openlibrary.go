@@ -0,0 +1,77 @@
+package lookup
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+const openLibraryURL = "https://openlibrary.org/api/books"
+
+// OpenLibrary fetches metadata from the Open Library Books API.
+type OpenLibrary struct {
+	Client *http.Client
+}
+
+func NewOpenLibrary() *OpenLibrary {
+	return &OpenLibrary{Client: defaultClient}
+}
+
+func (p *OpenLibrary) Name() string {
+	return "openlibrary"
+}
+
+func (p *OpenLibrary) LookupISBN(ctx context.Context, isbn string) (*Metadata, error) {
+	type named struct {
+		Name string `json:"name"`
+	}
+	res := map[string]struct {
+		Title       string      `json:"title"`
+		Subtitle    string      `json:"subtitle"`
+		Authors     []named     `json:"authors"`
+		Publishers  []named     `json:"publishers"`
+		PublishDate string      `json:"publish_date"`
+		Notes       interface{} `json:"notes"`
+		Cover       struct {
+			Large string `json:"large"`
+		} `json:"cover"`
+	}{}
+
+	key := "ISBN:" + isbn
+	q := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	if err := getJSON(ctx, p.Client, openLibraryURL+"?"+q.Encode(), &res); err != nil {
+		return nil, err
+	}
+	book, ok := res[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	md := Metadata{
+		ISBN:     isbn,
+		Title:    joinTitle(book.Title, book.Subtitle),
+		PubDate:  book.PublishDate,
+		CoverURL: book.Cover.Large,
+	}
+	for _, author := range book.Authors {
+		md.Authors = append(md.Authors, author.Name)
+	}
+	if len(book.Publishers) > 0 {
+		md.Publisher = book.Publishers[0].Name
+	}
+	// notes are either a string or a typed text value
+	switch notes := book.Notes.(type) {
+	case string:
+		md.Description = notes
+	case map[string]interface{}:
+		md.Description, _ = notes["value"].(string)
+	}
+	return &md, nil
+}
+
+func joinTitle(title, subtitle string) string {
+	if subtitle == "" {
+		return title
+	}
+	return title + ": " + subtitle
+}
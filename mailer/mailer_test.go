@@ -0,0 +1,110 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/altescy/bookshelf/mailer"
+	"github.com/altescy/bookshelf/mailin"
+)
+
+// startServer runs a local SMTP server passing received messages to a
+// handler, and returns a mailer sending to it.
+func startServer(t *testing.T, handler mailin.Handler) *mailer.Mailer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	server := mailin.Server{Addr: addr, Handler: handler}
+	go server.ListenAndServe(ctx)
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	host, portString, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portString)
+	return &mailer.Mailer{Host: host, Port: port, From: "Bookshelf <bookshelf@example.com>"}
+}
+
+func TestSend(t *testing.T) {
+	received := make(chan *mailin.Message, 1)
+	m := startServer(t, func(msg *mailin.Message) error {
+		received <- msg
+		return nil
+	})
+
+	data := bytes.Repeat([]byte("book\x00\xff"), 100)
+	attachment := mailer.Attachment{
+		Filename:    "吾輩は猫である.epub",
+		ContentType: "application/epub+zip",
+		Data:        data,
+	}
+	err := m.Send(context.Background(), "reader@example.com", "本を送ります", "body", attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+	if msg.Sender != "bookshelf@example.com" {
+		t.Errorf("sender: got %q", msg.Sender)
+	}
+	if msg.From == nil || msg.From.Address != "bookshelf@example.com" {
+		t.Errorf("from: got %v", msg.From)
+	}
+	if msg.Subject != "本を送ります" {
+		t.Errorf("subject: got %q", msg.Subject)
+	}
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("attachments: got %d", len(msg.Attachments))
+	}
+	got := msg.Attachments[0]
+	if got.Filename != attachment.Filename {
+		t.Errorf("filename: got %q", got.Filename)
+	}
+	if !bytes.Equal(got.Data, data) {
+		t.Errorf("data: got %d bytes, expected %d", len(got.Data), len(data))
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	m := startServer(t, func(msg *mailin.Message) error {
+		return mailin.ErrRejected
+	})
+
+	err := m.Send(context.Background(), "reader@example.com", "subject", "body")
+	if err == nil {
+		t.Fatal("rejected message is reported as sent")
+	}
+}
+
+func TestSendTooLarge(t *testing.T) {
+	m := startServer(t, func(msg *mailin.Message) error {
+		t.Error("message larger than MaxSize is sent")
+		return nil
+	})
+	m.MaxSize = 10
+
+	attachment := mailer.Attachment{Filename: "book.epub", Data: make([]byte, 11)}
+	err := m.Send(context.Background(), "reader@example.com", "subject", "body", attachment)
+	if err != mailer.ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
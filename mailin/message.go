@@ -0,0 +1,158 @@
+package mailin
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"strings"
+
+	"github.com/altescy/bookshelf/mailer"
+)
+
+// Message is a received email.
+type Message struct {
+	// Sender is the envelope sender given by MAIL FROM.
+	Sender    string
+	From      *mail.Address
+	Subject   string
+	MessageID string
+	// AutoSubmitted reports whether the message was sent automatically,
+	// such as a bounce or a vacation reply, which must not be answered.
+	AutoSubmitted bool
+	Attachments   []mailer.Attachment
+}
+
+// ParseMessage reads a message and decodes the files attached to it.
+func ParseMessage(r io.Reader) (*Message, error) {
+	m, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	dec := mime.WordDecoder{}
+	msg := Message{MessageID: m.Header.Get("Message-ID")}
+	msg.Subject, err = dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		msg.Subject = m.Header.Get("Subject")
+	}
+	if from, err := m.Header.AddressList("From"); err == nil && len(from) > 0 {
+		msg.From = from[0]
+	}
+
+	auto := strings.ToLower(strings.TrimSpace(m.Header.Get("Auto-Submitted")))
+	precedence := strings.ToLower(strings.TrimSpace(m.Header.Get("Precedence")))
+	msg.AutoSubmitted = (auto != "" && auto != "no") ||
+		precedence == "bulk" || precedence == "list" || precedence == "junk"
+
+	header := partHeader{
+		contentType: m.Header.Get("Content-Type"),
+		disposition: m.Header.Get("Content-Disposition"),
+		encoding:    m.Header.Get("Content-Transfer-Encoding"),
+	}
+	if err := msg.readPart(header, m.Body); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+type partHeader struct {
+	contentType string
+	disposition string
+	encoding    string
+}
+
+// readPart walks multipart bodies and collects parts having file names.
+func (msg *Message) readPart(header partHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			h := partHeader{
+				contentType: p.Header.Get("Content-Type"),
+				disposition: p.Header.Get("Content-Disposition"),
+				encoding:    p.Header.Get("Content-Transfer-Encoding"),
+			}
+			if err := msg.readPart(h, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := ""
+	if _, dparams, err := mime.ParseMediaType(header.disposition); err == nil {
+		filename = dparams["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename == "" {
+		return nil
+	}
+	dec := mime.WordDecoder{}
+	if decoded, err := dec.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	b, err := ioutil.ReadAll(decodeTransfer(header.encoding, body))
+	if err != nil {
+		return err
+	}
+	msg.Attachments = append(msg.Attachments, mailer.Attachment{
+		Filename:    filepath.Base(filepath.Clean("/" + strings.ReplaceAll(filename, `\`, "/"))),
+		ContentType: mediaType,
+		Data:        b,
+	})
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &lineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// lineStripper drops spaces and line breaks, while the base64 decoder of
+// the standard library skips only line breaks.
+type lineStripper struct {
+	r io.Reader
+}
+
+func (l *lineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := l.r.Read(p)
+		m := 0
+		for _, c := range p[:n] {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+			default:
+				p[m] = c
+				m++
+			}
+		}
+		if m > 0 || err != nil {
+			return m, err
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package mailin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRejected is returned by handlers refusing a message.
+var ErrRejected = errors.New("message rejected")
+
+// Handler processes a received message. The message is accepted when the
+// handler returns nil.
+type Handler func(msg *Message) error
+
+// Server is a minimal SMTP server receiving messages for bookshelf. It does
+// not relay messages, and it is meant to run behind a mail server or on a
+// private network because it supports neither TLS nor authentication.
+type Server struct {
+	Addr     string
+	Hostname string
+	// MaxSize is the largest message in bytes. Zero means no limit.
+	MaxSize int64
+	// AllowSender reports whether messages from an address are accepted.
+	// Nil accepts any sender.
+	AllowSender func(address string) bool
+	Handler     Handler
+}
+
+// ListenAndServe accepts connections until the context is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// session is the state of a mail transaction.
+type session struct {
+	helo       bool
+	sender     string
+	recipients []string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	tc := textproto.NewConn(conn)
+	reply := func(code int, msg string) {
+		tc.PrintfLine("%d %s", code, msg)
+	}
+	deadline := func() {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	}
+
+	deadline()
+	reply(220, hostname+" ESMTP bookshelf")
+
+	ss := session{}
+	for {
+		deadline()
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ss = session{helo: true}
+			reply(250, hostname)
+		case "EHLO":
+			ss = session{helo: true}
+			lines := []string{hostname, "8BITMIME", "PIPELINING"}
+			if s.MaxSize > 0 {
+				lines = append(lines, "SIZE "+strconv.FormatInt(s.MaxSize, 10))
+			}
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				tc.PrintfLine("250%s%s", sep, l)
+			}
+		case "MAIL":
+			if !ss.helo {
+				reply(503, "5.5.1 send HELO first")
+				continue
+			}
+			sender, params, ok := parsePath(arg, "FROM:")
+			if !ok {
+				reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+				continue
+			}
+			if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && s.MaxSize > 0 && size > s.MaxSize {
+				reply(552, "5.3.4 message too large")
+				continue
+			}
+			if s.AllowSender != nil && !s.AllowSender(sender) {
+				log.Printf("[WARN] reject mail from %s", sender)
+				reply(550, "5.7.1 sender not allowed")
+				continue
+			}
+			ss.sender = sender
+			ss.recipients = nil
+			reply(250, "2.1.0 ok")
+		case "RCPT":
+			if ss.sender == "" {
+				reply(503, "5.5.1 send MAIL first")
+				continue
+			}
+			recipient, _, ok := parsePath(arg, "TO:")
+			if !ok || recipient == "" {
+				reply(501, "5.5.4 syntax: RCPT TO:<address>")
+				continue
+			}
+			ss.recipients = append(ss.recipients, recipient)
+			reply(250, "2.1.5 ok")
+		case "DATA":
+			if len(ss.recipients) == 0 {
+				reply(503, "5.5.1 send RCPT first")
+				continue
+			}
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+			code, msg := s.receive(tc, ss.sender)
+			reply(code, msg)
+			ss = session{helo: true}
+		case "RSET":
+			ss = session{helo: ss.helo}
+			reply(250, "2.0.0 ok")
+		case "NOOP":
+			reply(250, "2.0.0 ok")
+		case "VRFY":
+			reply(252, "2.5.0 cannot verify")
+		case "QUIT":
+			reply(221, "2.0.0 bye")
+			return
+		default:
+			reply(502, "5.5.2 command not implemented")
+		}
+	}
+}
+
+// receive reads message data and passes it to the handler.
+func (s *Server) receive(tc *textproto.Conn, sender string) (int, string) {
+	data := tc.DotReader()
+	r := data
+	if s.MaxSize > 0 {
+		r = io.LimitReader(data, s.MaxSize+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 451, "4.3.0 cannot read message"
+	}
+	if s.MaxSize > 0 && int64(len(b)) > s.MaxSize {
+		// discard the rest to keep the connection in sync
+		io.Copy(ioutil.Discard, data)
+		return 552, "5.3.4 message too large"
+	}
+
+	msg, err := ParseMessage(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("[WARN] cannot parse mail from %s: %v", sender, err)
+		return 554, "5.6.0 malformed message"
+	}
+	msg.Sender = sender
+
+	if s.AllowSender != nil && (msg.From == nil || !s.AllowSender(msg.From.Address)) {
+		log.Printf("[WARN] reject mail from %s with disallowed From header", sender)
+		return 550, "5.7.1 sender not allowed"
+	}
+
+	if s.Handler != nil {
+		switch err := s.Handler(msg); {
+		case err == ErrRejected:
+			return 550, "5.7.1 message rejected"
+		case err != nil:
+			log.Printf("[ERROR] cannot handle mail from %s: %v", sender, err)
+			return 451, "4.3.0 cannot process message"
+		}
+	}
+	return 250, "2.0.0 message accepted"
+}
+
+// parsePath parses the argument of MAIL FROM or RCPT TO and returns the
+// address and the ESMTP parameters.
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	address := arg[1:end]
+	// drop source routes like <@relay:user@example.com>
+	if i := strings.LastIndexByte(address, ':'); i >= 0 && strings.HasPrefix(address, "@") {
+		address = address[i+1:]
+	}
+
+	params := map[string]string{}
+	for _, p := range strings.Fields(arg[end+1:]) {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+	return address, params, true
+}
+
+// SenderList returns a function accepting addresses in a list, where an
+// entry like @example.com accepts a whole domain.
+func SenderList(entries []string) func(address string) bool {
+	addresses := map[string]bool{}
+	domains := map[string]bool{}
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+		case strings.HasPrefix(e, "@"):
+			domains[e[1:]] = true
+		default:
+			if a, err := mail.ParseAddress(e); err == nil {
+				e = strings.ToLower(a.Address)
+			}
+			addresses[e] = true
+		}
+	}
+
+	return func(address string) bool {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if addresses[address] {
+			return true
+		}
+		if i := strings.LastIndexByte(address, '@'); i >= 0 {
+			return domains[address[i+1:]]
+		}
+		return false
+	}
+}
@@ -0,0 +1,193 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of annotations.
+const (
+	AnnotationHighlight = "highlight"
+	AnnotationNote      = "note"
+	AnnotationBookmark  = "bookmark"
+)
+
+// Annotation is a highlight, note or bookmark of a user on a book file.
+// Reflowable documents are located by an EPUB CFI (or a KOReader xpointer
+// for imported annotations) and fixed layout documents by a page and rect.
+type Annotation struct {
+	ID         uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	UpdatedAt  time.Time  `json:"UpdatedAt"`
+	DeletedAt  *time.Time `json:"-" sql:"index"`
+	UserID     uint64     `json:"UserID" gorm:"not null;index"`
+	BookID     uint64     `json:"BookID" gorm:"not null;index"`
+	FileID     uint64     `json:"FileID"`
+	Kind       string     `json:"Kind" gorm:"not null"`
+	CFI        string     `json:"CFI"`
+	XPointer0  string     `json:"XPointer0"`
+	XPointer1  string     `json:"XPointer1"`
+	Page       int        `json:"Page"`
+	RectX      float64    `json:"RectX"`
+	RectY      float64    `json:"RectY"`
+	RectWidth  float64    `json:"RectWidth"`
+	RectHeight float64    `json:"RectHeight"`
+	Chapter    string     `json:"Chapter"`
+	Text       string     `json:"Text"`
+	Note       string     `json:"Note"`
+	Color      string     `json:"Color"`
+}
+
+func IsValidAnnotationKind(kind string) bool {
+	switch kind {
+	case AnnotationHighlight, AnnotationNote, AnnotationBookmark:
+		return true
+	default:
+		return false
+	}
+}
+
+func AddAnnotation(db *gorm.DB, annotation *Annotation) error {
+	if !IsValidAnnotationKind(annotation.Kind) {
+		return ErrInvalidAnnotation
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleAnnotationError(tx.Save(annotation).Error)
+	})
+}
+
+// ImportAnnotations adds annotations which do not exist yet, so that the
+// same sidecar file can be imported more than once. It returns the number
+// of added annotations.
+func ImportAnnotations(db *gorm.DB, annotations []Annotation) (int, error) {
+	count := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i := range annotations {
+			a := &annotations[i]
+			if !IsValidAnnotationKind(a.Kind) {
+				return ErrInvalidAnnotation
+			}
+
+			err := tx.Take(&Annotation{},
+				"user_id=? and book_id=? and kind=? and x_pointer0=? and x_pointer1=? and page=? and text=?",
+				a.UserID, a.BookID, a.Kind, a.XPointer0, a.XPointer1, a.Page, a.Text,
+			).Error
+			switch {
+			case err == nil:
+				continue
+			case !gorm.IsRecordNotFoundError(err):
+				return err
+			}
+
+			if err := tx.Save(a).Error; err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, handleAnnotationError(err)
+	}
+	return count, nil
+}
+
+func DeleteAnnotation(db *gorm.DB, annotation *Annotation) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleAnnotationError(tx.Delete(annotation).Error)
+	})
+}
+
+func GetAnnotation(db *gorm.DB, userID, bookID, annotationID uint64) (*Annotation, error) {
+	annotation := Annotation{}
+	err := db.Take(&annotation, "id=? and user_id=? and book_id=?", annotationID, userID, bookID).Error
+	if err != nil {
+		return nil, handleAnnotationError(err)
+	}
+	return &annotation, nil
+}
+
+// GetAnnotations returns annotations of a user on a book in reading order.
+// fileID and kind are optional filters.
+func GetAnnotations(db *gorm.DB, userID, bookID, fileID uint64, kind string) (*[]Annotation, error) {
+	q := db.Where("user_id=? and book_id=?", userID, bookID)
+	if fileID != 0 {
+		q = q.Where("file_id=?", fileID)
+	}
+	if kind != "" {
+		q = q.Where("kind=?", kind)
+	}
+
+	annotations := []Annotation{}
+	if err := q.Order("page, cfi, x_pointer0, created_at").Find(&annotations).Error; err != nil {
+		return nil, handleAnnotationError(err)
+	}
+	return &annotations, nil
+}
+
+func UpdateAnnotation(db *gorm.DB, annotation *Annotation) error {
+	if !IsValidAnnotationKind(annotation.Kind) {
+		return ErrInvalidAnnotation
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleAnnotationError(tx.Save(annotation).Error)
+	})
+}
+
+func handleAnnotationError(err error) error {
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return ErrAnnotationNotFound
+	default:
+		return err
+	}
+}
+
+// WriteAnnotationsMarkdown exports annotations as a Markdown document
+// grouped by chapter.
+func WriteAnnotationsMarkdown(w io.Writer, book *Book, annotations []Annotation) error {
+	buf := bufio.NewWriter(w)
+
+	fmt.Fprintf(buf, "# %s\n\n", book.Title)
+	if book.Author != "" {
+		fmt.Fprintf(buf, "%s\n\n", book.Author)
+	}
+
+	chapter := ""
+	for _, a := range annotations {
+		if a.Chapter != "" && a.Chapter != chapter {
+			chapter = a.Chapter
+			fmt.Fprintf(buf, "## %s\n\n", chapter)
+		}
+
+		switch a.Kind {
+		case AnnotationBookmark:
+			fmt.Fprintf(buf, "- Bookmark")
+			if a.Page != 0 {
+				fmt.Fprintf(buf, " (p. %d)", a.Page)
+			}
+			if a.Note != "" {
+				fmt.Fprintf(buf, ": %s", a.Note)
+			}
+			fmt.Fprint(buf, "\n\n")
+		default:
+			for _, line := range strings.Split(a.Text, "\n") {
+				fmt.Fprintf(buf, "> %s\n", line)
+			}
+			if a.Page != 0 {
+				fmt.Fprintf(buf, ">\n> — p. %d\n", a.Page)
+			}
+			fmt.Fprint(buf, "\n")
+			if a.Note != "" {
+				fmt.Fprintf(buf, "%s\n\n", a.Note)
+			}
+		}
+	}
+
+	return buf.Flush()
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// archiveTables are the tables of library archives in order of their
+// dependencies. Jobs are not archived because they are transient.
+var archiveTables = []struct {
+	name   string
+	record func() interface{}
+}{
+	{"users", func() interface{} { return &User{} }},
+	{"custom_formats", func() interface{} { return &CustomFormat{} }},
+	{"books", func() interface{} { return &Book{} }},
+	{"files", func() interface{} { return &File{} }},
+	{"progresses", func() interface{} { return &Progress{} }},
+	{"annotations", func() interface{} { return &Annotation{} }},
+	{"metadata_proposals", func() interface{} { return &MetadataProposal{} }},
+	{"devices", func() interface{} { return &Device{} }},
+	{"deliveries", func() interface{} { return &Delivery{} }},
+}
+
+// ArchiveTables returns the names of archived tables.
+func ArchiveTables() []string {
+	names := []string{}
+	for _, t := range archiveTables {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// NewArchiveRecord returns an empty record of an archived table.
+func NewArchiveRecord(table string) (interface{}, error) {
+	for _, t := range archiveTables {
+		if t.name == table {
+			return t.record(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown table: %s", table)
+}
+
+// EachArchiveRecord calls a function with each record of a table ordered
+// by ID without loading the whole table.
+func EachArchiveRecord(db *gorm.DB, table string, f func(record interface{}) error) error {
+	record, err := NewArchiveRecord(table)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Model(record).Order("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record, _ := NewArchiveRecord(table)
+		if err := db.ScanRows(rows, record); err != nil {
+			return err
+		}
+		if err := f(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// InsertArchiveRecord inserts a record read from an archive as a new row.
+func InsertArchiveRecord(db *gorm.DB, record interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(record).Error
+	})
+}
@@ -19,17 +19,31 @@ type Book struct {
 	Author      string     `json:"Author"`
 	Description string     `json:"Description"`
 	CoverURL    string     `json:"CoverURL"`
+	CoverPath   string     `json:"-"`
+	CoverType   string     `json:"-"`
 	Publisher   string     `json:"Publisher"`
 	PubDate     string     `json:"PubDate"`
-	Files       []File     `json:"Files"`
+	Series      string     `json:"Series"`
+	SeriesIndex float64    `json:"SeriesIndex"`
+	// Tags and Identifiers are separated by commas, and identifiers are
+	// written as type:value like amazon:B00ABCDEFG.
+	Tags        string `json:"Tags"`
+	Identifiers string `json:"Identifiers"`
+	// Rating is from 0 to 10, two for each star.
+	Rating int    `json:"Rating"`
+	Files  []File `json:"Files"`
 }
 
+// AddBook adds a book with a new UUID unless the UUID is given, such as
+// the UUID of an imported book.
 func AddBook(db *gorm.DB, book *Book) error {
-	uid, err := uuid.NewRandom()
-	if err != nil {
-		return err
+	if book.UUID == "" {
+		uid, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		book.UUID = uid.String()
 	}
-	book.UUID = uid.String()
 	return db.Transaction(func(tx *gorm.DB) error {
 		return handleBookError(tx.Save(book).Error)
 	})
@@ -43,7 +57,15 @@ func DeleteBook(db *gorm.DB, book *Book) error {
 
 func GetBookByID(db *gorm.DB, bookID uint64) (*Book, error) {
 	book := Book{}
-	if err := db.Preload("Files").First(&book, bookID).Error; err != nil {
+	if err := preloadFiles(db).First(&book, bookID).Error; err != nil {
+		return nil, handleBookError(err)
+	}
+	return &book, nil
+}
+
+func GetBookByUUID(db *gorm.DB, uuid string) (*Book, error) {
+	book := Book{}
+	if err := preloadFiles(db).Where("uuid = ?", uuid).First(&book).Error; err != nil {
 		return nil, handleBookError(err)
 	}
 	return &book, nil
@@ -51,7 +73,7 @@ func GetBookByID(db *gorm.DB, bookID uint64) (*Book, error) {
 
 func GetBooks(db *gorm.DB) (*[]Book, error) {
 	books := []Book{}
-	err := db.Preload("Files").Order("updated_at desc").Find(&books).Error
+	err := preloadFiles(db).Order("updated_at desc").Find(&books).Error
 	if err != nil {
 		return nil, handleBookError(err)
 	}
@@ -60,7 +82,7 @@ func GetBooks(db *gorm.DB) (*[]Book, error) {
 
 func GetBooksWithCount(db *gorm.DB, count uint64) (*[]Book, error) {
 	books := []Book{}
-	if err := db.Preload("Files").Limit(count).Find(&books).Error; err != nil {
+	if err := preloadFiles(db).Limit(count).Find(&books).Error; err != nil {
 		return nil, handleBookError(err)
 	}
 	return &books, nil
@@ -68,7 +90,7 @@ func GetBooksWithCount(db *gorm.DB, count uint64) (*[]Book, error) {
 
 func GetBooksWithNext(db *gorm.DB, next uint64) (*[]Book, error) {
 	books := []Book{}
-	if err := db.Preload("Files").Where("id > ?", next).Find(&books).Error; err != nil {
+	if err := preloadFiles(db).Where("id > ?", next).Find(&books).Error; err != nil {
 		return nil, handleBookError(err)
 	}
 	return &books, nil
@@ -76,7 +98,7 @@ func GetBooksWithNext(db *gorm.DB, next uint64) (*[]Book, error) {
 
 func GetBooksWithNextCount(db *gorm.DB, next, count uint64) (*[]Book, error) {
 	books := []Book{}
-	if err := db.Preload("Files").Where("id > ?", next).Limit(count).Find(&books).Error; err != nil {
+	if err := preloadFiles(db).Where("id > ?", next).Limit(count).Find(&books).Error; err != nil {
 		return nil, handleBookError(err)
 	}
 	return &books, nil
@@ -91,6 +113,11 @@ func UpdateBook(db *gorm.DB, book *Book) error {
 	})
 }
 
+// preloadFiles loads current versions of files of books.
+func preloadFiles(db *gorm.DB) *gorm.DB {
+	return db.Preload("Files", "current = ?", true)
+}
+
 func handleBookError(err error) error {
 	if pgError, ok := err.(*pq.Error); ok {
 		switch pgError.Code {
@@ -0,0 +1,190 @@
+package model
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/jinzhu/gorm"
+)
+
+// States of deliveries.
+const (
+	DeliveryQueued   = "queued"
+	DeliverySending  = "sending"
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+	DeliveryCanceled = "canceled"
+)
+
+// Device is an e-reader of a user receiving books by email, such as the
+// Send to Kindle address of a Kindle.
+type Device struct {
+	ID        uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	UpdatedAt time.Time  `json:"UpdatedAt"`
+	DeletedAt *time.Time `json:"-" sql:"index"`
+	UserID    uint64     `json:"UserID" gorm:"not null;index"`
+	Name      string     `json:"Name" gorm:"not null"`
+	Email     string     `json:"Email" gorm:"not null"`
+	// Formats are aliases of formats accepted by the device separated by
+	// commas in order of preference.
+	Formats string `json:"Formats" gorm:"not null"`
+	// MaxSize is the largest attachment in bytes accepted by the device.
+	// Zero leaves the limit to the server.
+	MaxSize int64 `json:"MaxSize"`
+}
+
+// Delivery is a file sent to a device.
+type Delivery struct {
+	ID        uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	UpdatedAt time.Time  `json:"UpdatedAt"`
+	DeletedAt *time.Time `json:"-" sql:"index"`
+	UserID    uint64     `json:"UserID" gorm:"not null;index"`
+	DeviceID  uint64     `json:"DeviceID" gorm:"not null;index"`
+	BookID    uint64     `json:"BookID" gorm:"not null;index"`
+	// FileID is the file requested to be sent, or zero to choose one of
+	// the formats accepted by the device.
+	FileID uint64 `json:"FileID"`
+	// SentFileID is the file actually sent, which may be converted.
+	SentFileID uint64 `json:"SentFileID"`
+	JobID      uint64 `json:"JobID"`
+	Status     string `json:"Status" gorm:"not null"`
+	Error      string `json:"Error"`
+}
+
+// FormatList returns the aliases of formats accepted by a device.
+func (d *Device) FormatList() []string {
+	formats := []string{}
+	for _, alias := range strings.Split(d.Formats, ",") {
+		if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" {
+			formats = append(formats, alias)
+		}
+	}
+	return formats
+}
+
+// AddDevice adds a device after validating its address and formats.
+func AddDevice(db *gorm.DB, device *Device) error {
+	if err := validateDevice(device); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(device).Error
+	})
+}
+
+func UpdateDevice(db *gorm.DB, device *Device) error {
+	if err := validateDevice(device); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleDeviceError(tx.Save(device).Error)
+	})
+}
+
+func DeleteDevice(db *gorm.DB, device *Device) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleDeviceError(tx.Delete(device).Error)
+	})
+}
+
+func GetDevice(db *gorm.DB, userID, deviceID uint64) (*Device, error) {
+	device := Device{}
+	err := db.Take(&device, "id=? and user_id=?", deviceID, userID).Error
+	if err != nil {
+		return nil, handleDeviceError(err)
+	}
+	return &device, nil
+}
+
+func GetDevices(db *gorm.DB, userID uint64) (*[]Device, error) {
+	devices := []Device{}
+	if err := db.Where("user_id=?", userID).Order("id").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return &devices, nil
+}
+
+func validateDevice(device *Device) error {
+	device.Name = strings.TrimSpace(device.Name)
+	address, err := mail.ParseAddress(strings.TrimSpace(device.Email))
+	if err != nil || device.Name == "" || device.MaxSize < 0 {
+		return ErrInvalidDevice
+	}
+	device.Email = address.Address
+
+	formats := device.FormatList()
+	if len(formats) == 0 {
+		return ErrInvalidDevice
+	}
+	for _, alias := range formats {
+		if _, err := format.Default.ByAlias(alias); err != nil {
+			return ErrInvalidDevice
+		}
+	}
+	device.Formats = strings.Join(formats, ",")
+	return nil
+}
+
+func handleDeviceError(err error) error {
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return ErrDeviceNotFound
+	default:
+		return err
+	}
+}
+
+func AddDelivery(db *gorm.DB, delivery *Delivery) error {
+	delivery.Status = DeliveryQueued
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(delivery).Error
+	})
+}
+
+// UpdateDelivery records the state of a delivery.
+func UpdateDelivery(db *gorm.DB, delivery *Delivery) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Save(delivery).Error
+	})
+}
+
+func GetDelivery(db *gorm.DB, userID, deliveryID uint64) (*Delivery, error) {
+	delivery := Delivery{}
+	q := db.Where("id=?", deliveryID)
+	if userID != 0 {
+		q = q.Where("user_id=?", userID)
+	}
+	err := q.Take(&delivery).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrDeliveryNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// GetDeliveries returns recent deliveries of a user filtered by non-zero
+// arguments.
+func GetDeliveries(db *gorm.DB, userID, deviceID uint64, status string, count uint64) (*[]Delivery, error) {
+	q := db.Where("user_id=?", userID)
+	if deviceID != 0 {
+		q = q.Where("device_id=?", deviceID)
+	}
+	if status != "" {
+		q = q.Where("status=?", status)
+	}
+	if count == 0 {
+		count = 100
+	}
+
+	deliveries := []Delivery{}
+	if err := q.Order("id desc").Limit(count).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return &deliveries, nil
+}
@@ -0,0 +1,355 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Reasons why books are considered duplicates.
+const (
+	DuplicateByISBN  = "isbn"
+	DuplicateByFile  = "file"
+	DuplicateByTitle = "title"
+)
+
+// DuplicateGroup is a group of books which are likely the same.
+// Score is the highest similarity between books in the group.
+type DuplicateGroup struct {
+	Books   []Book   `json:"Books"`
+	Score   float64  `json:"Score"`
+	Reasons []string `json:"Reasons"`
+}
+
+// Properties of books which can be chosen when merging books.
+var mergeableFields = map[string]func(dst, src *Book){
+	"ISBN":        func(dst, src *Book) { dst.ISBN = src.ISBN },
+	"Title":       func(dst, src *Book) { dst.Title = src.Title },
+	"Author":      func(dst, src *Book) { dst.Author = src.Author },
+	"Description": func(dst, src *Book) { dst.Description = src.Description },
+	"Publisher":   func(dst, src *Book) { dst.Publisher = src.Publisher },
+	"PubDate":     func(dst, src *Book) { dst.PubDate = src.PubDate },
+	"Series": func(dst, src *Book) {
+		dst.Series, dst.SeriesIndex = src.Series, src.SeriesIndex
+	},
+	"Tags":        func(dst, src *Book) { dst.Tags = src.Tags },
+	"Identifiers": func(dst, src *Book) { dst.Identifiers = src.Identifiers },
+	"Rating":      func(dst, src *Book) { dst.Rating = src.Rating },
+	"Cover": func(dst, src *Book) {
+		dst.CoverURL, dst.CoverPath, dst.CoverType = src.CoverURL, src.CoverPath, src.CoverType
+	},
+}
+
+// IsMergeableField reports whether a book property can be chosen when
+// merging books.
+func IsMergeableField(field string) bool {
+	_, ok := mergeableFields[field]
+	return ok
+}
+
+// FindDuplicateBooks groups books sharing an ISBN or file content, or
+// having similar titles and authors. Titles and authors are compared for
+// every pair of books, which is fine for personal libraries.
+func FindDuplicateBooks(db *gorm.DB, threshold float64) (*[]DuplicateGroup, error) {
+	books := []Book{}
+	if err := preloadFiles(db).Order("id").Find(&books).Error; err != nil {
+		return nil, handleBookError(err)
+	}
+
+	files := []File{}
+	if err := db.Where("hash is not null and hash <> ''").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	hashes := map[uint64]map[string]bool{}
+	for _, file := range files {
+		if hashes[file.BookID] == nil {
+			hashes[file.BookID] = map[string]bool{}
+		}
+		hashes[file.BookID][file.Hash] = true
+	}
+
+	type key struct {
+		isbn, title, author string
+	}
+	keys := make([]key, len(books))
+	for i, book := range books {
+		keys[i] = key{normalizeISBN(book.ISBN), normalizeText(book.Title), normalizeText(book.Author)}
+	}
+
+	// union-find over pairs of duplicate books
+	parent := make([]int, len(books))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	scores := map[int]float64{}
+	reasons := map[int]map[string]bool{}
+	type edge struct {
+		i, j   int
+		score  float64
+		reason string
+	}
+	edges := []edge{}
+
+	for i := range books {
+		for j := i + 1; j < len(books); j++ {
+			a, b := keys[i], keys[j]
+			switch {
+			case a.isbn != "" && a.isbn == b.isbn:
+				edges = append(edges, edge{i, j, 1, DuplicateByISBN})
+			case shareHash(hashes[books[i].ID], hashes[books[j].ID]):
+				edges = append(edges, edge{i, j, 1, DuplicateByFile})
+			case a.title != "" && b.title != "":
+				score := similarity(a.title, b.title)
+				if a.author != "" && b.author != "" {
+					score = 0.7*score + 0.3*similarity(a.author, b.author)
+				}
+				if score >= threshold {
+					edges = append(edges, edge{i, j, score, DuplicateByTitle})
+				}
+			}
+		}
+	}
+
+	for _, e := range edges {
+		parent[find(e.i)] = find(e.j)
+	}
+	for _, e := range edges {
+		root := find(e.i)
+		if e.score > scores[root] {
+			scores[root] = e.score
+		}
+		if reasons[root] == nil {
+			reasons[root] = map[string]bool{}
+		}
+		reasons[root][e.reason] = true
+	}
+
+	members := map[int][]Book{}
+	roots := []int{}
+	for i, book := range books {
+		root := find(i)
+		if _, ok := reasons[root]; !ok {
+			continue
+		}
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], book)
+	}
+
+	groups := []DuplicateGroup{}
+	for _, root := range roots {
+		group := DuplicateGroup{Books: members[root], Score: scores[root]}
+		for reason := range reasons[root] {
+			group.Reasons = append(group.Reasons, reason)
+		}
+		sort.Strings(group.Reasons)
+		groups = append(groups, group)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Score > groups[j].Score
+	})
+
+	return &groups, nil
+}
+
+// MergeBooks merges books into a survivor. Files, annotations, metadata
+// proposals and deliveries are moved to the survivor, and the merged books
+// are deleted. fields maps a property to the ID of the book whose value is
+// kept. Other empty properties of the survivor are filled from the merged
+// books, and their tags are added to the survivor.
+func MergeBooks(db *gorm.DB, survivorID uint64, bookIDs []uint64, fields map[string]uint64) (*Book, error) {
+	if len(bookIDs) == 0 {
+		return nil, ErrInvalidMerge
+	}
+	ids := map[uint64]bool{survivorID: true}
+	for _, id := range bookIDs {
+		if ids[id] {
+			return nil, ErrInvalidMerge
+		}
+		ids[id] = true
+	}
+	for field, id := range fields {
+		if !IsMergeableField(field) || !ids[id] {
+			return nil, ErrInvalidMerge
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		books := map[uint64]*Book{}
+		for id := range ids {
+			book := Book{}
+			if err := tx.First(&book, id).Error; err != nil {
+				return handleBookError(err)
+			}
+			books[id] = &book
+		}
+		survivor := books[survivorID]
+
+		for _, id := range bookIDs {
+			fillEmptyProperties(survivor, books[id])
+		}
+		for field, id := range fields {
+			mergeableFields[field](survivor, books[id])
+		}
+		if err := tx.Save(survivor).Error; err != nil {
+			return handleBookError(err)
+		}
+
+		// renumber moved files after versions of the survivor, including
+		// deleted ones which keep their numbers
+		files := []File{}
+		if err := tx.Unscoped().Order("version").Find(&files, "book_id=?", survivorID).Error; err != nil {
+			return err
+		}
+		versions := map[string]int{}
+		current := map[string]bool{}
+		for _, file := range files {
+			versions[file.MimeType] = file.Version
+			if file.DeletedAt == nil {
+				current[file.MimeType] = current[file.MimeType] || file.Current
+			}
+		}
+		for _, id := range bookIDs {
+			files := []File{}
+			if err := tx.Order("version").Find(&files, "book_id=?", id).Error; err != nil {
+				return err
+			}
+			for _, file := range files {
+				versions[file.MimeType]++
+				file.BookID = survivorID
+				file.Version = versions[file.MimeType]
+				if file.Current && current[file.MimeType] {
+					file.Current = false
+				}
+				current[file.MimeType] = current[file.MimeType] || file.Current
+				if err := tx.Save(&file).Error; err != nil {
+					return handleFileError(err)
+				}
+			}
+		}
+
+		for _, record := range []interface{}{&Annotation{}, &MetadataProposal{}, &Delivery{}} {
+			err := tx.Model(record).
+				Where("book_id in (?)", bookIDs).
+				Update("book_id", survivorID).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return handleBookError(tx.Where("id in (?)", bookIDs).Delete(&Book{}).Error)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return GetBookByID(db, survivorID)
+}
+
+func fillEmptyProperties(dst, src *Book) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&dst.ISBN, src.ISBN)
+	fill(&dst.Title, src.Title)
+	fill(&dst.Author, src.Author)
+	fill(&dst.Description, src.Description)
+	fill(&dst.Publisher, src.Publisher)
+	fill(&dst.PubDate, src.PubDate)
+	dst.Tags = mergeTags(dst.Tags, src.Tags)
+	fill(&dst.Identifiers, src.Identifiers)
+	if dst.Series == "" {
+		mergeableFields["Series"](dst, src)
+	}
+	if dst.Rating == 0 {
+		dst.Rating = src.Rating
+	}
+	if dst.CoverURL == "" && dst.CoverPath == "" {
+		mergeableFields["Cover"](dst, src)
+	}
+}
+
+// mergeTags adds comma separated tags which are not in dst yet.
+func mergeTags(dst, src string) string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(dst+","+src, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+func shareHash(a, b map[string]bool) bool {
+	for hash := range a {
+		if b[hash] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeISBN returns an ISBN-13 so that ISBN-10 and ISBN-13 of a book
+// match, or an empty string for invalid ISBNs.
+func normalizeISBN(isbn string) string {
+	normalized, err := NormalizeISBN(isbn)
+	if err != nil {
+		return ""
+	}
+	return normalized
+}
+
+// normalizeText lowercases text, folds fullwidth ASCII and drops spaces
+// and punctuation.
+func normalizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 0xff01 <= r && r <= 0xff5e {
+			r -= 0xfee0
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// similarity returns the Dice coefficient of rune bigrams, which works for
+// both space separated and Japanese text.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < 2 || len(rb) < 2 {
+		return 0
+	}
+
+	bigrams := map[[2]rune]int{}
+	for i := 0; i+1 < len(ra); i++ {
+		bigrams[[2]rune{ra[i], ra[i+1]}]++
+	}
+	common := 0
+	for i := 0; i+1 < len(rb); i++ {
+		bigram := [2]rune{rb[i], rb[i+1]}
+		if bigrams[bigram] > 0 {
+			bigrams[bigram]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(ra)+len(rb)-2)
+}
@@ -0,0 +1,70 @@
+package model
+
+import "testing"
+
+func TestMergeBooks(t *testing.T) {
+	db := openTestDB(t)
+	survivor := addTestBook(t, db, Book{Title: "猫", Tags: "novel,classic"})
+	merged := addTestBook(t, db, Book{Title: "吾輩は猫である", Tags: "classic, japanese"})
+
+	// deleted versions of the survivor keep their numbers
+	const mime = "application/epub+zip"
+	for i := 0; i < 2; i++ {
+		if err := AddFile(db, &File{BookID: survivor.ID, MimeType: mime, Path: "deleted"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteFile(db, survivor.ID, mime); err != nil {
+		t.Fatal(err)
+	}
+	moved := File{BookID: merged.ID, MimeType: mime, Path: "moved"}
+	if err := AddFile(db, &moved); err != nil {
+		t.Fatal(err)
+	}
+
+	proposal := MetadataProposal{JobID: 1, BookID: merged.ID, Field: "Title", Status: ProposalPending}
+	if err := db.Save(&proposal).Error; err != nil {
+		t.Fatal(err)
+	}
+	delivery := Delivery{UserID: 1, DeviceID: 1, BookID: merged.ID, Status: DeliveryQueued}
+	if err := db.Save(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	annotation := Annotation{UserID: 1, BookID: merged.ID, Kind: "highlight"}
+	if err := db.Save(&annotation).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := MergeBooks(db, survivor.ID, []uint64{merged.ID}, map[string]uint64{"Title": merged.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "吾輩は猫である" {
+		t.Errorf("title: got %q", book.Title)
+	}
+	if book.Tags != "novel,classic,japanese" {
+		t.Errorf("tags: got %q", book.Tags)
+	}
+
+	file, err := GetFile(db, survivor.ID, mime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ID != moved.ID || file.Version != 3 {
+		t.Errorf("moved file: got ID %d version %d, expected ID %d version 3", file.ID, file.Version, moved.ID)
+	}
+
+	for _, record := range []interface{}{&MetadataProposal{}, &Delivery{}, &Annotation{}} {
+		count := 0
+		if err := db.Model(record).Where("book_id=?", survivor.ID).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%T of the survivor: got %d, expected 1", record, count)
+		}
+	}
+
+	if _, err := GetBookByID(db, merged.ID); err == nil {
+		t.Error("merged book is not deleted")
+	}
+}
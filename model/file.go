@@ -1,8 +1,11 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -10,42 +13,105 @@ import (
 )
 
 type File struct {
-	ID        uint64     `json:"ID"`
-	CreatedAt time.Time  `json:"CreatedAt"`
-	UpdatedAt time.Time  `json:"UpdatedAt"`
-	DeletedAt *time.Time `json:"-" sql:"index"`
-	BookID    uint64     `json:"BookID"`
-	MimeType  string     `json:"MimeType"`
-	Path      string     `json:"-"`
-	Link      string     `json:"Link" gorm:"-"`
-}
-
-func AddFile(db *gorm.DB, file *File) error {
-	// check the same MimeType existence
-	err := db.Take(&File{}, "book_id=? and mime_type=?", file.BookID, file.MimeType).Error
-	switch {
-	case err == nil:
-		return ErrFileConflict
-	case !gorm.IsRecordNotFoundError(err):
-		return err
+	ID           uint64     `json:"ID"`
+	CreatedAt    time.Time  `json:"CreatedAt"`
+	UpdatedAt    time.Time  `json:"UpdatedAt"`
+	DeletedAt    *time.Time `json:"-" sql:"index"`
+	BookID       uint64     `json:"BookID"`
+	MimeType     string     `json:"MimeType"`
+	Path         string     `json:"-"`
+	DocumentHash string     `json:"DocumentHash" gorm:"index"`
+	Hash         string     `json:"Hash" gorm:"index"`
+	Size         int64      `json:"Size"`
+	Charset      string     `json:"Charset"`
+	PageCount    int        `json:"PageCount"`
+	Version      int        `json:"Version"`
+	Current      bool       `json:"Current"`
+	Link         string     `json:"Link" gorm:"-"`
+	StreamLink   string     `json:"-" gorm:"-"`
+
+	// DocumentHashVersion is the version of the algorithm computing
+	// DocumentHash.
+	DocumentHashVersion int `json:"DocumentHashVersion"`
+}
+
+// addFileAttempts is the number of tries to add a file while concurrent
+// uploads take the same version.
+const addFileAttempts = 5
+
+// AddFile adds a file as the new current version of its format.
+func AddFile(db *gorm.DB, file *File) (err error) {
+	for i := 0; i < addFileAttempts; i++ {
+		err = addFile(db, file)
+		if !isUniqueViolation(err) {
+			return err
+		}
 	}
+	return err
+}
 
-	// add file to database
+func addFile(db *gorm.DB, file *File) error {
 	return db.Transaction(func(tx *gorm.DB) error {
-		return handleFileError(tx.Save(&file).Error)
+		// deleted versions keep their numbers, which are unique
+		latest := File{}
+		err := tx.Unscoped().Order("version desc").Take(&latest, "book_id=? and mime_type=?", file.BookID, file.MimeType).Error
+		switch {
+		case err == nil:
+			file.Version = latest.Version + 1
+		case gorm.IsRecordNotFoundError(err):
+			file.Version = 1
+		default:
+			return err
+		}
+
+		err = tx.Model(&File{}).
+			Where("book_id=? and mime_type=?", file.BookID, file.MimeType).
+			Update("current", false).Error
+		if err != nil {
+			return err
+		}
+
+		file.Current = true
+		return handleFileError(tx.Save(file).Error)
 	})
 }
 
+// DeleteFile deletes all versions of a format.
 func DeleteFile(db *gorm.DB, bookID uint64, mime string) error {
 	return db.Transaction(func(tx *gorm.DB) error {
-		err := db.Delete(File{}, "book_id=? and mime_type=?", bookID, mime).Error
+		err := tx.Delete(File{}, "book_id=? and mime_type=?", bookID, mime).Error
 		return handleFileError(err)
 	})
 }
 
+// GetFile returns the current version of a format.
 func GetFile(db *gorm.DB, bookID uint64, mime string) (*File, error) {
 	file := File{}
-	err := db.Last(&file, "book_id=? and mime_type=?", bookID, mime).Error
+	err := db.Last(&file, "book_id=? and mime_type=? and current=?", bookID, mime, true).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrFileNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &file, nil
+}
+
+func GetFileByID(db *gorm.DB, fileID uint64) (*File, error) {
+	file := File{}
+	err := db.First(&file, fileID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrFileNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &file, nil
+}
+
+func GetFileVersion(db *gorm.DB, bookID uint64, mime string, version int) (*File, error) {
+	file := File{}
+	err := db.Take(&file, "book_id=? and mime_type=? and version=?", bookID, mime, version).Error
 	switch {
 	case gorm.IsRecordNotFoundError(err):
 		return nil, ErrFileNotFound
@@ -55,12 +121,149 @@ func GetFile(db *gorm.DB, bookID uint64, mime string) (*File, error) {
 	return &file, nil
 }
 
+// GetFileVersions returns all versions of a format, newest first.
+func GetFileVersions(db *gorm.DB, bookID uint64, mime string) (*[]File, error) {
+	files := []File{}
+	err := db.Order("version desc").Find(&files, "book_id=? and mime_type=?", bookID, mime).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrFileNotFound
+	}
+	return &files, nil
+}
+
+// PromoteFileVersion makes an older version the current one.
+func PromoteFileVersion(db *gorm.DB, bookID uint64, mime string, version int) (*File, error) {
+	file, err := GetFileVersion(db, bookID, mime, version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&File{}).
+			Where("book_id=? and mime_type=?", bookID, mime).
+			Update("current", false).Error
+		if err != nil {
+			return err
+		}
+		file.Current = true
+		return tx.Save(file).Error
+	})
+	if err != nil {
+		return nil, handleFileError(err)
+	}
+	return file, nil
+}
+
+// GetPrunableFiles returns old versions of a format exceeding the number
+// of versions to keep. The current version is never pruned.
+func GetPrunableFiles(db *gorm.DB, bookID uint64, mime string, keep int) (*[]File, error) {
+	files := []File{}
+	err := db.Order("version desc").
+		Find(&files, "book_id=? and mime_type=? and current=?", bookID, mime, false).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(files) <= keep {
+		files = []File{}
+	} else {
+		files = files[keep:]
+	}
+	return &files, nil
+}
+
+// PurgeFile removes a file row permanently.
+func PurgeFile(db *gorm.DB, file *File) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleFileError(tx.Unscoped().Delete(file).Error)
+	})
+}
+
+func GetFileByDocumentHash(db *gorm.DB, hash string) (*File, error) {
+	file := File{}
+	err := db.Last(&file, "document_hash=?", hash).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrFileNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetDuplicateFile returns a file of another book having the same content.
+func GetDuplicateFile(db *gorm.DB, bookID uint64, hash string) (*File, error) {
+	file := File{}
+	err := db.Last(&file, "hash=? and book_id<>?", hash, bookID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrFileNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &file, nil
+}
+
+// CountFileReferences returns the number of files which are not deleted
+// referencing a blob.
+func CountFileReferences(db *gorm.DB, path string) (int, error) {
+	count := 0
+	err := db.Model(&File{}).Where("path=?", path).Count(&count).Error
+	return count, err
+}
+
+// PurgeDeletedFiles removes rows of deleted files stored at a path
+// permanently.
+func PurgeDeletedFiles(db *gorm.DB, path string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Unscoped().
+			Where("path=? and deleted_at is not null", path).
+			Delete(&File{}).Error
+	})
+}
+
+// GetFilesWithoutHash returns files uploaded before document or content
+// hashes were recorded.
+func GetFilesWithoutHash(db *gorm.DB, documentHashVersion int) (*[]File, error) {
+	files := []File{}
+	err := db.Where("document_hash is null or document_hash = '' or hash is null or hash = '' or document_hash_version < ?", documentHashVersion).Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+func UpdateFile(db *gorm.DB, file *File) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleFileError(tx.Save(file).Error)
+	})
+}
+
 func GenerateFilePath(bookID uint64, mimeAlias string) string {
 	filename := generateULID()
 	path := fmt.Sprintf("%d/%s/%s", bookID, mimeAlias, filename)
 	return path
 }
 
+// HashContent returns the SHA-256 digest of file content.
+func HashContent(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateBlobPath returns the content-addressed path of a blob.
+func GenerateBlobPath(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s", hash[:2], hash)
+}
+
+func GenerateCoverPath(bookID uint64) string {
+	filename := generateULID()
+	path := fmt.Sprintf("%d/cover/%s", bookID, filename)
+	return path
+}
+
 func generateULID() string {
 	t := time.Now()
 	entropy := ulid.Monotonic(rand.New(rand.NewSource(t.UnixNano())), 0)
@@ -68,6 +271,16 @@ func generateULID() string {
 	return id.String()
 }
 
+// isUniqueViolation reports whether an error is caused by a unique index,
+// whose messages differ between database drivers.
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") || strings.Contains(msg, "duplicate key")
+}
+
 func handleFileError(err error) error {
 	switch {
 	case gorm.IsRecordNotFoundError(err):
@@ -76,3 +289,64 @@ func handleFileError(err error) error {
 		return err
 	}
 }
+
+// StoredBlob is a path in the storage referenced by files or covers with
+// the size and digest of its content if known.
+type StoredBlob struct {
+	Path string
+	Size int64
+	Hash string
+}
+
+// GetStoredBlobs returns paths referenced by files and covers, including
+// those of deleted books and files whose content may still be stored.
+func GetStoredBlobs(db *gorm.DB) ([]StoredBlob, error) {
+	files := []File{}
+	if err := db.Unscoped().Select("path, size, hash").Where("path <> ''").Order("id").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	books := []Book{}
+	if err := db.Unscoped().Select("cover_path").Where("cover_path <> ''").Order("id").Find(&books).Error; err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	blobs := []StoredBlob{}
+	for _, file := range files {
+		if !seen[file.Path] {
+			seen[file.Path] = true
+			blobs = append(blobs, StoredBlob{Path: file.Path, Size: file.Size, Hash: file.Hash})
+		}
+	}
+	for _, book := range books {
+		if !seen[book.CoverPath] {
+			seen[book.CoverPath] = true
+			blobs = append(blobs, StoredBlob{Path: book.CoverPath})
+		}
+	}
+	return blobs, nil
+}
+
+// GetRecentBlobs returns paths of current files and covers of the most
+// recently added books, newest first.
+func GetRecentBlobs(db *gorm.DB, limit int) ([]string, error) {
+	books := []Book{}
+	if err := db.Select("id, cover_path").Order("created_at desc").Limit(limit).Find(&books).Error; err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, book := range books {
+		files := []File{}
+		if err := db.Select("path").Find(&files, "book_id=? and current=?", book.ID, true).Error; err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		if book.CoverPath != "" {
+			paths = append(paths, book.CoverPath)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,42 @@
+package model
+
+import "testing"
+
+func TestAddFileAfterDelete(t *testing.T) {
+	db := openTestDB(t)
+	book := addTestBook(t, db, Book{Title: "book"})
+
+	const mime = "application/epub+zip"
+	for i := 0; i < 2; i++ {
+		file := File{BookID: book.ID, MimeType: mime, Path: "old"}
+		if err := AddFile(db, &file); err != nil {
+			t.Fatalf("add version %d: %v", i+1, err)
+		}
+	}
+	if err := DeleteFile(db, book.ID, mime); err != nil {
+		t.Fatal(err)
+	}
+
+	file := File{BookID: book.ID, MimeType: mime, Path: "new"}
+	if err := AddFile(db, &file); err != nil {
+		t.Fatalf("add after delete: %v", err)
+	}
+	if file.Version != 3 {
+		t.Errorf("version: got %d, expected 3", file.Version)
+	}
+
+	current, err := GetFile(db, book.ID, mime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.ID != file.ID {
+		t.Errorf("current file: got %d, expected %d", current.ID, file.ID)
+	}
+	versions, err := GetFileVersions(db, book.ID, mime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*versions) != 1 {
+		t.Errorf("versions: got %d, expected 1", len(*versions))
+	}
+}
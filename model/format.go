@@ -0,0 +1,112 @@
+package model
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/altescy/bookshelf/format"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// CustomFormat is a file format added by an administrator at runtime.
+type CustomFormat struct {
+	ID         uint64    `json:"ID" gorm:"primary_key"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	UpdatedAt  time.Time `json:"UpdatedAt"`
+	Alias      string    `json:"Alias" gorm:"not null;unique_index"`
+	MimeType   string    `json:"MimeType" gorm:"not null;unique_index"`
+	Extensions string    `json:"Extensions"`
+}
+
+func (c *CustomFormat) Format() format.Format {
+	return format.Format{
+		Alias:      c.Alias,
+		Mime:       c.MimeType,
+		Extensions: strings.Split(c.Extensions, ","),
+	}
+}
+
+// AddCustomFormat registers a format and persists it so that it is
+// registered again on restart.
+func AddCustomFormat(db *gorm.DB, custom *CustomFormat) error {
+	f := custom.Format()
+	if err := format.Default.Register(f); err != nil {
+		return handleFormatError(err)
+	}
+
+	registered, _ := format.Default.ByAlias(f.Alias)
+	custom.Alias = registered.Alias
+	custom.MimeType = registered.Mime
+	custom.Extensions = strings.Join(registered.Extensions, ",")
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return handleFormatError(tx.Save(custom).Error)
+	})
+	if err != nil {
+		format.Default.Unregister(custom.Alias)
+	}
+	return err
+}
+
+// DeleteCustomFormat removes a custom format unless files of it exist.
+func DeleteCustomFormat(db *gorm.DB, alias string) error {
+	custom := CustomFormat{}
+	if err := db.Take(&custom, "alias=?", alias).Error; err != nil {
+		return handleFormatError(err)
+	}
+
+	err := db.Take(&File{}, "mime_type=?", custom.MimeType).Error
+	switch {
+	case err == nil:
+		return ErrFormatInUse
+	case !gorm.IsRecordNotFoundError(err):
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return handleFormatError(tx.Delete(&custom).Error)
+	})
+	if err != nil {
+		return err
+	}
+	return handleFormatError(format.Default.Unregister(alias))
+}
+
+// RegisterCustomFormats loads custom formats from the database into the
+// format registry.
+func RegisterCustomFormats(db *gorm.DB) error {
+	customs := []CustomFormat{}
+	if err := db.Find(&customs).Error; err != nil {
+		return err
+	}
+	for _, custom := range customs {
+		if err := format.Default.Register(custom.Format()); err != nil {
+			log.Printf("[WARN] cannot register custom format %s: %v", custom.Alias, err)
+		}
+	}
+	return nil
+}
+
+func handleFormatError(err error) error {
+	if pgError, ok := err.(*pq.Error); ok {
+		switch pgError.Code {
+		case "23505":
+			return ErrFormatConflict
+		}
+	}
+
+	switch {
+	case err == format.ErrFormatConflict:
+		return ErrFormatConflict
+	case err == format.ErrFormatNotFound, gorm.IsRecordNotFoundError(err):
+		return ErrFormatNotFound
+	case err == format.ErrInvalidFormat:
+		return ErrInvalidFormat
+	case err == format.ErrBuiltinFormat:
+		return ErrBuiltinFormat
+	default:
+		return err
+	}
+}
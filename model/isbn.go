@@ -0,0 +1,62 @@
+package model
+
+import "strings"
+
+// NormalizeISBN validates the check digit of an ISBN-10 or ISBN-13 and
+// returns it as an ISBN-13 without hyphens.
+func NormalizeISBN(isbn string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(isbn))
+	s = strings.TrimPrefix(s, "URN:ISBN:")
+	s = strings.TrimPrefix(s, "ISBN")
+	s = strings.TrimLeft(s, ":")
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, r := range s {
+			var d int
+			switch {
+			case '0' <= r && r <= '9':
+				d = int(r - '0')
+			case r == 'X' && i == 9:
+				d = 10
+			default:
+				return "", ErrInvalidISBN
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", ErrInvalidISBN
+		}
+		s = "978" + s[:9]
+		return s + string(isbn13CheckDigit(s)), nil
+	case 13:
+		if strings.Trim(s, "0123456789") != "" {
+			return "", ErrInvalidISBN
+		}
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", ErrInvalidISBN
+		}
+		if isbn13CheckDigit(s[:12]) != s[12] {
+			return "", ErrInvalidISBN
+		}
+		return s, nil
+	default:
+		return "", ErrInvalidISBN
+	}
+}
+
+// isbn13CheckDigit returns the check digit of the first 12 digits of an
+// ISBN-13.
+func isbn13CheckDigit(s string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(s[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,50 @@
+package model
+
+import "testing"
+
+func TestNormalizeISBN(t *testing.T) {
+	cases := []struct {
+		isbn     string
+		expected string
+	}{
+		{"9780306406157", "9780306406157"},
+		{"978-0-306-40615-7", "9780306406157"},
+		{"0306406152", "9780306406157"},
+		{"0-306-40615-2", "9780306406157"},
+		{"080442957X", "9780804429573"},
+		{"0-8044-2957-x", "9780804429573"},
+		{"ISBN 4-10-101001-3", "9784101010014"},
+		{"urn:isbn:978-4-10-101001-4", "9784101010014"},
+		{"979-10-90636-07-1", "9791090636071"},
+		{" 9784101010014 ", "9784101010014"},
+	}
+	for _, c := range cases {
+		actual, err := NormalizeISBN(c.isbn)
+		if err != nil {
+			t.Errorf("%q: %v", c.isbn, err)
+			continue
+		}
+		if actual != c.expected {
+			t.Errorf("%q: got %q, expected %q", c.isbn, actual, c.expected)
+		}
+	}
+}
+
+func TestNormalizeISBNInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"0306406153",        // wrong check digit
+		"X306406152",        // X not in the check digit
+		"080442957-0",       // X expected
+		"9780306406158",     // wrong check digit
+		"9770306406150",     // not a book
+		"97803064061570",    // too long
+		"978030640615",      // too short
+		"978-0-306-4O615-7", // letter O
+	}
+	for _, isbn := range cases {
+		if actual, err := NormalizeISBN(isbn); err != ErrInvalidISBN {
+			t.Errorf("%q: got %q and %v, expected ErrInvalidISBN", isbn, actual, err)
+		}
+	}
+}
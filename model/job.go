@@ -0,0 +1,145 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// States of jobs.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// Job is a unit of background work. Queued jobs are run once RunAt has
+// passed, and failed attempts are queued again until MaxAttempts.
+type Job struct {
+	ID          uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt   time.Time  `json:"CreatedAt"`
+	UpdatedAt   time.Time  `json:"UpdatedAt"`
+	DeletedAt   *time.Time `json:"-" sql:"index"`
+	Type        string     `json:"Type" gorm:"not null;index"`
+	Payload     string     `json:"Payload"`
+	Status      string     `json:"Status" gorm:"not null;index"`
+	Attempts    int        `json:"Attempts"`
+	MaxAttempts int        `json:"MaxAttempts"`
+	RunAt       time.Time  `json:"RunAt" gorm:"index"`
+	Progress    int        `json:"Progress"`
+	Total       int        `json:"Total"`
+	Error       string     `json:"Error"`
+}
+
+func AddJob(db *gorm.DB, job *Job) error {
+	job.Status = JobQueued
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Save(job).Error
+	})
+}
+
+func GetJob(db *gorm.DB, jobID uint64) (*Job, error) {
+	job := Job{}
+	err := db.First(&job, jobID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrJobNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJobs returns recent jobs filtered by non-empty arguments.
+func GetJobs(db *gorm.DB, jobType, status string, count uint64) (*[]Job, error) {
+	q := db
+	if jobType != "" {
+		q = q.Where("type=?", jobType)
+	}
+	if status != "" {
+		q = q.Where("status=?", status)
+	}
+	if count > 0 {
+		q = q.Limit(count)
+	}
+
+	jobs := []Job{}
+	if err := q.Order("id desc").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return &jobs, nil
+}
+
+// ClaimJob marks the oldest due job of a type as running and returns it.
+// ErrJobNotFound is returned when no job is due.
+func ClaimJob(db *gorm.DB, jobType string) (*Job, error) {
+	for {
+		job := Job{}
+		err := db.Order("run_at, id").
+			Take(&job, "type=? and status=? and run_at<=?", jobType, JobQueued, time.Now()).Error
+		switch {
+		case gorm.IsRecordNotFoundError(err):
+			return nil, ErrJobNotFound
+		case err != nil:
+			return nil, err
+		}
+
+		// another worker may have claimed the job in the meantime
+		res := db.Model(&Job{}).
+			Where("id=? and status=?", job.ID, JobQueued).
+			Updates(map[string]interface{}{"status": JobRunning, "attempts": job.Attempts + 1})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			job.Status = JobRunning
+			job.Attempts++
+			return &job, nil
+		}
+	}
+}
+
+// UpdateJobProgress records the progress of a running job.
+func UpdateJobProgress(db *gorm.DB, jobID uint64, progress, total int) error {
+	return db.Model(&Job{}).
+		Where("id=?", jobID).
+		Updates(map[string]interface{}{"progress": progress, "total": total}).Error
+}
+
+// FinishJob records the end of an attempt. A job failed with retry is
+// queued again to run at runAt.
+func FinishJob(db *gorm.DB, job *Job, status string, runAt time.Time, cause error) error {
+	values := map[string]interface{}{"status": status, "error": ""}
+	if cause != nil {
+		values["error"] = cause.Error()
+	}
+	if status == JobQueued {
+		values["run_at"] = runAt
+	}
+	err := db.Model(&Job{}).Where("id=?", job.ID).Updates(values).Error
+	if err != nil {
+		return err
+	}
+	return db.First(job, job.ID).Error
+}
+
+// CancelQueuedJob cancels a job which has not started. It returns false
+// if the job is not queued.
+func CancelQueuedJob(db *gorm.DB, jobID uint64) (bool, error) {
+	res := db.Model(&Job{}).
+		Where("id=? and status=?", jobID, JobQueued).
+		Update("status", JobCanceled)
+	return res.RowsAffected == 1, res.Error
+}
+
+// RequeueRunningJobs queues jobs left running by a previous process again.
+func RequeueRunningJobs(db *gorm.DB) error {
+	return db.Model(&Job{}).
+		Where("status=?", JobRunning).
+		Update("status", JobQueued).Error
+}
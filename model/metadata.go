@@ -0,0 +1,148 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// States of metadata proposals.
+const (
+	ProposalPending  = "pending"
+	ProposalApproved = "approved"
+	ProposalRejected = "rejected"
+)
+
+// Properties of books which metadata proposals can change. The cover is
+// proposed as an image URL and applied by the controller.
+var proposalFields = map[string]func(book *Book, value string){
+	"Title":       func(book *Book, value string) { book.Title = value },
+	"Author":      func(book *Book, value string) { book.Author = value },
+	"Publisher":   func(book *Book, value string) { book.Publisher = value },
+	"PubDate":     func(book *Book, value string) { book.PubDate = value },
+	"Description": func(book *Book, value string) { book.Description = value },
+	"Cover":       nil,
+}
+
+// MetadataProposal is a change of a book property found by a metadata
+// refresh job, which is applied only when approved.
+type MetadataProposal struct {
+	ID        uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	UpdatedAt time.Time  `json:"UpdatedAt"`
+	DeletedAt *time.Time `json:"-" sql:"index"`
+	JobID     uint64     `json:"JobID" gorm:"not null;index"`
+	BookID    uint64     `json:"BookID" gorm:"not null;index"`
+	Field     string     `json:"Field" gorm:"not null"`
+	OldValue  string     `json:"OldValue"`
+	NewValue  string     `json:"NewValue"`
+	Provider  string     `json:"Provider"`
+	Status    string     `json:"Status" gorm:"not null"`
+}
+
+// GetBooksWithISBN returns books having an ISBN, optionally restricted to
+// IDs or to titles and authors containing a query.
+func GetBooksWithISBN(db *gorm.DB, bookIDs []uint64, query string) (*[]Book, error) {
+	q := db.Where("isbn is not null and isbn <> ''")
+	if len(bookIDs) > 0 {
+		q = q.Where("id in (?)", bookIDs)
+	}
+	if query != "" {
+		pattern := "%" + query + "%"
+		q = q.Where("title like ? or author like ?", pattern, pattern)
+	}
+
+	books := []Book{}
+	if err := q.Order("id").Find(&books).Error; err != nil {
+		return nil, handleBookError(err)
+	}
+	return &books, nil
+}
+
+// IsProposalField reports whether metadata proposals can change a book
+// property.
+func IsProposalField(field string) bool {
+	_, ok := proposalFields[field]
+	return ok
+}
+
+// AddMetadataProposal adds a pending proposal, replacing pending proposals
+// of the same book property.
+func AddMetadataProposal(db *gorm.DB, proposal *MetadataProposal) error {
+	if !IsProposalField(proposal.Field) {
+		return ErrInvalidProposal
+	}
+	proposal.Status = ProposalPending
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(MetadataProposal{}, "book_id=? and field=? and status=?",
+			proposal.BookID, proposal.Field, ProposalPending).Error
+		if err != nil {
+			return err
+		}
+		return tx.Save(proposal).Error
+	})
+}
+
+func GetMetadataProposal(db *gorm.DB, proposalID uint64) (*MetadataProposal, error) {
+	proposal := MetadataProposal{}
+	err := db.First(&proposal, proposalID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrProposalNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &proposal, nil
+}
+
+// GetMetadataProposals returns proposals filtered by non-zero arguments.
+func GetMetadataProposals(db *gorm.DB, jobID, bookID uint64, status string) (*[]MetadataProposal, error) {
+	q := db
+	if jobID != 0 {
+		q = q.Where("job_id=?", jobID)
+	}
+	if bookID != 0 {
+		q = q.Where("book_id=?", bookID)
+	}
+	if status != "" {
+		q = q.Where("status=?", status)
+	}
+
+	proposals := []MetadataProposal{}
+	if err := q.Order("id").Find(&proposals).Error; err != nil {
+		return nil, err
+	}
+	return &proposals, nil
+}
+
+// ApproveMetadataProposal applies a pending proposal to its book. Covers
+// are not applied here since they have to be downloaded.
+func ApproveMetadataProposal(db *gorm.DB, proposal *MetadataProposal) error {
+	if proposal.Status != ProposalPending {
+		return ErrProposalNotPending
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if apply := proposalFields[proposal.Field]; apply != nil {
+			book := Book{}
+			if err := tx.First(&book, proposal.BookID).Error; err != nil {
+				return handleBookError(err)
+			}
+			apply(&book, proposal.NewValue)
+			if err := tx.Save(&book).Error; err != nil {
+				return handleBookError(err)
+			}
+		}
+		proposal.Status = ProposalApproved
+		return tx.Save(proposal).Error
+	})
+}
+
+func RejectMetadataProposal(db *gorm.DB, proposal *MetadataProposal) error {
+	if proposal.Status != ProposalPending {
+		return ErrProposalNotPending
+	}
+	proposal.Status = ProposalRejected
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Save(proposal).Error
+	})
+}
@@ -3,6 +3,78 @@ package model
 import "github.com/jinzhu/gorm"
 
 func AutoMigrate(db *gorm.DB) (err error) {
-	err = db.AutoMigrate(&Book{}).AutoMigrate(&File{}).Error
+	err = db.AutoMigrate(&Book{}).
+		AutoMigrate(&File{}).
+		AutoMigrate(&User{}).
+		AutoMigrate(&Progress{}).
+		AutoMigrate(&Annotation{}).
+		AutoMigrate(&CustomFormat{}).
+		AutoMigrate(&MetadataProposal{}).
+		AutoMigrate(&Job{}).
+		AutoMigrate(&Device{}).
+		AutoMigrate(&Delivery{}).Error
+	if err != nil {
+		return
+	}
+
+	// files added before versioning are the only and current versions
+	err = db.Unscoped().Model(&File{}).
+		Where("version = 0").
+		Updates(map[string]interface{}{"version": 1, "current": true}).Error
+	if err != nil {
+		return
+	}
+
+	// versions taken twice by concurrent uploads are renumbered before
+	// they are made unique
+	if err = renumberFileVersions(db); err != nil {
+		return
+	}
+	err = db.Model(&File{}).
+		AddUniqueIndex("idx_files_book_id_mime_type_version", "book_id", "mime_type", "version").Error
 	return
 }
+
+// renumberFileVersions numbers versions of formats having duplicated
+// versions again in the order of their versions and IDs.
+func renumberFileVersions(db *gorm.DB) error {
+	type format struct {
+		BookID   uint64
+		MimeType string
+	}
+	formats := []format{}
+	err := db.Unscoped().Model(&File{}).
+		Select("distinct book_id, mime_type").
+		Group("book_id, mime_type, version").
+		Having("count(*) > 1").
+		Scan(&formats).Error
+	if err != nil {
+		return err
+	}
+
+	for _, f := range formats {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			files := []File{}
+			err := tx.Unscoped().
+				Where("book_id=? and mime_type=?", f.BookID, f.MimeType).
+				Order("version, id").
+				Find(&files).Error
+			if err != nil {
+				return err
+			}
+			for i, file := range files {
+				err := tx.Unscoped().Model(&File{}).
+					Where("id=?", file.ID).
+					UpdateColumn("version", i+1).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
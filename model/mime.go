@@ -1,88 +1,78 @@
 package model
 
 import (
-	"mime"
-	"path/filepath"
-	"strings"
+	"github.com/altescy/bookshelf/format"
 )
 
-var extToMime = map[string]string{
-	".azw3": "application/x-mobi8-ebook",
-	".epub": "application/epub+zip",
-	".fb2":  "application/fb2+zip",
-	".mobi": "application/x-mobipocket-ebook",
-	".pdf":  "application/pdf",
-	".txt":  "text/plain",
+// comicMimes are formats of comic book archives whose pages are images.
+var comicMimes = map[string]bool{
+	"application/x-cb7":             true,
+	"application/vnd.comicbook-rar": true,
+	"application/vnd.comicbook+zip": true,
 }
 
-var MimeAlias = map[string]string{
-	"application/x-mobi8-ebook":      "azw3",
-	"application/epub+zip":           "epub",
-	"application/fb2+zip":            "fb2",
-	"application/x-mobipocket-ebook": "mobi",
-	"application/pdf":                "pdf",
-	"text/plain":                     "txt",
+func IsComicMime(mime string) bool {
+	return comicMimes[mime]
 }
 
-func GetMimeAlias(mime string) (string, error) {
-	alias := MimeAlias[mime]
-	if alias == "" {
-		return "", ErrMimeNotFound
-	}
-	return alias, nil
+// IsZipComicMime reports whether comic archives of a format are ZIP files,
+// which are read in place unlike other archives.
+func IsZipComicMime(mime string) bool {
+	return mime == "application/vnd.comicbook+zip"
+}
 
+// textMimes are formats of plain text whose character set is detected.
+var textMimes = map[string]bool{
+	"text/plain": true,
 }
 
-func GetMimeAliasByFilename(filename string) (string, error) {
-	mime, err := MimeByFilename(filename)
+func IsTextMime(mime string) bool {
+	return textMimes[mime]
+}
+
+func GetMimeAlias(mime string) (string, error) {
+	f, err := format.Default.ByMime(mime)
 	if err != nil {
-		return "", nil
+		return "", ErrMimeNotFound
 	}
+	return f.Alias, nil
+}
 
-	mimeAlias, err := GetMimeAlias(mime)
+func GetMimeAliasByFilename(filename string) (string, error) {
+	f, err := format.Default.ByFilename(filename)
 	if err != nil {
-		return "", nil
+		return "", ErrInvalidExt
 	}
-
-	return mimeAlias, nil
+	return f.Alias, nil
 }
 
+// GetMimes returns MIME types of all supported extensions.
 func GetMimes() map[string]string {
-	return copyMimes(extToMime)
+	mimes := map[string]string{}
+	for _, f := range format.Default.Formats() {
+		for _, ext := range f.Extensions {
+			mimes[ext] = f.Mime
+		}
+	}
+	return mimes
 }
 
+// MimeByExt returns the MIME type of an extension or of a format alias
+// prefixed with a dot as used in URLs.
 func MimeByExt(ext string) (string, error) {
-	mime := extToMime[ext]
-	if mime == "" {
+	f, err := format.Default.ByExt(ext)
+	if err != nil {
 		return "", ErrMimeNotFound
 	}
-	return mime, nil
+	return f.Mime, nil
 }
 
+// MimeByFilename returns the MIME type of a supported file. Unlike
+// mime.TypeByExtension, files of unknown formats are rejected.
 func MimeByFilename(filename string) (string, error) {
-	ext := strings.ToLower(filepath.Ext(filename))
-
-	mimeType, ok := extToMime[ext]
-	if ok {
-		return mimeType, nil
-	}
-
-	mimeType = mime.TypeByExtension(ext)
-	if mimeType == "" {
+	f, err := format.Default.ByFilename(filename)
+	if err != nil {
 		return "", ErrInvalidExt
 	}
-	// The mimeType returned by TypeByExtension may contain
-	// some arguments like "text/plain; charset=utf-8". But
-	// in this statement, we ignore such arguments.
-	mimeType = strings.Split(mimeType, ";")[0]
-
-	return mimeType, nil
-}
-
-func copyMimes(m map[string]string) map[string]string {
-	cp := map[string]string{}
-	for k, v := range m {
-		cp[k] = v
-	}
-	return cp
+	return f.Mime, nil
 }
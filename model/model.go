@@ -9,4 +9,30 @@ var (
 	ErrFileConflict = errors.New("file conflict")
 	ErrFileNotFound = errors.New("file not found")
 	ErrInvalidExt   = errors.New("invalid ext")
+	ErrInvalidMerge = errors.New("invalid merge")
+	ErrInvalidISBN  = errors.New("invalid isbn")
+
+	ErrUserConflict     = errors.New("user conflict")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrProgressNotFound = errors.New("progress not found")
+
+	ErrAnnotationNotFound = errors.New("annotation not found")
+	ErrInvalidAnnotation  = errors.New("invalid annotation")
+
+	ErrFormatConflict = errors.New("format conflict")
+	ErrFormatNotFound = errors.New("format not found")
+	ErrFormatInUse    = errors.New("format in use")
+	ErrInvalidFormat  = errors.New("invalid format")
+	ErrBuiltinFormat  = errors.New("builtin format cannot be removed")
+
+	ErrProposalNotFound   = errors.New("proposal not found")
+	ErrInvalidProposal    = errors.New("invalid proposal")
+	ErrProposalNotPending = errors.New("proposal is not pending")
+
+	ErrJobNotFound = errors.New("job not found")
+
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrInvalidDevice    = errors.New("invalid device")
+	ErrDeliveryNotFound = errors.New("delivery not found")
 )
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB opens a migrated in-memory database.
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// every connection opens another in-memory database
+	db.DB().SetMaxOpenConns(1)
+	if err := AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func addTestBook(t *testing.T, db *gorm.DB, book Book) *Book {
+	if err := AddBook(db, &book); err != nil {
+		t.Fatal(err)
+	}
+	return &book
+}
@@ -1,6 +1,9 @@
 package model
 
 import (
+	"mime"
+	"path"
+
 	"github.com/altescy/bookshelf/opds"
 )
 
@@ -10,7 +13,10 @@ func EntriesFromBooks(books *[]Book) []opds.Entry {
 	for _, book := range *books {
 		author := opds.Author{Name: book.Author}
 		summary := opds.Summary{Type: "text", Text: book.Description}
-		coverType, _ := MimeByFilename(book.CoverURL)
+		coverType := book.CoverType
+		if coverType == "" {
+			coverType = mime.TypeByExtension(path.Ext(book.CoverURL))
+		}
 		links := []opds.Link{
 			{Href: book.CoverURL, Type: coverType, Rel: opds.CoverRel},
 		}
@@ -21,6 +27,15 @@ func EntriesFromBooks(books *[]Book) []opds.Entry {
 				Rel:  opds.FileRel,
 			}
 			links = append(links, link)
+
+			if file.PageCount > 0 && file.StreamLink != "" {
+				links = append(links, opds.Link{
+					Href:  file.StreamLink,
+					Type:  "image/jpeg",
+					Rel:   opds.PSEStreamRel,
+					Count: file.PageCount,
+				})
+			}
 		}
 		entry := opds.Entry{
 			ID:      "urn:uuid:" + book.UUID,
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Progress is a reading position reported by a KOReader device.
+// Document is the KOReader partial MD5 of the file, which is matched
+// against File.DocumentHash to find the book being read.
+type Progress struct {
+	ID         uint64    `json:"ID" gorm:"primary_key"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	UpdatedAt  time.Time `json:"UpdatedAt"`
+	UserID     uint64    `json:"UserID" gorm:"not null;index"`
+	Document   string    `json:"Document" gorm:"not null;index"`
+	FileID     uint64    `json:"FileID" gorm:"index"`
+	Progress   string    `json:"Progress"`
+	Percentage float64   `json:"Percentage"`
+	Device     string    `json:"Device"`
+	DeviceID   string    `json:"DeviceID"`
+	Timestamp  int64     `json:"Timestamp"`
+}
+
+// BookProgress is a reading position of a book shown in the web UI.
+type BookProgress struct {
+	Username   string  `json:"Username"`
+	FileID     uint64  `json:"FileID"`
+	MimeType   string  `json:"MimeType"`
+	Percentage float64 `json:"Percentage"`
+	Device     string  `json:"Device"`
+	Timestamp  int64   `json:"Timestamp"`
+}
+
+// UpdateProgress stores the latest position of a document for the user,
+// linking it to a known file if the document hash matches one.
+func UpdateProgress(db *gorm.DB, progress *Progress) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if file, err := GetFileByDocumentHash(tx, progress.Document); err == nil {
+			progress.FileID = file.ID
+		} else if err != ErrFileNotFound {
+			return err
+		}
+
+		current := Progress{}
+		err := tx.Take(&current, "user_id=? and document=?", progress.UserID, progress.Document).Error
+		switch {
+		case err == nil:
+			progress.ID = current.ID
+			progress.CreatedAt = current.CreatedAt
+		case !gorm.IsRecordNotFoundError(err):
+			return err
+		}
+
+		return tx.Save(progress).Error
+	})
+}
+
+// LinkProgresses links reading positions which are not linked to any file to
+// the file of the same document hash.
+func LinkProgresses(db *gorm.DB, file *File) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(&Progress{}).
+			Where("document=? and file_id=0", file.DocumentHash).
+			Update("file_id", file.ID).Error
+	})
+}
+
+func GetProgress(db *gorm.DB, userID uint64, document string) (*Progress, error) {
+	progress := Progress{}
+	err := db.Take(&progress, "user_id=? and document=?", userID, document).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, ErrProgressNotFound
+	case err != nil:
+		return nil, err
+	}
+	return &progress, nil
+}
+
+func GetBookProgresses(db *gorm.DB, bookID uint64) (*[]BookProgress, error) {
+	progresses := []BookProgress{}
+	err := db.Table("progresses").
+		Select("users.username, progresses.file_id, files.mime_type, progresses.percentage, progresses.device, progresses.timestamp").
+		Joins("join files on files.id = progresses.file_id").
+		Joins("join users on users.id = progresses.user_id").
+		Where("files.book_id = ? and files.deleted_at is null", bookID).
+		Order("progresses.timestamp desc").
+		Scan(&progresses).Error
+	if err != nil {
+		return nil, err
+	}
+	return &progresses, nil
+}
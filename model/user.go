@@ -0,0 +1,108 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+type User struct {
+	ID        uint64     `json:"ID" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	UpdatedAt time.Time  `json:"UpdatedAt"`
+	DeletedAt *time.Time `json:"-" sql:"index"`
+	Username  string     `json:"Username" gorm:"not null;unique_index"`
+	Salt      string     `json:"-"`
+	KeyHash   string     `json:"-"`
+}
+
+// SetKey stores a salted hash of the given key. KOReader already sends
+// an MD5 digest of the password, so the raw password never reaches us.
+func (u *User) SetKey(key string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	u.Salt = hex.EncodeToString(salt)
+	u.KeyHash = hashKey(u.Salt, key)
+	return nil
+}
+
+func (u *User) CheckKey(key string) bool {
+	hash := hashKey(u.Salt, key)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(u.KeyHash)) == 1
+}
+
+func AddUser(db *gorm.DB, user *User) error {
+	err := db.Take(&User{}, "username=?", user.Username).Error
+	switch {
+	case err == nil:
+		return ErrUserConflict
+	case !gorm.IsRecordNotFoundError(err):
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		return handleUserError(tx.Save(user).Error)
+	})
+}
+
+func GetUserByID(db *gorm.DB, userID uint64) (*User, error) {
+	user := User{}
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, handleUserError(err)
+	}
+	return &user, nil
+}
+
+func GetUserByName(db *gorm.DB, username string) (*User, error) {
+	user := User{}
+	if err := db.Take(&user, "username=?", username).Error; err != nil {
+		return nil, handleUserError(err)
+	}
+	return &user, nil
+}
+
+// AuthenticateUser returns the user only if the key matches.
+func AuthenticateUser(db *gorm.DB, username, key string) (*User, error) {
+	if username == "" || key == "" {
+		return nil, ErrUnauthorized
+	}
+	user, err := GetUserByName(db, username)
+	switch {
+	case err == ErrUserNotFound:
+		return nil, ErrUnauthorized
+	case err != nil:
+		return nil, err
+	}
+	if !user.CheckKey(key) {
+		return nil, ErrUnauthorized
+	}
+	return user, nil
+}
+
+func hashKey(salt, key string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func handleUserError(err error) error {
+	if pgError, ok := err.(*pq.Error); ok {
+		switch pgError.Code {
+		case "23505":
+			return ErrUserConflict
+		}
+	}
+
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return ErrUserNotFound
+	default:
+		return err
+	}
+}
@@ -11,17 +11,22 @@ const (
 	DirRel   = "subsection"
 	FileRel  = "http://opds-spec.org/acquisition"
 	CoverRel = "http://opds-spec.org/cover"
+
+	// OPDS Page Streaming Extension
+	PSENamespace = "http://vaemendis.net/opds-pse/ns"
+	PSEStreamRel = "http://vaemendis.net/opds-pse/stream"
 )
 
 // Feed is a main frame of OPDS.
 type Feed struct {
-	XMLName xml.Name `xml:"feed"`
-	ID      string   `xml:"id"`
-	Title   string   `xml:"title"`
-	Xmlns   string   `xml:"xmlns,attr"`
-	Updated string   `xml:"updated"`
-	Link    []Link   `xml:"link"`
-	Entry   []Entry  `xml:"entry"`
+	XMLName  xml.Name `xml:"feed"`
+	ID       string   `xml:"id"`
+	Title    string   `xml:"title"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	XmlnsPSE string   `xml:"xmlns:pse,attr"`
+	Updated  string   `xml:"updated"`
+	Link     []Link   `xml:"link"`
+	Entry    []Entry  `xml:"entry"`
 }
 
 // Link is link properties.
@@ -29,6 +34,8 @@ type Link struct {
 	Href string `xml:"href,attr"`
 	Type string `xml:"type,attr"`
 	Rel  string `xml:"rel,attr,ommitempty"`
+	// Count is the number of pages of a PSE stream link.
+	Count int `xml:"pse:count,attr,omitempty"`
 }
 
 // Entry is a struct of OPDS entry properties.
@@ -52,10 +59,11 @@ type Summary struct {
 
 func BuildFeed(id, title, href string, entries []Entry) *Feed {
 	return &Feed{
-		ID:      id,
-		Title:   title,
-		Xmlns:   "http://www.w3.org/2005/Atom",
-		Updated: time.Now().UTC().Format(AtomTime),
+		ID:       id,
+		Title:    title,
+		Xmlns:    "http://www.w3.org/2005/Atom",
+		XmlnsPSE: PSENamespace,
+		Updated:  time.Now().UTC().Format(AtomTime),
 		Link: []Link{
 			{
 				Href: href,
@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheTempPrefix      = "tmp-"
+	cacheFingerprintName = ".fingerprint"
+)
+
+// CacheOptions configures CachedStorage.
+type CacheOptions struct {
+	// MaxSize is the total size of cached files in bytes.
+	MaxSize int64
+	// WarmUploads caches uploaded files, which are likely to be read soon.
+	WarmUploads bool
+	// Fingerprint identifies what the cached files are read from, such as
+	// the storage and its encryption keys. Files cached with another
+	// fingerprint are removed, since they may differ from stored files.
+	Fingerprint string
+}
+
+// CacheStats reports the usage of a cache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Files     int
+	Size      int64
+	MaxSize   int64
+}
+
+// CachedStorage keeps files read from a storage in a local directory, and
+// evicts the least recently used ones when they exceed the maximum size.
+// A missed file is fetched once and read from the cache, even when only a
+// range of it is read. Files larger than the cache are read directly.
+//
+// Cached files are named by the digest of their paths, and the cache is
+// reused after a restart in order of their modification times, which are
+// updated when they are read, unless the fingerprint of the cache changes.
+type CachedStorage struct {
+	storage Storage
+	dir     string
+	opts    CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	stats   CacheStats
+	loads   map[string]*cacheLoad
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// cacheLoad is a file being fetched, which other readers wait for. A load
+// is stale if the file is changed meanwhile, and then it is not cached.
+type cacheLoad struct {
+	done  chan struct{}
+	err   error
+	stale bool
+}
+
+func NewCachedStorage(s Storage, dir string, opts CacheOptions) (*CachedStorage, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	c := CachedStorage{
+		storage: s,
+		dir:     dir,
+		opts:    opts,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		loads:   map[string]*cacheLoad{},
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fingerprintPath := filepath.Join(dir, cacheFingerprintName)
+	fingerprint, err := ioutil.ReadFile(fingerprintPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	stale := string(fingerprint) != opts.Fingerprint
+	if stale {
+		// the fingerprint is removed first so that files are removed again
+		// if the process stops halfway
+		if err := os.Remove(fingerprintPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	files := []os.FileInfo{}
+	removed := 0
+	for _, info := range infos {
+		switch {
+		case info.IsDir() || info.Name() == cacheFingerprintName:
+		case stale:
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return nil, err
+			}
+			removed++
+		case strings.HasPrefix(info.Name(), cacheTempPrefix):
+			// left by an interrupted fetch
+			os.Remove(filepath.Join(dir, info.Name()))
+		default:
+			files = append(files, info)
+		}
+	}
+	if stale {
+		if removed > 0 {
+			log.Printf("[INFO] removed %d files cached from another storage or with other keys", removed)
+		}
+		if err := ioutil.WriteFile(fingerprintPath, []byte(opts.Fingerprint), 0644); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, info := range files {
+		c.entries[info.Name()] = c.lru.PushFront(&cacheEntry{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+	return &c, nil
+}
+
+func (s *CachedStorage) Upload(path string, body io.ReadSeeker) error {
+	name := cacheName(path)
+	s.invalidate(name)
+	err := s.storage.Upload(path, body)
+	// drop the old file fetched during the upload
+	s.invalidate(name)
+	if err != nil || !s.opts.WarmUploads {
+		return err
+	}
+
+	s.mu.Lock()
+	load := &cacheLoad{done: make(chan struct{})}
+	s.loads[name] = load
+	s.mu.Unlock()
+
+	load.err = s.store(name, load, func(w io.Writer) error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, body)
+		return err
+	})
+	s.finish(name, load)
+	if load.err != nil {
+		log.Printf("[WARN] cannot cache %s: %v", path, load.err)
+	}
+	return nil
+}
+
+func (s *CachedStorage) Download(w io.Writer, path string) error {
+	return s.read(path, func(f *os.File) error {
+		_, err := io.Copy(w, f)
+		return err
+	}, func() error {
+		return s.storage.Download(w, path)
+	})
+}
+
+func (s *CachedStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	return s.read(path, func(f *os.File) error {
+		_, err := io.Copy(w, io.NewSectionReader(f, offset, length))
+		return err
+	}, func() error {
+		return s.storage.DownloadRange(w, path, offset, length)
+	})
+}
+
+func (s *CachedStorage) Size(path string) (int64, error) {
+	return s.storage.Size(path)
+}
+
+func (s *CachedStorage) Delete(path string) error {
+	name := cacheName(path)
+	s.invalidate(name)
+	err := s.storage.Delete(path)
+	s.invalidate(name)
+	return err
+}
+
+// Warm fetches a file into the cache unless it is cached or larger than
+// the cache.
+func (s *CachedStorage) Warm(path string) error {
+	name := cacheName(path)
+	s.mu.Lock()
+	_, ok := s.entries[name]
+	s.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	size, err := s.storage.Size(path)
+	if err != nil {
+		return err
+	}
+	if size > s.opts.MaxSize {
+		return nil
+	}
+	return s.fetch(path, name)
+}
+
+// Stats returns the usage of the cache.
+func (s *CachedStorage) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Files = len(s.entries)
+	stats.Size = s.size
+	stats.MaxSize = s.opts.MaxSize
+	return stats
+}
+
+// read reads a file from the cache, fetching it if missed, or directly
+// from the storage if it cannot be cached.
+func (s *CachedStorage) read(path string, read func(f *os.File) error, direct func() error) error {
+	name := cacheName(path)
+	if f := s.open(name, true); f != nil {
+		defer f.Close()
+		return read(f)
+	}
+
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	size, err := s.storage.Size(path)
+	if err != nil || size > s.opts.MaxSize {
+		return direct()
+	}
+	if err := s.fetch(path, name); err != nil {
+		log.Printf("[WARN] cannot cache %s: %v", path, err)
+		return direct()
+	}
+	if f := s.open(name, false); f != nil {
+		defer f.Close()
+		return read(f)
+	}
+	return direct()
+}
+
+// open opens a cached file and marks it as recently used, and returns nil
+// if it is not cached.
+func (s *CachedStorage) open(name string, hit bool) *os.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[name]
+	if !ok {
+		return nil
+	}
+
+	path := filepath.Join(s.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		// removed from outside
+		s.remove(elem)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	if hit {
+		s.stats.Hits++
+	}
+	return f
+}
+
+// fetch downloads a file into the cache. Concurrent fetches of a file wait
+// for the first one.
+func (s *CachedStorage) fetch(path, name string) error {
+	s.mu.Lock()
+	if load, ok := s.loads[name]; ok {
+		s.mu.Unlock()
+		<-load.done
+		return load.err
+	}
+	load := &cacheLoad{done: make(chan struct{})}
+	s.loads[name] = load
+	s.mu.Unlock()
+
+	load.err = s.store(name, load, func(w io.Writer) error {
+		return s.storage.Download(w, path)
+	})
+	s.finish(name, load)
+	return load.err
+}
+
+// finish removes a load unless it is replaced, and wakes up its waiters.
+func (s *CachedStorage) finish(name string, load *cacheLoad) {
+	s.mu.Lock()
+	if s.loads[name] == load {
+		delete(s.loads, name)
+	}
+	s.mu.Unlock()
+	close(load.done)
+}
+
+// store writes a file to the cache and evicts old files. The file is
+// dropped if the load becomes stale.
+func (s *CachedStorage) store(name string, load *cacheLoad, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(s.dir, cacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if size > s.opts.MaxSize {
+		return nil
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if load.stale {
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if elem, ok := s.entries[name]; ok {
+		s.size -= elem.Value.(*cacheEntry).size
+		s.lru.Remove(elem)
+	}
+	s.entries[name] = s.lru.PushFront(&cacheEntry{name: name, size: size})
+	s.size += size
+	s.evict()
+	return nil
+}
+
+// invalidate removes a cached file and makes its pending load stale.
+func (s *CachedStorage) invalidate(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if load, ok := s.loads[name]; ok {
+		load.stale = true
+		delete(s.loads, name)
+	}
+	if elem, ok := s.entries[name]; ok {
+		s.remove(elem)
+	}
+}
+
+// evict removes least recently used files until the cache fits in the
+// maximum size. The caller must hold s.mu.
+func (s *CachedStorage) evict() {
+	for s.size > s.opts.MaxSize && s.lru.Len() > 0 {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// remove removes a cached file. The caller must hold s.mu.
+func (s *CachedStorage) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.name)
+	s.size -= entry.size
+	if err := os.Remove(filepath.Join(s.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] cannot remove cached file %s: %v", entry.name, err)
+	}
+}
+
+func cacheName(path string) string {
+	h := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(h[:])
+}
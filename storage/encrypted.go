@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedMagic starts encrypted files. Files without it are read as
+	// they are, so a storage can be encrypted after files are stored.
+	encryptedMagic = "\x00bsenc1\n"
+	// encryptedChunkSize is the size of plaintext sealed at once, which is
+	// the unit of range reads.
+	encryptedChunkSize = 64 * 1024
+	// encryptedHeaderSize is the size of a header without a key ID.
+	encryptedHeaderSize = len(encryptedMagic) + 4 + 8 + 8 + 1
+	maxKeyIDLength      = 255
+	maxChunkSize        = 16 * 1024 * 1024
+)
+
+var (
+	ErrUnknownKey       = errors.New("unknown encryption key")
+	ErrDecryptionFailed = errors.New("cannot decrypt file")
+	ErrNotEncrypted     = errors.New("file is not encrypted")
+)
+
+// Keyring has keys of encrypted files by their IDs. New files are encrypted
+// with the current key.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring parses keys written as "<id>:<base64 key>" separated by
+// commas or lines, where the first one is the current key. Keys are 16, 24
+// or 32 bytes for AES-128, AES-192 or AES-256. Lines starting with "#" are
+// ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	keyring := Keyring{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			i := strings.Index(entry, ":")
+			if i <= 0 || i > maxKeyIDLength {
+				return nil, fmt.Errorf("invalid key entry: expected <id>:<base64 key>")
+			}
+			id := entry[:i]
+			if _, ok := keyring.keys[id]; ok {
+				return nil, fmt.Errorf("duplicated key id: %s", id)
+			}
+			key, err := base64.StdEncoding.DecodeString(entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", id, err)
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", id, err)
+			}
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, err
+			}
+			keyring.keys[id] = aead
+			if keyring.current == "" {
+				keyring.current = id
+			}
+		}
+	}
+	if keyring.current == "" {
+		return nil, errors.New("no encryption keys")
+	}
+	return &keyring, nil
+}
+
+// Current returns the ID of the key encrypting new files.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// EncryptedStorage encrypts files with AES-GCM before storing them. Files
+// are sealed in chunks, so ranges are read without decrypting whole files,
+// and each file records the ID of its key, so keys are rotated by
+// encrypting files again with a new key.
+//
+// An encrypted file has a header of the magic, the chunk size, the size of
+// the plaintext, a nonce prefix and the key ID, followed by the sealed
+// chunks. The nonce of a chunk is the prefix and the chunk index, and the
+// header is authenticated with every chunk, so chunks cannot be reordered,
+// truncated or moved to other files.
+type EncryptedStorage struct {
+	storage Storage
+	keys    *Keyring
+	opts    EncryptionOptions
+}
+
+// EncryptionOptions configures EncryptedStorage.
+type EncryptionOptions struct {
+	// Strict rejects files which are not encrypted instead of reading them
+	// as they are. It is enabled once all files are encrypted by rotating
+	// keys or migrating them, so that files replaced in the storage are
+	// not served.
+	Strict bool
+}
+
+func NewEncryptedStorage(s Storage, keys *Keyring, opts EncryptionOptions) *EncryptedStorage {
+	return &EncryptedStorage{storage: s, keys: keys, opts: opts}
+}
+
+type encryptedHeader struct {
+	raw       []byte
+	chunkSize int64
+	size      int64
+	nonce     []byte
+	keyID     string
+	aead      cipher.AEAD
+}
+
+func (h *encryptedHeader) chunkNonce(index int64) []byte {
+	nonce := make([]byte, h.aead.NonceSize())
+	copy(nonce, h.nonce)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], uint32(index))
+	return nonce
+}
+
+func (h *encryptedHeader) chunks() int64 {
+	return (h.size + h.chunkSize - 1) / h.chunkSize
+}
+
+// sealedChunkSize returns the size of an encrypted chunk including its tag.
+func (h *encryptedHeader) sealedChunkSize() int64 {
+	return h.chunkSize + int64(h.aead.Overhead())
+}
+
+// storedSize returns the size of the encrypted file including the header.
+func (h *encryptedHeader) storedSize() int64 {
+	return int64(len(h.raw)) + h.size + h.chunks()*int64(h.aead.Overhead())
+}
+
+func (s *EncryptedStorage) Upload(path string, body io.ReadSeeker) error {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := encryptedHeader{
+		chunkSize: encryptedChunkSize,
+		size:      size,
+		nonce:     make([]byte, 8),
+		keyID:     s.keys.current,
+		aead:      s.keys.keys[s.keys.current],
+	}
+	if _, err := rand.Read(header.nonce); err != nil {
+		return err
+	}
+	raw := bytes.NewBufferString(encryptedMagic)
+	binary.Write(raw, binary.BigEndian, uint32(header.chunkSize))
+	binary.Write(raw, binary.BigEndian, uint64(header.size))
+	raw.Write(header.nonce)
+	raw.WriteByte(byte(len(header.keyID)))
+	raw.WriteString(header.keyID)
+	header.raw = raw.Bytes()
+
+	tmp, err := ioutil.TempFile("", "bookshelf-encrypt-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(header.raw); err != nil {
+		return err
+	}
+	chunk := make([]byte, header.chunkSize)
+	sealed := make([]byte, 0, header.sealedChunkSize())
+	for index := int64(0); index < header.chunks(); index++ {
+		n, err := io.ReadFull(body, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sealed = header.aead.Seal(sealed[:0], header.chunkNonce(index), chunk[:n], header.raw)
+		if _, err := tmp.Write(sealed); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.storage.Upload(path, tmp)
+}
+
+func (s *EncryptedStorage) Download(w io.Writer, path string) error {
+	return s.download(w, path, s.opts.Strict)
+}
+
+func (s *EncryptedStorage) download(w io.Writer, path string, strict bool) error {
+	header, err := s.readHeader(path, strict)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return s.storage.Download(w, path)
+	}
+	return s.decrypt(w, path, header, 0, header.size)
+}
+
+func (s *EncryptedStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	header, err := s.readHeader(path, s.opts.Strict)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return s.storage.DownloadRange(w, path, offset, length)
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if offset+length > header.size {
+		length = header.size - offset
+	}
+	if length <= 0 {
+		return nil
+	}
+	return s.decrypt(w, path, header, offset, length)
+}
+
+// Size returns the size of the plaintext of a file, and fails if the size of
+// the stored file does not match its header, such as if it is truncated.
+func (s *EncryptedStorage) Size(path string) (int64, error) {
+	header, err := s.readHeader(path, s.opts.Strict)
+	if err != nil {
+		return 0, err
+	}
+	if header == nil {
+		return s.storage.Size(path)
+	}
+
+	stored, err := s.storage.Size(path)
+	if err != nil {
+		return 0, err
+	}
+	if expected := header.storedSize(); stored != expected {
+		return 0, fmt.Errorf("%w: expected %d bytes but stored %d", ErrDecryptionFailed, expected, stored)
+	}
+	return header.size, nil
+}
+
+func (s *EncryptedStorage) Delete(path string) error {
+	return s.storage.Delete(path)
+}
+
+// KeyID returns the ID of the key of a stored file, which is empty if the
+// file is not encrypted, even in the strict mode.
+func (s *EncryptedStorage) KeyID(path string) (string, error) {
+	header, err := s.readHeader(path, false)
+	if err != nil || header == nil {
+		return "", err
+	}
+	return header.keyID, nil
+}
+
+// readHeader reads the header of a file, which is nil if the file is not
+// encrypted. Files which are not encrypted are rejected in the strict mode.
+func (s *EncryptedStorage) readHeader(path string, strict bool) (*encryptedHeader, error) {
+	plaintext := func() (*encryptedHeader, error) {
+		if strict {
+			return nil, ErrNotEncrypted
+		}
+		return nil, nil
+	}
+
+	buf := bytes.Buffer{}
+	if err := s.storage.DownloadRange(&buf, path, 0, int64(encryptedHeaderSize+maxKeyIDLength)); err != nil {
+		// ranges of empty files are invalid in S3
+		if size, sizeErr := s.storage.Size(path); sizeErr == nil && size == 0 {
+			return plaintext()
+		}
+		return nil, err
+	}
+	raw := buf.Bytes()
+	if !bytes.HasPrefix(raw, []byte(encryptedMagic)) {
+		return plaintext()
+	}
+	if len(raw) < encryptedHeaderSize {
+		return nil, ErrDecryptionFailed
+	}
+
+	p := raw[len(encryptedMagic):]
+	header := encryptedHeader{
+		chunkSize: int64(binary.BigEndian.Uint32(p[0:4])),
+		size:      int64(binary.BigEndian.Uint64(p[4:12])),
+		nonce:     p[12:20],
+	}
+	n := int(p[20])
+	if header.chunkSize == 0 || header.chunkSize > maxChunkSize || header.size < 0 || len(raw) < encryptedHeaderSize+n {
+		return nil, ErrDecryptionFailed
+	}
+	header.keyID = string(raw[encryptedHeaderSize : encryptedHeaderSize+n])
+	header.raw = raw[:encryptedHeaderSize+n]
+	if header.size == 0 && len(raw) > len(header.raw) {
+		// empty files have no chunks to authenticate data after the header
+		return nil, ErrDecryptionFailed
+	}
+
+	aead, ok := s.keys.keys[header.keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, header.keyID)
+	}
+	header.aead = aead
+	return &header, nil
+}
+
+// decrypt writes length bytes of the plaintext of a file from offset,
+// reading only the chunks containing them.
+func (s *EncryptedStorage) decrypt(w io.Writer, path string, header *encryptedHeader, offset, length int64) error {
+	first := offset / header.chunkSize
+	last := (offset + length - 1) / header.chunkSize
+	if length == 0 {
+		last = first - 1
+	}
+
+	dw := decryptWriter{
+		w:      w,
+		header: header,
+		index:  first,
+		skip:   offset - first*header.chunkSize,
+		remain: length,
+	}
+	if last >= first {
+		start := int64(len(header.raw)) + first*header.sealedChunkSize()
+		end := int64(len(header.raw)) + (last+1)*header.sealedChunkSize()
+		if err := s.storage.DownloadRange(&dw, path, start, end-start); err != nil {
+			return err
+		}
+	}
+	if err := dw.flush(); err != nil {
+		return err
+	}
+	if dw.index != last+1 {
+		// the file is truncated
+		return ErrDecryptionFailed
+	}
+	return nil
+}
+
+// decryptWriter opens sealed chunks written to it and writes a range of
+// their plaintext.
+type decryptWriter struct {
+	w      io.Writer
+	header *encryptedHeader
+	buf    []byte
+	index  int64
+	// skip is the size of plaintext to drop before the range
+	skip   int64
+	remain int64
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	size := int(d.header.sealedChunkSize())
+	for len(d.buf) >= size {
+		if err := d.open(d.buf[:size]); err != nil {
+			return 0, err
+		}
+		d.buf = d.buf[size:]
+	}
+	return len(p), nil
+}
+
+// flush opens the last chunk, which may be shorter than others.
+func (d *decryptWriter) flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	err := d.open(d.buf)
+	d.buf = nil
+	return err
+}
+
+func (d *decryptWriter) open(sealed []byte) error {
+	chunk, err := d.header.aead.Open(nil, d.header.chunkNonce(d.index), sealed, d.header.raw)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	d.index++
+
+	if d.skip >= int64(len(chunk)) {
+		d.skip -= int64(len(chunk))
+		return nil
+	}
+	chunk = chunk[d.skip:]
+	d.skip = 0
+	if int64(len(chunk)) > d.remain {
+		chunk = chunk[:d.remain]
+	}
+	d.remain -= int64(len(chunk))
+	_, err = d.w.Write(chunk)
+	return err
+}
@@ -0,0 +1,59 @@
+package storage
+
+import "io"
+
+// FallbackStorage writes files to both a primary and a fallback storage, and
+// reads them from the fallback when the primary does not have them. It keeps
+// a server running while files are migrated from the fallback to the
+// primary, and allows switching back since the fallback stays complete.
+type FallbackStorage struct {
+	primary  Storage
+	fallback Storage
+}
+
+func NewFallbackStorage(primary, fallback Storage) *FallbackStorage {
+	return &FallbackStorage{primary: primary, fallback: fallback}
+}
+
+func (s *FallbackStorage) Upload(path string, body io.ReadSeeker) error {
+	if err := s.primary.Upload(path, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.fallback.Upload(path, body)
+}
+
+func (s *FallbackStorage) Download(w io.Writer, path string) error {
+	// find the file first so that nothing is written when the primary fails
+	return s.storageOf(path).Download(w, path)
+}
+
+func (s *FallbackStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	return s.storageOf(path).DownloadRange(w, path, offset, length)
+}
+
+func (s *FallbackStorage) Size(path string) (int64, error) {
+	if size, err := s.primary.Size(path); err == nil {
+		return size, nil
+	}
+	return s.fallback.Size(path)
+}
+
+// Delete deletes a file from both storages, and fails only if neither of
+// them has deleted it, because files may not be migrated yet.
+func (s *FallbackStorage) Delete(path string) error {
+	err := s.primary.Delete(path)
+	if fallbackErr := s.fallback.Delete(path); fallbackErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (s *FallbackStorage) storageOf(path string) Storage {
+	if _, err := s.primary.Size(path); err == nil {
+		return s.primary
+	}
+	return s.fallback
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -15,6 +16,8 @@ func NewFileSystemStorage(root string, perm os.FileMode) *FileSystemStorage {
 	return &FileSystemStorage{root: root, perm: perm}
 }
 
+// Upload writes a file to a temporary name and renames it, so that readers
+// never see a partially written file.
 func (s *FileSystemStorage) Upload(path string, body io.ReadSeeker) (err error) {
 	path = filepath.Join(s.root, path)
 
@@ -24,15 +27,25 @@ func (s *FileSystemStorage) Upload(path string, body io.ReadSeeker) (err error)
 		return
 	}
 
-	f, err := os.Create(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
 	if err != nil {
 		return
 	}
 
+	defer os.Remove(f.Name())
 	defer f.Close()
 
-	_, err = io.Copy(f, body)
-	return
+	if _, err = io.Copy(f, body); err != nil {
+		return
+	}
+	// temporary files are private, unlike files created by os.Create
+	if err = f.Chmod(0644); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
 }
 
 func (s *FileSystemStorage) Download(w io.Writer, path string) (err error) {
@@ -48,3 +61,32 @@ func (s *FileSystemStorage) Download(w io.Writer, path string) (err error) {
 	_, err = io.Copy(w, f)
 	return
 }
+
+func (s *FileSystemStorage) DownloadRange(w io.Writer, path string, offset, length int64) (err error) {
+	path = filepath.Join(s.root, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(f, offset, length))
+	return
+}
+
+func (s *FileSystemStorage) Size(path string) (int64, error) {
+	path = filepath.Join(s.root, path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *FileSystemStorage) Delete(path string) error {
+	path = filepath.Join(s.root, path)
+	return os.Remove(path)
+}
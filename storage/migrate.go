@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// Blob is a stored file with its size and SHA-256 digest in hex, which are
+// unknown if zero or empty.
+type Blob struct {
+	Path string
+	Size int64
+	Hash string
+}
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// Concurrency is the number of files copied at once.
+	Concurrency int
+	// Verify reads every file back from the target after copying and
+	// compares its digest with the source.
+	Verify bool
+}
+
+// MigrateSummary reports the result of Migrate.
+type MigrateSummary struct {
+	Copied int
+	// Skipped files already exist in the target with the same size, such
+	// as files copied before an interruption.
+	Skipped  int
+	Missing  int
+	Verified int
+	Errors   []string
+
+	mu sync.Mutex
+}
+
+func (s *MigrateSummary) count(n *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*n++
+}
+
+func (s *MigrateSummary) fail(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := fmt.Sprintf(format, args...)
+	log.Printf("[ERROR] %s", message)
+	s.Errors = append(s.Errors, message)
+}
+
+// Migrate copies files from a source storage to a target one, checking their
+// digests. Files which the target already has with the expected size are
+// skipped, so running it again resumes an interrupted migration.
+func Migrate(ctx context.Context, src, dst Storage, blobs []Blob, opts MigrateOptions) *MigrateSummary {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	summary := MigrateSummary{Errors: []string{}}
+
+	run := func(f func(blob Blob)) {
+		eachBlob(ctx, blobs, opts.Concurrency, f)
+	}
+
+	total := len(blobs)
+	done := 0
+	missing := map[string]bool{}
+	progress := func() {
+		summary.mu.Lock()
+		defer summary.mu.Unlock()
+		done++
+		if done%100 == 0 || done == total {
+			log.Printf("[INFO] migrated %d/%d files", done, total)
+		}
+	}
+
+	run(func(blob Blob) {
+		defer progress()
+		copied, err := copyBlob(src, dst, blob)
+		switch {
+		case err == errMissing:
+			summary.mu.Lock()
+			missing[blob.Path] = true
+			summary.mu.Unlock()
+			summary.count(&summary.Missing)
+			summary.fail("%s: not found in source", blob.Path)
+		case err != nil:
+			summary.fail("%s: %v", blob.Path, err)
+		case copied:
+			summary.count(&summary.Copied)
+		default:
+			summary.count(&summary.Skipped)
+		}
+	})
+
+	if opts.Verify && ctx.Err() == nil {
+		run(func(blob Blob) {
+			if missing[blob.Path] {
+				return
+			}
+			if err := verifyBlob(src, dst, blob); err != nil {
+				summary.fail("%s: verification failed: %v", blob.Path, err)
+				return
+			}
+			summary.count(&summary.Verified)
+		})
+	}
+	return &summary
+}
+
+// eachBlob calls a function with blobs by concurrent workers until the
+// context is canceled.
+func eachBlob(ctx context.Context, blobs []Blob, concurrency int, f func(blob Blob)) {
+	ch := make(chan Blob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range ch {
+				f(blob)
+			}
+		}()
+	}
+loop:
+	for _, blob := range blobs {
+		select {
+		case ch <- blob:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(ch)
+	wg.Wait()
+}
+
+var errMissing = errors.New("file not found")
+
+// copyBlob copies a file unless the target has it, and reports whether it
+// is copied. The file is uploaded once fully downloaded, and storages
+// replace files atomically by uploading them to temporary names, so the
+// target never has a partial file to be served or skipped.
+func copyBlob(src, dst Storage, blob Blob) (bool, error) {
+	size := blob.Size
+	srcSize, err := src.Size(blob.Path)
+	if err != nil {
+		if _, err := dst.Size(blob.Path); err == nil {
+			// migrated and deleted from the source
+			return false, nil
+		}
+		return false, errMissing
+	}
+	if size == 0 {
+		size = srcSize
+	}
+	if dstSize, err := dst.Size(blob.Path); err == nil && dstSize == size {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "bookshelf-migrate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if err := src.Download(io.MultiWriter(tmp, h), blob.Path); err != nil {
+		return false, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); blob.Hash != "" && sum != blob.Hash {
+		return false, fmt.Errorf("checksum mismatch in source: expected %s but got %s", blob.Hash, sum)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return true, dst.Upload(blob.Path, tmp)
+}
+
+// verifyBlob compares the digest of a file in the target with the recorded
+// one or, if unknown, with the digest of the source. Files which cannot be
+// read back or differ are deleted from the target to be copied again by the
+// next migration, unless the source has lost them.
+func verifyBlob(src, dst Storage, blob Blob) error {
+	expected := blob.Hash
+	if expected == "" {
+		var err error
+		if expected, err = hashStored(src, blob.Path); err != nil {
+			return fmt.Errorf("cannot read source: %v", err)
+		}
+	}
+	actual, err := hashStored(dst, blob.Path)
+	if err == nil && actual != expected {
+		err = fmt.Errorf("expected %s but got %s", expected, actual)
+	}
+	if err != nil {
+		if _, srcErr := src.Size(blob.Path); srcErr != nil {
+			log.Printf("[WARN] keep broken file %s which the source does not have", blob.Path)
+			return err
+		}
+		if err := dst.Delete(blob.Path); err != nil {
+			log.Printf("[WARN] cannot delete broken file %s: %v", blob.Path, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func hashStored(s Storage, path string) (string, error) {
+	h := sha256.New()
+	if err := s.Download(h, path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
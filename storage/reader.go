@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+)
+
+const (
+	readerBlockSize = 64 * 1024
+	readerMaxBlocks = 32
+)
+
+// ReaderAt provides random access to a stored file with range requests.
+// Recently read blocks are kept in memory, because readers like
+// archive/zip issue many small reads close to each other.
+type ReaderAt struct {
+	storage Storage
+	path    string
+	size    int64
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	lru    *list.List
+}
+
+type readerBlock struct {
+	index int64
+	data  []byte
+}
+
+func NewReaderAt(s Storage, path string) (*ReaderAt, error) {
+	size, err := s.Size(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{
+		storage: s,
+		path:    path,
+		size:    size,
+		blocks:  map[int64]*list.Element{},
+		lru:     list.New(),
+	}, nil
+}
+
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	for n < len(p) && off < r.size {
+		index := off / readerBlockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off-index*readerBlockSize:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *ReaderAt) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(e)
+		return e.Value.(*readerBlock).data, nil
+	}
+
+	offset := index * readerBlockSize
+	length := int64(readerBlockSize)
+	if offset+length > r.size {
+		length = r.size - offset
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	if err := r.storage.DownloadRange(buf, r.path, offset, length); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	r.blocks[index] = r.lru.PushFront(&readerBlock{index: index, data: buf.Bytes()})
+	if r.lru.Len() > readerMaxBlocks {
+		e := r.lru.Back()
+		r.lru.Remove(e)
+		delete(r.blocks, e.Value.(*readerBlock).index)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// replicaCooldown is how long a failed replica is tried after others.
+	replicaCooldown = 30 * time.Second
+	// repairInterval is the interval of retrying repairs of replicas.
+	repairInterval = 10 * time.Second
+)
+
+// ReplicatedStorage stores files in a primary storage and its replicas, such
+// as a local disk and S3. Files are read from the fastest healthy storage,
+// falling back on the others, and writes missed by replicas are repaired in
+// background from the primary. Repairs are kept in memory, and Reconcile
+// finds the files to repair after a restart.
+type ReplicatedStorage struct {
+	replicas []*replica
+
+	mu      sync.Mutex
+	repairs map[repairTask]bool
+}
+
+type replica struct {
+	index   int
+	storage Storage
+
+	mu       sync.Mutex
+	latency  time.Duration
+	failedAt time.Time
+}
+
+// repairTask is a write missed by a replica.
+type repairTask struct {
+	replica int
+	path    string
+	delete  bool
+}
+
+// NewReplicatedStorage creates a storage writing to a primary and replicas.
+// It repairs replicas until the process exits.
+func NewReplicatedStorage(primary Storage, replicas ...Storage) *ReplicatedStorage {
+	s := ReplicatedStorage{repairs: map[repairTask]bool{}}
+	for i, storage := range append([]Storage{primary}, replicas...) {
+		s.replicas = append(s.replicas, &replica{index: i, storage: storage})
+	}
+	go s.repairLoop()
+	return &s
+}
+
+// Upload writes a file to the primary, which has to succeed, and to the
+// replicas, which are repaired later if they fail.
+func (s *ReplicatedStorage) Upload(path string, body io.ReadSeeker) error {
+	if err := s.replicas[0].storage.Upload(path, body); err != nil {
+		s.replicas[0].fail()
+		return err
+	}
+	for _, r := range s.replicas[1:] {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := r.storage.Upload(path, body); err != nil {
+			log.Printf("[WARN] replica %d missed upload of %s: %v", r.index, path, err)
+			r.fail()
+			s.scheduleRepair(repairTask{replica: r.index, path: path})
+			continue
+		}
+		s.cancelRepair(repairTask{replica: r.index, path: path, delete: true})
+	}
+	return nil
+}
+
+func (s *ReplicatedStorage) Download(w io.Writer, path string) error {
+	return s.read(w, path, func(r Storage, w io.Writer) error {
+		return r.Download(w, path)
+	})
+}
+
+func (s *ReplicatedStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	return s.read(w, path, func(r Storage, w io.Writer) error {
+		return r.DownloadRange(w, path, offset, length)
+	})
+}
+
+func (s *ReplicatedStorage) Size(path string) (int64, error) {
+	var err error
+	for _, r := range s.ordered() {
+		start := time.Now()
+		var size int64
+		if size, err = r.storage.Size(path); err == nil {
+			r.succeed(time.Since(start))
+			return size, nil
+		}
+	}
+	return 0, err
+}
+
+// Delete deletes a file from the primary, which has to succeed, and from the
+// replicas, which are repaired later if they fail.
+func (s *ReplicatedStorage) Delete(path string) error {
+	if err := s.replicas[0].storage.Delete(path); err != nil {
+		return err
+	}
+	for _, r := range s.replicas[1:] {
+		s.cancelRepair(repairTask{replica: r.index, path: path})
+		if err := r.storage.Delete(path); err != nil {
+			// files missing in the replica need no repair
+			if _, sizeErr := r.storage.Size(path); sizeErr != nil {
+				continue
+			}
+			log.Printf("[WARN] replica %d missed deletion of %s: %v", r.index, path, err)
+			r.fail()
+			s.scheduleRepair(repairTask{replica: r.index, path: path, delete: true})
+		}
+	}
+	return nil
+}
+
+// read tries storages in order of preference until one of them succeeds.
+// Another storage cannot be tried once data is written to w.
+func (s *ReplicatedStorage) read(w io.Writer, path string, f func(r Storage, w io.Writer) error) error {
+	var err error
+	for _, r := range s.ordered() {
+		cw := countingWriter{w: w}
+		start := time.Now()
+		if err = f(r.storage, &cw); err == nil {
+			r.succeed(cw.firstByte(start))
+			return nil
+		}
+
+		// a replica which missed the file is not failing
+		if !IsNotExist(err) {
+			r.fail()
+		}
+		if r.index != 0 {
+			// the replica may have missed the file
+			s.scheduleRepair(repairTask{replica: r.index, path: path})
+		}
+		if cw.n > 0 {
+			return err
+		}
+	}
+	return err
+}
+
+// ordered returns healthy storages by latency followed by failed ones.
+func (s *ReplicatedStorage) ordered() []*replica {
+	now := time.Now()
+	type candidate struct {
+		r       *replica
+		healthy bool
+		latency time.Duration
+	}
+	candidates := []candidate{}
+	for _, r := range s.replicas {
+		r.mu.Lock()
+		candidates = append(candidates, candidate{
+			r:       r,
+			healthy: now.Sub(r.failedAt) > replicaCooldown,
+			latency: r.latency,
+		})
+		r.mu.Unlock()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		return a.latency < b.latency
+	})
+
+	ordered := []*replica{}
+	for _, c := range candidates {
+		ordered = append(ordered, c.r)
+	}
+	return ordered
+}
+
+func (r *replica) succeed(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// moving average of recent latencies
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = (r.latency*7 + latency) / 8
+	}
+	r.failedAt = time.Time{}
+}
+
+func (r *replica) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failedAt = time.Now()
+}
+
+// Reconcile compares files in the primary with the replicas and schedules
+// repairs of the files which replicas miss or have different sizes of.
+// Repairs are not persisted, so writes missed before a restart are found
+// by reconciling. It returns the number of scheduled repairs.
+func (s *ReplicatedStorage) Reconcile(ctx context.Context, blobs []Blob, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	mu := sync.Mutex{}
+	scheduled := 0
+	eachBlob(ctx, blobs, concurrency, func(blob Blob) {
+		size, err := s.replicas[0].storage.Size(blob.Path)
+		if err != nil {
+			// nothing to copy from the primary
+			return
+		}
+		for _, r := range s.replicas[1:] {
+			if replicaSize, err := r.storage.Size(blob.Path); err == nil && replicaSize == size {
+				continue
+			}
+			s.scheduleRepair(repairTask{replica: r.index, path: blob.Path})
+			mu.Lock()
+			scheduled++
+			mu.Unlock()
+		}
+	})
+	return scheduled
+}
+
+func (s *ReplicatedStorage) scheduleRepair(task repairTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repairs[task] = true
+}
+
+func (s *ReplicatedStorage) cancelRepair(task repairTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.repairs, task)
+}
+
+func (s *ReplicatedStorage) repairLoop() {
+	for range time.Tick(repairInterval) {
+		s.mu.Lock()
+		tasks := []repairTask{}
+		for task := range s.repairs {
+			tasks = append(tasks, task)
+		}
+		s.mu.Unlock()
+
+		for _, task := range tasks {
+			if err := s.repair(task); err != nil {
+				log.Printf("[WARN] cannot repair %s of replica %d: %v", task.path, task.replica, err)
+				continue
+			}
+			s.cancelRepair(task)
+		}
+	}
+}
+
+func (s *ReplicatedStorage) repair(task repairTask) error {
+	primary := s.replicas[0].storage
+	target := s.replicas[task.replica]
+
+	if task.delete {
+		if _, err := primary.Size(task.path); err == nil {
+			// uploaded again after deletion
+			return nil
+		}
+		if _, err := target.storage.Size(task.path); err != nil {
+			return nil
+		}
+		return target.storage.Delete(task.path)
+	}
+
+	size, err := primary.Size(task.path)
+	if err != nil {
+		// deleted after the missed upload
+		return nil
+	}
+	if targetSize, err := target.storage.Size(task.path); err == nil && targetSize == size {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile("", "bookshelf-repair-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := primary.Download(tmp, task.path); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := target.storage.Upload(task.path, tmp); err != nil {
+		target.fail()
+		return err
+	}
+	log.Printf("[INFO] repaired %s of replica %d", task.path, task.replica)
+	return nil
+}
+
+// countingWriter counts bytes written and records when the first byte is
+// written.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	first time.Time
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 && len(p) > 0 {
+		w.first = time.Now()
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) firstByte(start time.Time) time.Duration {
+	if w.first.IsZero() {
+		return time.Since(start)
+	}
+	return w.first.Sub(start)
+}
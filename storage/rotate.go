@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// RotateSummary reports the result of RotateKeys.
+type RotateSummary struct {
+	Rotated int
+	// Skipped files are already encrypted with the current key.
+	Skipped int
+	Missing int
+	Errors  []string
+
+	mu sync.Mutex
+}
+
+func (s *RotateSummary) count(n *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*n++
+}
+
+func (s *RotateSummary) fail(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := fmt.Sprintf(format, args...)
+	log.Printf("[ERROR] %s", message)
+	s.Errors = append(s.Errors, message)
+}
+
+// RotateKeys encrypts files with the current key unless they already are,
+// including files stored before the storage was encrypted. Files are
+// replaced one by one, so running it again resumes an interrupted rotation.
+func RotateKeys(ctx context.Context, s *EncryptedStorage, blobs []Blob, concurrency int) *RotateSummary {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	summary := RotateSummary{Errors: []string{}}
+
+	total := len(blobs)
+	done := 0
+	progress := func() {
+		summary.mu.Lock()
+		defer summary.mu.Unlock()
+		done++
+		if done%100 == 0 || done == total {
+			log.Printf("[INFO] checked %d/%d files", done, total)
+		}
+	}
+
+	eachBlob(ctx, blobs, concurrency, func(blob Blob) {
+		defer progress()
+		rotated, err := s.rotate(blob)
+		switch {
+		case err == errMissing:
+			summary.count(&summary.Missing)
+			summary.fail("%s: not found", blob.Path)
+		case err != nil:
+			summary.fail("%s: %v", blob.Path, err)
+		case rotated:
+			summary.count(&summary.Rotated)
+		default:
+			summary.count(&summary.Skipped)
+		}
+	})
+	return &summary
+}
+
+// rotate encrypts a file again with the current key, and reports whether it
+// is rotated. The decrypted file is checked against the digest of the blob
+// before it replaces the stored one, and the replaced file is read back, so
+// that a broken file is not skipped as rotated by the next run.
+func (s *EncryptedStorage) rotate(blob Blob) (bool, error) {
+	if _, err := s.storage.Size(blob.Path); err != nil {
+		return false, errMissing
+	}
+	keyID, err := s.KeyID(blob.Path)
+	if err != nil {
+		return false, err
+	}
+	if keyID == s.keys.current {
+		// a file truncated by an earlier run is reported
+		if _, err := s.Size(blob.Path); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "bookshelf-rotate-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if err := s.download(io.MultiWriter(tmp, h), blob.Path, false); err != nil {
+		return false, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if blob.Hash != "" && sum != blob.Hash {
+		return false, fmt.Errorf("checksum mismatch: expected %s but got %s", blob.Hash, sum)
+	}
+
+	// a replaced file which cannot be read back is uploaded once more from
+	// the decrypted copy
+	for attempt := 1; ; attempt++ {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		if err := s.Upload(blob.Path, tmp); err != nil {
+			return false, err
+		}
+		stored, err := hashStored(s, blob.Path)
+		if err == nil && stored != sum {
+			err = fmt.Errorf("expected %s but got %s", sum, stored)
+		}
+		if err == nil {
+			return true, nil
+		}
+		if attempt == 2 {
+			return false, fmt.Errorf("rotated file is broken: %v", err)
+		}
+		log.Printf("[WARN] upload %s again: rotated file is broken: %v", blob.Path, err)
+	}
+}
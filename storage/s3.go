@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 	"path/filepath"
 
@@ -47,3 +48,41 @@ func (s *S3Storage) Download(w io.Writer, path string) (err error) {
 	_, err = io.Copy(w, resp.Body)
 	return
 }
+
+func (s *S3Storage) DownloadRange(w io.Writer, path string, offset, length int64) (err error) {
+	key := filepath.Join(s.root, path)
+	resp, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return
+}
+
+func (s *S3Storage) Size(path string) (int64, error) {
+	key := filepath.Join(s.root, path)
+	resp, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.Int64Value(resp.ContentLength), nil
+}
+
+func (s *S3Storage) Delete(path string) error {
+	key := filepath.Join(s.root, path)
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
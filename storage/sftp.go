@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPStorage stores files on an SFTP server, such as a NAS. It connects on
+// first use and reconnects after the connection is lost.
+type SFTPStorage struct {
+	addr   string
+	config *ssh.ClientConfig
+	root   string
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+func NewSFTPStorage(addr string, config *ssh.ClientConfig, root string) *SFTPStorage {
+	return &SFTPStorage{addr: addr, config: config, root: root}
+}
+
+func (s *SFTPStorage) Upload(path string, body io.ReadSeeker) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	path = s.remotePath(path)
+	if err := client.MkdirAll(filepath.ToSlash(filepath.Dir(path))); err != nil {
+		return err
+	}
+	tmp, err := tempName(path)
+	if err != nil {
+		return err
+	}
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(body); err != nil {
+		f.Close()
+		client.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	if err := rename(client, tmp, path); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// rename moves a file over an existing one. Rename does not overwrite files
+// in SFTP, so the old file is removed first unless the server supports the
+// POSIX rename extension.
+func rename(client *sftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		// some servers advertise the extension but fail to overwrite files
+		if err := client.PosixRename(oldname, newname); err == nil {
+			return nil
+		}
+	}
+	if err := client.Remove(newname); err != nil && !IsNotExist(err) {
+		return err
+	}
+	return client.Rename(oldname, newname)
+}
+
+func (s *SFTPStorage) Download(w io.Writer, path string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	f, err := client.Open(s.remotePath(path))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.WriteTo(w)
+	return err
+}
+
+func (s *SFTPStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	f, err := client.Open(s.remotePath(path))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(f, offset, length))
+	return err
+}
+
+func (s *SFTPStorage) Size(path string) (int64, error) {
+	client, err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := client.Stat(s.remotePath(path))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *SFTPStorage) Delete(path string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return client.Remove(s.remotePath(path))
+}
+
+// CreateRoot creates the root directory unless it exists.
+func (s *SFTPStorage) CreateRoot() error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := client.MkdirAll(s.root); err != nil {
+		// MkdirAll fails for existing directories on some servers
+		if info, statErr := client.Stat(s.root); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SFTPStorage) remotePath(path string) string {
+	return filepath.ToSlash(filepath.Join(s.root, path))
+}
+
+// connect returns the client of the current connection, or dials a new one
+// if there is no connection.
+func (s *SFTPStorage) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.client = client
+
+	go func() {
+		// forget the connection when it is closed, such as by a timeout
+		conn.Wait()
+		s.mu.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.mu.Unlock()
+		client.Close()
+	}()
+	return client, nil
+}
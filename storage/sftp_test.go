@@ -0,0 +1,127 @@
+package storage_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path"
+	"testing"
+
+	"github.com/altescy/bookshelf/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer runs a local SSH server serving files in memory, and
+// returns its address and a client configuration to connect to it.
+func startSFTPServer(t *testing.T) (string, *ssh.ClientConfig) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "bookshelf" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// connections share the files
+	handlers := sftp.InMemHandler()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, handlers)
+		}
+	}()
+
+	return l.Addr().String(), &ssh.ClientConfig{
+		User:            "bookshelf",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// the payload is the subsystem name prefixed by its length
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						server := sftp.NewRequestServer(channel, handlers)
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	addr, config := startSFTPServer(t)
+
+	s := storage.NewSFTPStorage(addr, config, "/bookshelf")
+	if err := s.CreateRoot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRoot(); err != nil {
+		t.Fatalf("existing root: %v", err)
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, s, func(name string) ([]string, error) {
+		infos, err := client.ReadDir(path.Join("/bookshelf", name))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names, nil
+	})
+}
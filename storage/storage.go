@@ -1,8 +1,47 @@
 package storage
 
-import "io"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/studio-b12/gowebdav"
+)
 
 type Storage interface {
 	Upload(path string, body io.ReadSeeker) error
 	Download(w io.Writer, path string) error
+	// DownloadRange writes length bytes of the file starting at offset.
+	DownloadRange(w io.Writer, path string, offset, length int64) error
+	Size(path string) (int64, error)
+	Delete(path string) error
+}
+
+// IsNotExist reports whether an error of a storage means that the file does
+// not exist, rather than that the storage cannot be reached.
+func IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || gowebdav.IsErrNotFound(err) {
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound
+}
+
+// tempName returns a random name next to a remote file, which the file is
+// uploaded to before it is moved into place.
+func tempName(name string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	dir, base := path.Split(name)
+	return dir + "." + base + ".tmp-" + hex.EncodeToString(b), nil
 }
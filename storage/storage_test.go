@@ -0,0 +1,70 @@
+package storage_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/altescy/bookshelf/storage"
+)
+
+// testStorage checks that a storage reads, overwrites and deletes files. list
+// returns the names of files in a directory of the storage, which must not
+// have temporary files left by uploads.
+func testStorage(t *testing.T, s storage.Storage, list func(dir string) ([]string, error)) {
+	t.Helper()
+
+	const path = "books/1/book.epub"
+	if err := s.Upload(path, strings.NewReader("first version")); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	data := []byte("second version of the book")
+	if err := s.Upload(path, bytes.NewReader(data)); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Download(&buf, path); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("download: got %q, expected %q", buf.Bytes(), data)
+	}
+
+	buf.Reset()
+	if err := s.DownloadRange(&buf, path, 7, 7); err != nil {
+		t.Fatalf("download range: %v", err)
+	}
+	if buf.String() != "version" {
+		t.Errorf("download range: got %q", buf.String())
+	}
+
+	size, err := s.Size(path)
+	if err != nil {
+		t.Fatalf("size: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("size: got %d, expected %d", size, len(data))
+	}
+
+	names, err := list("books/1")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(names) != 1 || names[0] != "book.epub" {
+		t.Errorf("files after uploads: got %v", names)
+	}
+
+	if err := s.Delete(path); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Size(path); !storage.IsNotExist(err) {
+		t.Errorf("size of deleted file: expected not exist, got %v", err)
+	}
+	if err := s.Download(&buf, path); !storage.IsNotExist(err) {
+		t.Errorf("download of deleted file: expected not exist, got %v", err)
+	}
+	if err := s.Delete(path); !storage.IsNotExist(err) {
+		t.Errorf("delete of deleted file: expected not exist, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// WebDAVStorage stores files on a WebDAV server, such as a NAS.
+type WebDAVStorage struct {
+	client *gowebdav.Client
+	root   string
+}
+
+func NewWebDAVStorage(client *gowebdav.Client, root string) *WebDAVStorage {
+	return &WebDAVStorage{client: client, root: root}
+}
+
+func (s *WebDAVStorage) Upload(path string, body io.ReadSeeker) error {
+	path = filepath.ToSlash(filepath.Join(s.root, path))
+	tmp, err := tempName(path)
+	if err != nil {
+		return err
+	}
+	// parent collections are created by WriteStream
+	if err := s.client.WriteStream(tmp, body, 0644); err != nil {
+		s.client.Remove(tmp)
+		return err
+	}
+	if err := s.client.Rename(tmp, path, true); err != nil {
+		s.client.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *WebDAVStorage) Download(w io.Writer, path string) error {
+	path = filepath.ToSlash(filepath.Join(s.root, path))
+	r, err := s.client.ReadStream(path)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (s *WebDAVStorage) DownloadRange(w io.Writer, path string, offset, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+
+	path = filepath.ToSlash(filepath.Join(s.root, path))
+	r, err := s.client.ReadStreamRange(path, offset, length)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (s *WebDAVStorage) Size(path string) (int64, error) {
+	path = filepath.ToSlash(filepath.Join(s.root, path))
+	info, err := s.client.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *WebDAVStorage) Delete(path string) error {
+	path = filepath.ToSlash(filepath.Join(s.root, path))
+	// deleting a missing file succeeds in WebDAV
+	if _, err := s.client.Stat(path); err != nil {
+		return err
+	}
+	return s.client.Remove(path)
+}
+
+// CreateRoot creates the root collection unless it exists.
+func (s *WebDAVStorage) CreateRoot() error {
+	if _, err := s.client.Stat(s.root); err == nil {
+		return nil
+	}
+	return s.client.MkdirAll(s.root, os.ModePerm)
+}
@@ -0,0 +1,54 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/altescy/bookshelf/storage"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAVStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webdav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	handler := &webdav.Handler{FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bookshelf" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bookshelf"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client := gowebdav.NewClient(server.URL, "bookshelf", "secret")
+	s := storage.NewWebDAVStorage(client, "/bookshelf")
+	if err := s.CreateRoot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRoot(); err != nil {
+		t.Fatalf("existing root: %v", err)
+	}
+
+	testStorage(t, s, func(name string) ([]string, error) {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, "bookshelf", name))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names, nil
+	})
+}